@@ -0,0 +1,159 @@
+// Package acoustid identifies audio files by their Chromaprint fingerprint. Fingerprints are
+// calculated with the fpcalc command-line tool, then looked up with the AcoustID web service.
+package acoustid
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var ErrNoFpcalc = errors.New("fpcalc not found in PATH")
+
+const FpcalcCommand = "fpcalc"
+
+// Fingerprint is a Chromaprint fingerprint for an audio file, along with its duration.
+type Fingerprint struct {
+	Fingerprint string
+	Duration    time.Duration
+}
+
+// Calculate runs fpcalc to get a fingerprint for the file at path.
+func Calculate(ctx context.Context, path string) (fp Fingerprint, err error) {
+	if _, err := exec.LookPath(FpcalcCommand); err != nil {
+		return Fingerprint{}, fmt.Errorf("%w: %w", ErrNoFpcalc, err)
+	}
+
+	cmd := exec.CommandContext(ctx, FpcalcCommand, "-json", path) //nolint:gosec // args are only args and paths
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	defer func() {
+		if err != nil && stderr.Len() > 0 {
+			err = fmt.Errorf("%w: stderr: %q", err, stderr.String())
+		}
+	}()
+
+	slog.DebugContext(ctx, "starting subprocess", "command", cmd.Args)
+
+	if err := cmd.Run(); err != nil {
+		return Fingerprint{}, fmt.Errorf("run cmd: %w", err)
+	}
+
+	var out struct {
+		Duration    float64 `json:"duration"`
+		Fingerprint string  `json:"fingerprint"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return Fingerprint{}, fmt.Errorf("decode json: %w", err)
+	}
+	if out.Fingerprint == "" {
+		return Fingerprint{}, errors.New("no fingerprint in output")
+	}
+
+	return Fingerprint{
+		Fingerprint: out.Fingerprint,
+		Duration:    time.Duration(out.Duration * float64(time.Second)),
+	}, nil
+}
+
+// Client looks up fingerprints with an AcoustID compatible web service.
+type Client struct {
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+	Limiter    *rate.Limiter
+}
+
+// Result is a single AcoustID match for a fingerprint. Score is the match confidence from 0 to 1.
+type Result struct {
+	ID         string      `json:"id"`
+	Score      float64     `json:"score"`
+	Recordings []Recording `json:"recordings"`
+}
+
+// Recording is a MusicBrainz recording linked to an AcoustID, and the releases it appears on.
+type Recording struct {
+	ID       string `json:"id"`
+	Releases []struct {
+		ID string `json:"id"`
+	} `json:"releases"`
+}
+
+// Lookup finds the AcoustIDs matching the fingerprint, best match first.
+func (c *Client) Lookup(ctx context.Context, fp Fingerprint) ([]Result, error) {
+	// https://acoustid.org/webservice#lookup
+
+	form := url.Values{}
+	form.Set("format", "json")
+	form.Set("client", c.APIKey)
+	form.Set("meta", "recordings releaseids")
+	form.Set("duration", strconv.Itoa(int(math.Round(fp.Duration.Seconds()))))
+	form.Set("fingerprint", fp.Fingerprint)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, joinPath(c.BaseURL, "lookup"), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp struct {
+		Status string `json:"status"`
+		Error  struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Results []Result `json:"results"`
+	}
+	if err := c.request(ctx, req, &resp); err != nil {
+		return nil, fmt.Errorf("request lookup: %w", err)
+	}
+	if resp.Status != "ok" {
+		return nil, fmt.Errorf("acoustid returned error %d: %s", resp.Error.Code, resp.Error.Message)
+	}
+
+	results := slices.DeleteFunc(resp.Results, func(r Result) bool { return r.ID == "" })
+	slices.SortStableFunc(results, func(a, b Result) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	return results, nil
+}
+
+func (c *Client) request(ctx context.Context, r *http.Request, dest any) error {
+	if err := c.Limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(r)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// the service gives a json body with details for 4xx errors, so only bail on 5xx
+	if resp.StatusCode/100 == 5 {
+		return fmt.Errorf("acoustid returned non 2xx: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(dest); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+func joinPath(base string, p ...string) string {
+	r, _ := url.JoinPath(base, p...)
+	return r
+}
@@ -0,0 +1,75 @@
+// Package assign solves the assignment problem, pairing up rows and columns of a cost matrix so that the total
+// cost is as low as possible. It's used to work out which local file belongs to which release track.
+package assign
+
+import "math"
+
+// Min returns the column assigned to each row of cost, minimising the total cost, using the Hungarian algorithm.
+// All rows must have the same number of columns, and there can't be more rows than columns.
+func Min(cost [][]float64) []int {
+	n := len(cost)
+	if n == 0 {
+		return nil
+	}
+	m := len(cost[0])
+	if n > m {
+		panic("more rows than columns")
+	}
+
+	// potentials for rows (u) and columns (v), and the row matched to each column (p). everything is 1-indexed
+	// so that index 0 can be used as a virtual starting row.
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1)
+	way := make([]int, m+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, m+1)
+		used := make([]bool, m+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for {
+			used[j0] = true
+			i0, delta, j1 := p[j0], math.Inf(1), 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				if cur := cost[i0-1][j-1] - u[i0] - v[j]; cur < minv[j] {
+					minv[j], way[j] = cur, j0
+				}
+				if minv[j] < delta {
+					delta, j1 = minv[j], j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	rows := make([]int, n)
+	for j := 1; j <= m; j++ {
+		if p[j] != 0 {
+			rows[p[j]-1] = j - 1
+		}
+	}
+	return rows
+}
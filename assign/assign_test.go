@@ -0,0 +1,39 @@
+package assign_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.senan.xyz/wrtag/assign"
+)
+
+func TestMin(t *testing.T) {
+	t.Parallel()
+
+	assert.Nil(t, assign.Min(nil))
+	assert.Equal(t, []int{0}, assign.Min([][]float64{{5}}))
+
+	// greedy would take the 1 in the top left, but that forces the 100
+	assert.Equal(t, []int{1, 0}, assign.Min([][]float64{
+		{1, 2},
+		{3, 100},
+	}))
+
+	assert.Equal(t, []int{2, 0, 1}, assign.Min([][]float64{
+		{9, 9, 1},
+		{1, 9, 9},
+		{9, 1, 9},
+	}))
+
+	// more columns than rows
+	assert.Equal(t, []int{2, 0}, assign.Min([][]float64{
+		{5, 5, 0},
+		{0, 5, 5},
+	}))
+}
+
+func TestMinPanicsWithMoreRows(t *testing.T) {
+	t.Parallel()
+
+	assert.Panics(t, func() { assign.Min([][]float64{{1}, {2}}) })
+}
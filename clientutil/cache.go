@@ -0,0 +1,154 @@
+package clientutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrCacheMiss = errors.New("not in cache")
+
+// Cache stores GET responses on disk so that they can be reused without making the request again. Entries
+// are fresh for TTL, after which they're revalidated with the server using their ETag or Last-Modified
+// headers, if they have any. Each entry is written to a temporary file and renamed into place, so a cache
+// directory can be shared by several processes at once.
+//
+// A nil *Cache is valid, and caches nothing.
+type Cache struct {
+	Dir string
+	TTL time.Duration
+
+	// Offline serves every request from the cache regardless of its age, and fails with ErrCacheMiss instead
+	// of making requests for anything that isn't cached.
+	Offline bool
+}
+
+// Do returns the response for r from the cache if it's fresh, otherwise it makes the request with fetch and
+// caches the result. Only successful and not found responses are cached.
+func (c *Cache) Do(r *http.Request, fetch func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if c == nil || c.Dir == "" || r.Method != http.MethodGet {
+		return fetch(r)
+	}
+
+	path := c.path(r)
+
+	cached, modTime, err := readEntry(path, r)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.WarnContext(r.Context(), "reading cache entry", "url", r.URL, "err", err)
+	}
+	if cached != nil && (c.Offline || time.Since(modTime) < c.TTL) {
+		slog.DebugContext(r.Context(), "cache hit", "url", r.URL)
+		return cached, nil
+	}
+	if c.Offline {
+		return nil, fmt.Errorf("%w: %s", ErrCacheMiss, r.URL)
+	}
+
+	if cached != nil {
+		r = r.Clone(r.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			r.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := fetch(r)
+	if err != nil {
+		if cached != nil {
+			cached.Body.Close()
+		}
+		return nil, err
+	}
+
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			slog.WarnContext(r.Context(), "refreshing cache entry", "url", r.URL, "err", err)
+		}
+		slog.DebugContext(r.Context(), "cache revalidated", "url", r.URL)
+		return cached, nil
+	}
+	if cached != nil {
+		cached.Body.Close()
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	if err := writeEntry(path, resp, body); err != nil {
+		slog.WarnContext(r.Context(), "writing cache entry", "url", r.URL, "err", err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (c *Cache) path(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.URL.String()))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(c.Dir, key[:2], key)
+}
+
+// readEntry reads a response written by writeEntry, and when it was last written or revalidated.
+func readEntry(path string, r *http.Request) (*http.Response, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), r)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("parse response: %w", err)
+	}
+	return resp, info.ModTime(), nil
+}
+
+// writeEntry atomically writes resp with body to path.
+func writeEntry(path string, resp *http.Response, body []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("make cache dir: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	stored := *resp
+	stored.Body = io.NopCloser(bytes.NewReader(body))
+	stored.ContentLength = int64(len(body))
+	stored.TransferEncoding = nil
+	if err := stored.Write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write response: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package clientutil_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/wrtag/clientutil"
+)
+
+func TestCacheRevalidate(t *testing.T) {
+	t.Parallel()
+
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, "hello")
+	}))
+	t.Cleanup(srv.Close)
+
+	cache := &clientutil.Cache{Dir: t.TempDir(), TTL: time.Hour}
+	get := func() string {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+		resp, err := cache.Do(req, srv.Client().Do)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	assert.Equal(t, "hello", get())
+	assert.Equal(t, "hello", get())
+	assert.Equal(t, 1, requests) // fresh
+
+	cache.TTL = 0
+	assert.Equal(t, "hello", get())
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 1, notModified) // stale, but not changed
+
+	cache.Offline = true
+	assert.Equal(t, "hello", get())
+	assert.Equal(t, 2, requests)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/other", nil)
+	require.NoError(t, err)
+	_, err = cache.Do(req, srv.Client().Do)
+	require.ErrorIs(t, err, clientutil.ErrCacheMiss)
+	assert.Equal(t, 2, requests)
+}
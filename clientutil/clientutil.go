@@ -1,5 +1,5 @@
 // Package clientutil provides HTTP client middleware for common functionality
-// like rate limiting, logging, and user agent management.
+// like rate limiting, logging, user agent management, and response caching.
 package clientutil
 
 import (
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.senan.xyz/wrtag"
+	"go.senan.xyz/wrtag/musicbrainz"
+)
+
+// picker asks which release to use for a dir that couldn't be imported without confirmation, like the review
+// flow in wrtagweb.
+type picker struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+func newPicker(in io.Reader, out io.Writer) *picker {
+	return &picker{in: bufio.NewScanner(in), out: out}
+}
+
+// pick is a release to import instead. Provider is empty for a pasted ID or URL, which is looked up with the
+// configured providers.
+type pick struct {
+	provider  string
+	releaseID string
+}
+
+var uuidExpr = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// pick lists the candidates in r and reads a choice. It returns false if the dir should be skipped.
+func (p *picker) pick(r *wrtag.SearchResult) (pick, bool, error) {
+	fmt.Fprintf(p.out, "candidates:\n")
+	for i, c := range r.Candidates {
+		fmt.Fprintf(p.out, "  %d) %6.2f%%  %s  %s\n", i+1, c.Score, candidateText(c), c.URL)
+	}
+
+	for {
+		fmt.Fprintf(p.out, "number to import, d<number> to show its diff, an mbid or release url, or s to skip: ")
+		if !p.in.Scan() {
+			fmt.Fprintln(p.out)
+			if err := p.in.Err(); err != nil {
+				return pick{}, false, fmt.Errorf("read choice: %w", err)
+			}
+			return pick{}, false, nil
+		}
+
+		choice := strings.TrimSpace(p.in.Text())
+		switch {
+		case choice == "":
+			continue
+		case choice == "s" || choice == "skip":
+			return pick{}, false, nil
+		case strings.HasPrefix(choice, "d"):
+			c, err := candidateAt(r.Candidates, strings.TrimSpace(strings.TrimPrefix(choice, "d")))
+			if err != nil {
+				fmt.Fprintln(p.out, err)
+				continue
+			}
+			if err := printDiff(c.Diff); err != nil {
+				return pick{}, false, err
+			}
+		case strings.Contains(choice, "/"):
+			return pick{releaseID: path.Base(strings.TrimRight(choice, "/"))}, true, nil // accept release URL
+		case uuidExpr.MatchString(choice):
+			return pick{releaseID: choice}, true, nil
+		default:
+			c, err := candidateAt(r.Candidates, choice)
+			if err != nil {
+				fmt.Fprintln(p.out, err)
+				continue
+			}
+			return pick{provider: c.Provider, releaseID: c.ReleaseID}, true, nil
+		}
+	}
+}
+
+func candidateAt(candidates []wrtag.Candidate, num string) (wrtag.Candidate, error) {
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return wrtag.Candidate{}, errors.New("unknown choice")
+	}
+	if n < 1 || n > len(candidates) {
+		return wrtag.Candidate{}, fmt.Errorf("no candidate %d", n)
+	}
+	return candidates[n-1], nil
+}
+
+// candidateText describes a candidate release well enough to tell it apart from others in the same group.
+func candidateText(c wrtag.Candidate) string {
+	var details []string
+	if !c.Release.Date.IsZero() {
+		details = append(details, strconv.Itoa(c.Release.Date.Year()))
+	}
+	if c.Release.Country != "" {
+		details = append(details, c.Release.Country)
+	}
+	if len(c.Release.Media) > 0 && c.Release.Media[0].Format != "" {
+		details = append(details, c.Release.Media[0].Format)
+	}
+	if c.Provider != "" && c.Provider != wrtag.DefaultProvider {
+		details = append(details, c.Provider)
+	}
+
+	text := musicbrainz.ArtistsString(c.Release.Artists) + " – " + c.Release.Title
+	if len(details) > 0 {
+		text += " (" + strings.Join(details, ", ") + ")"
+	}
+	return text
+}
@@ -1,10 +1,12 @@
 // Command wrtag is a command-line tool for tagging and organizing music files
-// using metadata from MusicBrainz. It supports moving, copying, and reflinking files
+// using metadata from MusicBrainz. It supports moving, copying, reflinking, and linking files
 // as well as bulk synchronization operations.
 package main
 
 import (
+	"cmp"
 	"context"
+	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
@@ -14,6 +16,8 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -25,17 +29,26 @@ import (
 	"go.senan.xyz/wrtag"
 	"go.senan.xyz/wrtag/cmd/internal/wrtagflag"
 	"go.senan.xyz/wrtag/cmd/internal/wrtaglog"
+	"go.senan.xyz/wrtag/destfs"
 	"go.senan.xyz/wrtag/fileutil"
 	"go.senan.xyz/wrtag/notifications"
 	"go.senan.xyz/wrtag/researchlink"
+	"go.senan.xyz/wrtag/tags"
 )
 
 func init() {
 	flag := flag.CommandLine
 	flag.Usage = func() {
 		fmt.Fprintf(flag.Output(), "Usage:\n")
-		fmt.Fprintf(flag.Output(), "  $ %s [<options>] move|copy|reflink [<operation options>] <path>\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s [<options>] move|copy|reflink|reflink-or-copy|hardlink|symlink [<operation options>] <path>\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s [<options>] plan [<plan options>] <path>\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s [<options>] apply [<apply options>] <plan path>\n", flag.Name())
 		fmt.Fprintf(flag.Output(), "  $ %s [<options>] sync [<sync options>] <path>...\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s [<options>] verify [<verify options>] <path>...\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s [<options>] relayout [<relayout options>] <path>...\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s [<options>] mirror [<mirror options>] <path>...\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s [<options>] undo <dest path>|last\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s [<options>] index rebuild\n", flag.Name())
 		fmt.Fprintf(flag.Output(), "\n")
 		fmt.Fprintf(flag.Output(), "Options:\n")
 		flag.PrintDefaults()
@@ -44,7 +57,15 @@ func init() {
 		fmt.Fprintf(flag.Output(), "  $ %s move -h\n", flag.Name())
 		fmt.Fprintf(flag.Output(), "  $ %s copy -h\n", flag.Name())
 		fmt.Fprintf(flag.Output(), "  $ %s reflink -h\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s reflink-or-copy -h\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s hardlink -h\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s symlink -h\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s plan -h\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s apply -h\n", flag.Name())
 		fmt.Fprintf(flag.Output(), "  $ %s sync -h\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s verify -h\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s relayout -h\n", flag.Name())
+		fmt.Fprintf(flag.Output(), "  $ %s mirror -h\n", flag.Name())
 	}
 }
 
@@ -68,16 +89,33 @@ func main() {
 		return
 	}
 
+	// the other commands read the library from the local filesystem
+	if !destfs.IsLocal(cfg.DestFS) && !slices.Contains([]string{"move", "copy", "plan", "apply"}, flag.Arg(0)) {
+		slog.Error("only move, copy, plan, and apply can be used with a remote dest-fs", "command", flag.Arg(0))
+		return
+	}
+
+	defer cfg.Index.Close()
+
 	switch command, args := flag.Arg(0), flag.Args()[1:]; command {
-	case "move", "copy", "reflink":
+	case "move", "copy", "reflink", "reflink-or-copy", "hardlink", "symlink":
 		flag := flag.NewFlagSet(command, flag.ExitOnError)
 		var (
-			yes     = flag.Bool("yes", false, "Use the found release anyway despite a low score")
-			useMBID = flag.String("mbid", "", "Overwrite matched MusicBrainz release UUID")
-			dryRun  = flag.Bool("dry-run", false, "Do a dry run of imports")
+			yes      = flag.Bool("yes", false, "Use the found release anyway despite a low score")
+			useMBID  = flag.String("mbid", "", "Overwrite matched MusicBrainz release UUID")
+			dryRun   = flag.Bool("dry-run", false, "Do a dry run of imports")
+			singles  = flag.Bool("singles", false, "Import each track in the path as a single, rather than the path as a release")
+			provider = flag.String("provider", "", "Search only this provider instead of the configured ones")
+			output   = flag.String("output", outputText, "Output format, one of text, json")
+			interact = flag.Bool("interactive", false, "Choose a release to import from the candidates if the match needs confirmation")
 		)
 		flag.Parse(args)
 
+		if err := validOutput(*output); err != nil {
+			slog.Error("parse output", "err", err)
+			return
+		}
+
 		ctx := notifications.RecordAction(context.Background())
 
 		var importCondition wrtag.ImportCondition
@@ -90,6 +128,34 @@ func main() {
 			return
 		}
 
+		if *singles && *output == outputJSON {
+			slog.Error("json output isn't supported for singles")
+			return
+		}
+
+		if *interact && (*singles || *output == outputJSON) {
+			slog.Error("interactive isn't supported for singles or json output")
+			return
+		}
+
+		if *singles && cfg.SinglesPathFormat.Root() == "" {
+			slog.Error("no singles-path-format configured")
+			return
+		}
+
+		if *singles && cfg.Index.Enabled() {
+			slog.Error("singles can't be imported with an index-path configured")
+			return
+		}
+
+		if *provider != "" {
+			if _, err := cfg.Provider(*provider); err != nil {
+				slog.Error("get provider", "err", err)
+				return
+			}
+			cfg.Providers = []string{*provider}
+		}
+
 		dir := flag.Arg(0)
 		dir, err := filepath.Abs(dir)
 		if err != nil {
@@ -106,7 +172,95 @@ func main() {
 			return
 		}
 
-		if err := runOperation(ctx, cfg, researchLinkQuerier, op, dir, importCondition, *useMBID); err != nil {
+		if !*dryRun && !recoverStaged(ctx, cfg) {
+			return
+		}
+
+		if *singles {
+			if err := runSingles(ctx, cfg, op, dir, importCondition, *useMBID); err != nil {
+				slog.Error("running", "command", command, "err", err)
+			}
+			return
+		}
+
+		var picker *picker
+		if *interact {
+			picker = newPicker(os.Stdin, os.Stderr)
+		}
+
+		if err := runOperation(ctx, cfg, researchLinkQuerier, picker, op, dir, importCondition, *useMBID, *output); err != nil {
+			slog.Error("running", "command", command, "err", err)
+			return
+		}
+
+	case "plan":
+		flag := flag.NewFlagSet(command, flag.ExitOnError)
+		var (
+			opName   = flag.String("op", "move", "Operation to plan, one of move, copy, reflink, reflink-or-copy, hardlink, symlink")
+			yes      = flag.Bool("yes", false, "Use the found release anyway despite a low score")
+			useMBID  = flag.String("mbid", "", "Overwrite matched MusicBrainz release UUID")
+			provider = flag.String("provider", "", "Search only this provider instead of the configured ones")
+		)
+		flag.Parse(args)
+
+		var importCondition wrtag.ImportCondition
+		if *yes {
+			importCondition = wrtag.Always
+		}
+
+		if flag.NArg() != 1 {
+			slog.Error("please provide a single directory")
+			return
+		}
+
+		if *provider != "" {
+			if _, err := cfg.Provider(*provider); err != nil {
+				slog.Error("get provider", "err", err)
+				return
+			}
+			cfg.Providers = []string{*provider}
+		}
+
+		dir, err := filepath.Abs(flag.Arg(0))
+		if err != nil {
+			slog.Error("making path abs", "err", err)
+			return
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		op, err := wrtagflag.OperationByName(*opName, false)
+		if err != nil {
+			slog.Error("get operation by name", "err", err)
+			return
+		}
+
+		if err := runPlan(ctx, cfg, os.Stdout, op, dir, importCondition, *useMBID); err != nil {
+			slog.Error("running", "command", command, "err", err)
+			return
+		}
+
+	case "apply":
+		flag := flag.NewFlagSet(command, flag.ExitOnError)
+		var (
+			dryRun = flag.Bool("dry-run", false, "Do a dry run of the plan")
+		)
+		flag.Parse(args)
+
+		if flag.NArg() != 1 {
+			slog.Error("please provide a single plan file")
+			return
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		if !*dryRun && !recoverStaged(ctx, cfg) {
+			return
+		}
+
+		if err := runApply(ctx, cfg, flag.Arg(0), *dryRun); err != nil {
 			slog.Error("running", "command", command, "err", err)
 			return
 		}
@@ -114,13 +268,32 @@ func main() {
 	case "sync":
 		flag := flag.NewFlagSet(command, flag.ExitOnError)
 		var (
-			ageYounger = flag.Duration("age-younger", 0, "Minimum duration a release should be left unsynced")
-			ageOlder   = flag.Duration("age-older", 0, "Maximum duration a release should be left unsynced")
-			dryRun     = flag.Bool("dry-run", false, "Do a dry run of imports")
-			numWorkers = flag.Int("num-workers", runtime.NumCPU(), "Number of directories to process concurrently")
+			opts          syncOptions
+			skipUnchanged = flag.Bool("skip-unchanged", false, "Don't write tags or run addons for releases whose data hasn't changed since they were last synced (requires index-path)")
+			numWorkers    = flag.Int("num-workers", runtime.NumCPU(), "Number of directories to process concurrently")
+			output        = flag.String("output", outputText, "Output format, one of text, json")
 		)
+		flag.DurationVar(&opts.ageYounger, "age-younger", 0, "Minimum duration a release should be left unsynced")
+		flag.DurationVar(&opts.ageOlder, "age-older", 0, "Maximum duration a release should be left unsynced")
+		flag.DurationVar(&opts.backoff, "backoff", 0, "Wait this long before trying a failing release again, doubling for each failure in a row (requires index-path)")
+		flag.DurationVar(&opts.backoffMax, "backoff-max", 30*24*time.Hour, "Maximum duration to wait before trying a failing release again")
+		flag.BoolVar(&opts.dryRun, "dry-run", false, "Do a dry run of imports")
 		flag.Parse(args)
 
+		if (*skipUnchanged || opts.backoff > 0) && !cfg.Index.Enabled() {
+			slog.Error("skip-unchanged and backoff need an index-path to keep sync state in")
+			return
+		}
+		cfg.SkipUnchanged = *skipUnchanged
+
+		if err := validOutput(*output); err != nil {
+			slog.Error("parse output", "err", err)
+			return
+		}
+		if *output == outputJSON {
+			opts.json = &jsonLines{w: os.Stdout}
+		}
+
 		ctx := notifications.RecordAction(context.Background())
 
 		// walk the whole root dir by default, or some user provided dirs if provided
@@ -143,16 +316,32 @@ func main() {
 		ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 		defer cancel()
 
+		if !opts.dryRun && !recoverStaged(ctx, cfg) {
+			return
+		}
+
 		start := time.Now()
 
 		var stats syncStats
-		if err := runSync(ctx, cfg, &stats, dirs, *ageYounger, *ageOlder, *dryRun, *numWorkers); err != nil {
+		if err := runSync(ctx, cfg, &stats, dirs, opts, *numWorkers); err != nil {
 			slog.Error("running", "command", command, "err", err)
 			return
 		}
 
 		took := time.Since(start).Truncate(time.Millisecond)
 
+		if opts.json != nil {
+			var summary syncSummaryOutput
+			summary.Summary.Saw = stats.saw.Load()
+			summary.Summary.Processed = stats.processed.Load()
+			summary.Summary.Errors = stats.errors.Load()
+			summary.Summary.TookMS = took.Milliseconds()
+			if err := opts.json.write(summary); err != nil {
+				slog.Error("write summary", "err", err)
+				return
+			}
+		}
+
 		switch {
 		case stats.errors.Load() > 0:
 			slog.Error("sync finished", "took", took, "", &stats)
@@ -162,45 +351,406 @@ func main() {
 			notifs.Sendf(ctx, notifSyncComplete, "sync finished in %v %v", took, &stats)
 		}
 
+	case "verify":
+		flag := flag.NewFlagSet(command, flag.ExitOnError)
+		var (
+			format     = flag.String("format", "text", "Report format, one of text, json")
+			numWorkers = flag.Int("num-workers", runtime.NumCPU(), "Number of directories to verify concurrently")
+		)
+		flag.Parse(args)
+
+		if *format != "text" && *format != "json" {
+			slog.Error("unknown report format", "format", *format)
+			return
+		}
+
+		// verify the whole root dir by default, or some user provided dirs if provided
+		var dirs []string
+		if args := flag.Args(); len(args) > 0 {
+			dirs = append(dirs, args...)
+		} else if root := cfg.PathFormat.Root(); root != "" {
+			dirs = append(dirs, root)
+		}
+
+		for i := range dirs {
+			var err error
+			dirs[i], err = filepath.Abs(dirs[i])
+			if err != nil {
+				slog.Error("making path abs", "err", err)
+				return
+			}
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		start := time.Now()
+
+		report, err := runVerify(ctx, cfg, dirs, *numWorkers)
+		if err != nil {
+			slog.Error("running", "command", command, "err", err)
+			return
+		}
+		if err := writeVerifyReport(os.Stdout, *format, report); err != nil {
+			slog.Error("write report", "err", err)
+			return
+		}
+
+		took := time.Since(start).Truncate(time.Millisecond)
+		if report.Errors > 0 {
+			slog.Error("verify finished", "took", took, "checked", report.Checked, "drifted", report.Drifted, "errors", report.Errors)
+			return
+		}
+		slog.Info("verify finished", "took", took, "checked", report.Checked, "drifted", report.Drifted, "errors", report.Errors)
+
+	case "relayout":
+		flag := flag.NewFlagSet(command, flag.ExitOnError)
+		var (
+			dryRun     = flag.Bool("dry-run", false, "Do a dry run of moves")
+			numWorkers = flag.Int("num-workers", runtime.NumCPU(), "Number of directories to process concurrently")
+		)
+		flag.Parse(args)
+
+		// relayout the whole root dir by default, or some user provided dirs if provided
+		var dirs []string
+		if args := flag.Args(); len(args) > 0 {
+			dirs = append(dirs, args...)
+		} else if root := cfg.PathFormat.Root(); root != "" {
+			dirs = append(dirs, root)
+		}
+
+		for i := range dirs {
+			var err error
+			dirs[i], err = filepath.Abs(dirs[i])
+			if err != nil {
+				slog.Error("making path abs", "err", err)
+				return
+			}
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		if !*dryRun && !recoverStaged(ctx, cfg) {
+			return
+		}
+
+		start := time.Now()
+
+		var stats relayoutStats
+		if err := runRelayout(ctx, cfg, &stats, dirs, *dryRun, *numWorkers); err != nil {
+			slog.Error("running", "command", command, "err", err)
+			return
+		}
+
+		took := time.Since(start).Truncate(time.Millisecond)
+		if stats.errors.Load() > 0 || stats.collisions.Load() > 0 {
+			slog.Error("relayout finished", "took", took, "", &stats)
+			return
+		}
+		slog.Info("relayout finished", "took", took, "", &stats)
+
+	case "mirror":
+		flag := flag.NewFlagSet(command, flag.ExitOnError)
+		var (
+			format     = flag.String("format", "opus", "Format to transcode to, one of opus, mp3")
+			bitrate    = flag.String("bitrate", "", "Bitrate to transcode at, like 160k (default 128k for opus, 256k for mp3)")
+			dryRun     = flag.Bool("dry-run", false, "Do a dry run of the mirror")
+			numWorkers = flag.Int("num-workers", runtime.NumCPU(), "Number of directories to transcode concurrently")
+		)
+		flag.Parse(args)
+
+		op, err := wrtag.NewTranscode(*dryRun, *format, *bitrate)
+		if err != nil {
+			slog.Error("parse format", "err", err)
+			return
+		}
+
+		// mirror the whole root dir by default, or some user provided dirs if provided
+		var dirs []string
+		if args := flag.Args(); len(args) > 0 {
+			dirs = append(dirs, args...)
+		} else if root := cfg.PathFormat.Root(); root != "" {
+			dirs = append(dirs, root)
+		}
+
+		for i := range dirs {
+			var err error
+			dirs[i], err = filepath.Abs(dirs[i])
+			if err != nil {
+				slog.Error("making path abs", "err", err)
+				return
+			}
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		start := time.Now()
+
+		var stats mirrorStats
+		if err := runMirror(ctx, cfg, &stats, op, dirs, *numWorkers); err != nil {
+			slog.Error("running", "command", command, "err", err)
+			return
+		}
+
+		took := time.Since(start).Truncate(time.Millisecond)
+		if stats.errors.Load() > 0 {
+			slog.Error("mirror finished", "took", took, "", &stats)
+			return
+		}
+		slog.Info("mirror finished", "took", took, "", &stats)
+
+	case "undo":
+		if len(args) != 1 {
+			slog.Error("please provide a single destination directory, or \"last\"")
+			return
+		}
+
+		dir := args[0]
+		if dir != wrtag.UndoLast {
+			var err error
+			dir, err = filepath.Abs(dir)
+			if err != nil {
+				slog.Error("making path abs", "err", err)
+				return
+			}
+		}
+
+		if !recoverStaged(context.Background(), cfg) {
+			return
+		}
+
+		entry, err := cfg.Journal.Undo(context.Background(), dir)
+		if err != nil {
+			slog.Error("running", "command", command, "err", err)
+			return
+		}
+		slog.Info("undid import", "operation", entry.Operation, "dest", entry.DestDir, "source", entry.SourceDir)
+
+		for _, dir := range []string{entry.DestDir, entry.SourceDir} {
+			if !fileutil.HasPrefix(dir, cfg.PathFormat.Root()) {
+				continue
+			}
+			if err := wrtag.IndexDir(context.Background(), cfg.Index, dir); err != nil {
+				slog.Error("update index", "err", err)
+				return
+			}
+		}
+
+	case "index":
+		if len(args) != 1 || args[0] != "rebuild" {
+			slog.Error("please provide an index command, one of \"rebuild\"")
+			return
+		}
+		if !cfg.Index.Enabled() {
+			slog.Error("no index-path configured")
+			return
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		start := time.Now()
+
+		numReleases, err := rebuildIndex(ctx, cfg)
+		if err != nil {
+			slog.Error("running", "command", command, "err", err)
+			return
+		}
+		slog.Info("rebuilt index", "releases", numReleases, "took", time.Since(start).Truncate(time.Millisecond))
+
 	default:
 		slog.Error("unknown command", "command", command)
 		return
 	}
 }
 
+// recoverStaged rolls back or finishes any imports into the library that were interrupted, before a command
+// changes it. Commands that only read the library, and dry runs, leave them for the next one that does.
+func recoverStaged(ctx context.Context, cfg *wrtag.Config) bool {
+	if err := wrtag.RecoverStaged(ctx, cfg); err != nil {
+		slog.Error("recover staged imports", "err", err)
+		return false
+	}
+	return true
+}
+
+// runOperation imports srcDir. If there's a picker and the match needs confirmation, it asks which release
+// to import instead, and tries again with that.
 func runOperation(
-	ctx context.Context, cfg *wrtag.Config, researchLinks *researchlink.Builder,
-	op wrtag.FileSystemOperation, srcDir string, cond wrtag.ImportCondition, useMBID string,
+	ctx context.Context, cfg *wrtag.Config, researchLinks *researchlink.Builder, picker *picker,
+	op wrtag.FileSystemOperation, srcDir string, cond wrtag.ImportCondition, useMBID string, output string,
 ) error {
+	for {
+		r, err := processOperation(ctx, cfg, researchLinks, op, srcDir, cond, useMBID, output)
+		if err == nil || picker == nil || r == nil || len(r.Candidates) == 0 {
+			return err
+		}
+
+		p, ok, pickErr := picker.pick(r)
+		if pickErr != nil {
+			return pickErr
+		}
+		if !ok {
+			slog.InfoContext(ctx, "skipped", "dir", srcDir)
+			return err
+		}
+		if p.provider != "" {
+			pickCfg := *cfg
+			pickCfg.Providers = []string{p.provider}
+			cfg = &pickCfg
+		}
+		cond, useMBID = wrtag.Always, p.releaseID
+	}
+}
+
+func processOperation(
+	ctx context.Context, cfg *wrtag.Config, researchLinks *researchlink.Builder,
+	op wrtag.FileSystemOperation, srcDir string, cond wrtag.ImportCondition, useMBID string, output string,
+) (*wrtag.SearchResult, error) {
 	r, searchErr := wrtag.ProcessDir(ctx, cfg, op, srcDir, cond, useMBID)
 	if searchErr != nil && !wrtag.IsNonFatalError(searchErr) {
-		return fmt.Errorf("processing: %w", searchErr)
+		if output == outputJSON {
+			if err := (&jsonLines{w: os.Stdout}).write(newDirOutput(srcDir, nil, nil, searchErr)); err != nil {
+				return nil, fmt.Errorf("write output: %w", err)
+			}
+		}
+		return nil, fmt.Errorf("processing: %w", searchErr)
+	}
+
+	links, err := researchLinks.Build(wrtagflag.ResearchQuery(r, searchErr == nil))
+	if err != nil {
+		return nil, fmt.Errorf("research search: %w", err)
+	}
+
+	if output == outputJSON {
+		if err := (&jsonLines{w: os.Stdout}).write(newDirOutput(srcDir, r, links, searchErr)); err != nil {
+			return nil, fmt.Errorf("write output: %w", err)
+		}
+		if searchErr != nil {
+			return r, fmt.Errorf("processing: %w", searchErr)
+		}
+		return r, nil
 	}
 
 	slog.InfoContext(ctx, "matched",
 		"score", fmt.Sprintf("%.2f%%", r.Score),
-		"url", "https://musicbrainz.org/release/"+r.Release.ID,
+		"reason", r.Reason,
+		"url", r.URL,
 	)
+	for _, c := range r.Candidates[min(1, len(r.Candidates)):] {
+		slog.InfoContext(ctx, "other candidate",
+			"score", fmt.Sprintf("%.2f%%", c.Score),
+			"url", c.URL,
+		)
+	}
 
-	tbl := table.New(os.Stderr)
-	tbl.SetFormat("\t", " ", "")
-	for _, d := range r.Diff {
-		fmt.Fprintf(tbl, "%s\t%s\t%s\n", d.Field, fmtDiff(d.Before), fmtDiff(d.After))
+	for _, t := range r.MissingTracks {
+		slog.WarnContext(ctx, "missing track", "position", t.Position, "title", t.Title)
 	}
-	if err := tbl.Flush(); err != nil {
-		return fmt.Errorf("flush table: %w", err)
+	for _, path := range r.ExtraFiles {
+		slog.WarnContext(ctx, "extra file", "path", path)
 	}
 
-	links, err := researchLinks.Build(wrtagflag.ResearchQuery(r, searchErr == nil))
-	if err != nil {
-		return fmt.Errorf("research search: %w", err)
+	if err := printDiff(r.Diff); err != nil {
+		return nil, err
 	}
+
 	for _, link := range links {
 		slog.InfoContext(ctx, "search with", "name", link.Name, "url", link.URL)
 	}
 
 	if searchErr != nil {
-		return fmt.Errorf("processing: %w", searchErr)
+		return r, fmt.Errorf("processing: %w", searchErr)
+	}
+	return r, nil
+}
+
+// runSingles imports path, or every track under it if it's a directory, as singles. A track that fails
+// doesn't stop the others.
+func runSingles(
+	ctx context.Context, cfg *wrtag.Config,
+	op wrtag.FileSystemOperation, path string, cond wrtag.ImportCondition, useMBID string,
+) error {
+	var paths []string
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && tags.CanRead(p) {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk path: %w", err)
+	}
+	if len(paths) == 0 {
+		return wrtag.ErrNoTracks
+	}
+	if useMBID != "" && len(paths) > 1 {
+		return errors.New("mbid can only be used when importing a single track")
+	}
+
+	var numErrors int
+	for _, p := range paths {
+		r, err := wrtag.ProcessSingle(ctx, cfg, op, p, cond, useMBID)
+		if err != nil && !wrtag.IsNonFatalError(err) {
+			if errors.Is(err, context.Canceled) {
+				return err
+			}
+			numErrors++
+			slog.ErrorContext(ctx, "processing track", "path", p, "err", err)
+			continue
+		}
+
+		slog.InfoContext(ctx, "matched",
+			"path", p,
+			"score", fmt.Sprintf("%.2f%%", r.Score),
+			"reason", r.Reason,
+			"url", "https://musicbrainz.org/recording/"+r.Recording.ID,
+		)
+		if err := printDiff(r.Diff); err != nil {
+			return err
+		}
+
+		if err != nil {
+			numErrors++
+			slog.ErrorContext(ctx, "processing track", "path", p, "err", err)
+		}
+	}
+
+	if numErrors > 0 {
+		return fmt.Errorf("%d of %d tracks not imported", numErrors, len(paths))
+	}
+	return nil
+}
+
+// printDiff prints a table of the fields that were compared. Columns for track length differences and
+// for how much each field took off the score are only shown if there are any.
+func printDiff(diff []wrtag.Diff) error {
+	showLengths := slices.ContainsFunc(diff, func(d wrtag.Diff) bool { return d.LengthDelta() != 0 })
+	showPenalties := slices.ContainsFunc(diff, func(d wrtag.Diff) bool { return d.Penalty > 0 })
+
+	tbl := table.New(os.Stderr)
+	tbl.SetFormat("\t", " ", "")
+	for _, d := range diff {
+		field := d.Field
+		if d.File != "" {
+			field = fmt.Sprintf("%s (%s)", d.Field, d.File)
+		}
+		cols := []string{field, fmtDiff(d.Before), fmtDiff(d.After)}
+		if showLengths {
+			cols = append(cols, fmtLengthDelta(d))
+		}
+		if showPenalties {
+			cols = append(cols, fmtPenalty(d))
+		}
+		fmt.Fprintln(tbl, strings.Join(cols, "\t"))
+	}
+	if err := tbl.Flush(); err != nil {
+		return fmt.Errorf("flush table: %w", err)
 	}
 	return nil
 }
@@ -210,11 +760,23 @@ const (
 	notifSyncError    = "sync-error"
 )
 
-func runSync(ctx context.Context, cfg *wrtag.Config, stats *syncStats, dirs []string, ageYounger, ageOlder time.Duration, dryRun bool, numWorkers int) error { //nolint:unparam
+type syncOptions struct {
+	ageYounger, ageOlder time.Duration
+	backoff, backoffMax  time.Duration
+	dryRun               bool
+
+	// json prints a document for each dir if it's set
+	json *jsonLines
+}
+
+func runSync(ctx context.Context, cfg *wrtag.Config, stats *syncStats, dirs []string, opts syncOptions, numWorkers int) error { //nolint:unparam
 	leaves := make(chan string)
 	go func() {
 		for _, d := range dirs {
 			err := fileutil.WalkLeaves(d, func(path string, _ fs.DirEntry) error {
+				if wrtag.IsStagingPath(path) {
+					return nil
+				}
 				leaves <- path
 				return nil
 			})
@@ -231,7 +793,12 @@ func runSync(ctx context.Context, cfg *wrtag.Config, stats *syncStats, dirs []st
 		wg.Go(func() {
 			ctxConsume(ctx, leaves, func(dir string) {
 				stats.saw.Add(1)
-				r, err := syncDir(ctx, cfg, ageYounger, ageOlder, wrtag.NewMove(dryRun), dir)
+				r, err := syncDir(ctx, cfg, opts, wrtag.NewMove(opts.dryRun), dir)
+				if opts.json != nil && (r != nil || err != nil) && !errors.Is(err, context.Canceled) {
+					if err := opts.json.write(newDirOutput(dir, r, nil, err)); err != nil {
+						slog.ErrorContext(ctx, "write output", "dir", dir, "err", err)
+					}
+				}
 				if err != nil && !errors.Is(err, context.Canceled) {
 					stats.errors.Add(1)
 					slog.ErrorContext(ctx, "processing dir", "dir", dir, "err", err)
@@ -268,31 +835,122 @@ func (s *syncStats) String() string {
 	return s.LogValue().String()
 }
 
-func syncDir(ctx context.Context, cfg *wrtag.Config, ageYounger, ageOlder time.Duration, op wrtag.FileSystemOperation, srcDir string) (*wrtag.SearchResult, error) {
-	if ageYounger > 0 || ageOlder > 0 {
-		info, err := os.Stat(srcDir)
-		if err != nil {
-			return nil, fmt.Errorf("stat dir: %w", err)
+func syncDir(ctx context.Context, cfg *wrtag.Config, opts syncOptions, op wrtag.FileSystemOperation, srcDir string) (*wrtag.SearchResult, error) {
+	// with an index, sync state is kept there. otherwise the dir's modification time is when it was last synced
+	state, err := cfg.Index.SyncState(ctx, srcDir)
+	haveState := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get sync state: %w", err)
+	}
+
+	if opts.ageYounger > 0 || opts.ageOlder > 0 {
+		lastSync := state.LastSuccess.Time
+		if !haveState {
+			info, err := os.Stat(srcDir)
+			if err != nil {
+				return nil, fmt.Errorf("stat dir: %w", err)
+			}
+			lastSync = info.ModTime()
 		}
-		if ageYounger > 0 && time.Since(info.ModTime()) > ageYounger {
+		if opts.ageYounger > 0 && time.Since(lastSync) > opts.ageYounger {
 			return nil, nil
 		}
-		if ageOlder > 0 && time.Since(info.ModTime()) < ageOlder {
+		if opts.ageOlder > 0 && time.Since(lastSync) < opts.ageOlder {
 			return nil, nil
 		}
 	}
 
+	if opts.backoff > 0 && state.Failures > 0 {
+		if wait := backoffDelay(opts.backoff, opts.backoffMax, state.Failures); time.Since(state.LastAttempt) < wait {
+			slog.DebugContext(ctx, "backing off failing dir", "dir", srcDir, "failures", state.Failures, "wait", wait)
+			return nil, nil
+		}
+	}
+
+	start := time.Now()
 	r, err := wrtag.ProcessDir(ctx, cfg, op, srcDir, wrtag.HighScoreOrMBID, "")
-	if err != nil {
+	if errors.Is(err, context.Canceled) {
 		return nil, err
 	}
 
-	if err := os.Chtimes(srcDir, time.Time{}, time.Now()); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return nil, fmt.Errorf("chtimes %q: %w", srcDir, err)
+	switch {
+	case !op.CanModifyDest():
+	case cfg.Index.Enabled():
+		state.Dir = srcDir
+		state.LastAttempt = start
+		if err != nil {
+			state.LastError = err.Error()
+			state.Failures++
+		} else {
+			state.LastSuccess = sql.NullTime{Time: start, Valid: true}
+			state.LastError = ""
+			state.Failures = 0
+			state.ReleaseHash = r.ReleaseHash
+			state.Dir = cmp.Or(r.DestDir, srcDir)
+		}
+		if err := cfg.Index.PutSyncState(ctx, state); err != nil {
+			return nil, fmt.Errorf("put sync state: %w", err)
+		}
+	}
+	if err != nil {
+		return r, err // with what was found, if the error isn't fatal
+	}
+
+	if !cfg.Index.Enabled() {
+		if err := os.Chtimes(srcDir, time.Time{}, time.Now()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("chtimes %q: %w", srcDir, err)
+		}
+	}
+	if op.CanModifyDest() && r.DestDir != "" {
+		if err := cfg.Index.SetSynced(ctx, r.DestDir, start); err != nil {
+			return nil, fmt.Errorf("set synced: %w", err)
+		}
 	}
 	return r, nil
 }
 
+// backoffDelay is how long to wait before trying a dir again after it failed failures times in a row.
+func backoffDelay(base, maxDelay time.Duration, failures int) time.Duration {
+	d := base
+	for range failures - 1 {
+		if d >= maxDelay/2 {
+			return maxDelay
+		}
+		d *= 2
+	}
+	return min(d, maxDelay)
+}
+
+// rebuildIndex indexes every release in the library from scratch. Directories that can't be read are logged and
+// skipped.
+func rebuildIndex(ctx context.Context, cfg *wrtag.Config) (int, error) {
+	if err := cfg.Index.Reset(ctx); err != nil {
+		return 0, fmt.Errorf("reset index: %w", err)
+	}
+
+	var numReleases int
+	err := fileutil.WalkLeaves(cfg.PathFormat.Root(), func(path string, _ fs.DirEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if wrtag.IsStagingPath(path) {
+			return nil
+		}
+		if err := wrtag.IndexDir(ctx, cfg.Index, path); err != nil {
+			slog.ErrorContext(ctx, "indexing dir", "dir", path, "err", err)
+			return nil
+		}
+		if _, err := cfg.Index.Release(ctx, path); err == nil {
+			numReleases++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("walk library: %w", err)
+	}
+	return numReleases, nil
+}
+
 func ctxConsume[T any](ctx context.Context, work <-chan T, f func(T)) {
 	for {
 		select { // prority select for ctx.Done()
@@ -320,3 +978,22 @@ func fmtDiff(diff []dmp.Diff) string {
 	}
 	return "[empty]"
 }
+
+func fmtPenalty(d wrtag.Diff) string {
+	if d.Penalty == 0 {
+		return ""
+	}
+	return fmt.Sprintf("-%.2f%%", d.Penalty)
+}
+
+func fmtLengthDelta(d wrtag.Diff) string {
+	delta := d.LengthDelta()
+	if delta == 0 {
+		return ""
+	}
+	delta = delta.Round(time.Second)
+	if delta >= 0 {
+		return "+" + delta.String()
+	}
+	return delta.String()
+}
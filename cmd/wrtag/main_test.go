@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"embed"
 	"flag"
@@ -8,6 +9,7 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -17,10 +19,13 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/pkg/sftp"
 	"github.com/rogpeppe/go-internal/testscript"
 	"go.senan.xyz/wrtag/fileutil"
 	"go.senan.xyz/wrtag/tags"
 	"go.senan.xyz/wrtag/tags/normtag"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 //go:embed testdata/responses
@@ -36,6 +41,8 @@ func TestMain(m *testing.M) {
 	os.Setenv("WRTAG_MB_RATE_LIMIT", "0")
 	os.Setenv("WRTAG_CAA_BASE_URL", "file:///testdata/responses/coverartarchive")
 	os.Setenv("WRTAG_CAA_RATE_LIMIT", "0")
+	os.Setenv("WRTAG_ACOUSTID_BASE_URL", "file:///testdata/responses/acoustid/v2")
+	os.Setenv("WRTAG_ACOUSTID_RATE_LIMIT", "0")
 
 	testscript.Main(m, map[string]func(){
 		"wrtag":     main,
@@ -47,18 +54,102 @@ func TestMain(m *testing.M) {
 		"file-mode": mainFileMode,
 		"mod-time":  mainModTime,
 		"rand":      mainRand,
+		"fpcalc":    mainFpcalc,
+		"ffmpeg":    mainFFmpeg,
 	})
 }
 
 func TestScripts(t *testing.T) {
 	t.Parallel()
 
+	sftpAddr, sftpHostKey := startSFTPServer(t)
+
 	testscript.Run(t, testscript.Params{
 		Dir:                 "testdata/scripts",
 		RequireExplicitExec: true,
+		Setup: func(env *testscript.Env) error {
+			// scripts can import to $SFTP_ADDR, which serves the local filesystem, with any password
+			env.Setenv("SFTP_ADDR", sftpAddr)
+			knownHosts := knownhosts.Line([]string{sftpAddr}, sftpHostKey) + "\n"
+			return os.WriteFile(filepath.Join(env.WorkDir, "known_hosts"), []byte(knownHosts), 0o600)
+		},
 	})
 }
 
+// startSFTPServer starts an in-process SSH server for the local filesystem, with an SFTP subsystem.
+func startSFTPServer(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("make signer: %v", err)
+	}
+
+	conf := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil },
+	}
+	conf.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, conf)
+		}
+	}()
+
+	return ln.Addr().String(), signer.PublicKey()
+}
+
+func serveSFTP(conn net.Conn, conf *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			_ = newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					return
+				}
+				_ = server.Serve()
+				_ = server.Close()
+				return
+			}
+		}()
+	}
+}
+
 func mainTag() {
 	flag.Parse()
 
@@ -233,6 +324,51 @@ func mainRand() {
 	_, _ = io.Copy(f, io.LimitReader(rand.Reader, int64(size)))
 }
 
+// mainFpcalc is a stand-in for the real fpcalc, which gives each file a fingerprint based on its name.
+func mainFpcalc() {
+	jsonOut := flag.Bool("json", false, "")
+	flag.Parse()
+
+	if !*jsonOut || flag.NArg() != 1 {
+		log.Fatalf("bad args")
+	}
+	path := flag.Arg(0)
+	if _, err := os.Stat(path); err != nil {
+		log.Fatalf("error stating: %v", err)
+	}
+	fmt.Printf(`{"duration": 0, "fingerprint": "FAKE_%s"}`+"\n", filepath.Base(path))
+}
+
+// mainFFmpeg is a stand-in for the real ffmpeg, which "encodes" audio by writing an empty file of the output's
+// format, and copies anything else, like a cover.
+func mainFFmpeg() {
+	args := os.Args[1:]
+	i := slices.Index(args, "-i")
+	if i < 0 || i+1 >= len(args) || !slices.Contains(args, "-y") {
+		log.Fatalf("bad args")
+	}
+	src, dest := args[i+1], args[len(args)-1]
+
+	if !slices.Contains(args, "-map") {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			log.Fatalf("read src: %v", err)
+		}
+		if err := os.WriteFile(dest, data, os.ModePerm); err != nil {
+			log.Fatalf("write dest: %v", err)
+		}
+		return
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		log.Fatalf("error stating: %v", err)
+	}
+	_ = os.Remove(dest)
+	if err := ensureAudioFile(dest); err != nil {
+		log.Fatalf("ensure audio file: %v", err)
+	}
+}
+
 func parsePattern(pat string) []string {
 	// assume the file exists if the pattern doesn't look like a glob
 	if fileutil.GlobEscape(pat) == pat {
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"go.senan.xyz/wrtag"
+	"go.senan.xyz/wrtag/fileutil"
+)
+
+// runMirror transcodes every release in dirs to the mirror. If the whole library is mirrored, files in the mirror
+// whose release is gone from the library are removed too.
+func runMirror(ctx context.Context, cfg *wrtag.Config, stats *mirrorStats, op wrtag.Transcode, dirs []string, numWorkers int) error {
+	root := cfg.MirrorPathFormat.Root()
+	if root == "" {
+		return errors.New("no mirror-path-format configured")
+	}
+	if lib := cfg.PathFormat.Root(); fileutil.HasPrefix(root, lib) || fileutil.HasPrefix(lib, root) {
+		return fmt.Errorf("mirror root %q can't overlap the library root %q", root, lib)
+	}
+
+	leaves := make(chan string)
+	go func() {
+		for _, d := range dirs {
+			err := fileutil.WalkLeaves(d, func(path string, _ fs.DirEntry) error {
+				if wrtag.IsStagingPath(path) {
+					return nil
+				}
+				leaves <- path
+				return nil
+			})
+			if err != nil {
+				slog.ErrorContext(ctx, "walking paths", "err", err)
+				stats.errors.Add(1)
+				continue
+			}
+		}
+		close(leaves)
+	}()
+
+	var keepMu sync.Mutex
+	keep := map[string]struct{}{}
+
+	var wg sync.WaitGroup
+	for range numWorkers {
+		wg.Go(func() {
+			ctxConsume(ctx, leaves, func(dir string) {
+				stats.saw.Add(1)
+				r, err := wrtag.Mirror(ctx, cfg, op, dir)
+				switch {
+				case errors.Is(err, context.Canceled):
+					return
+				case err != nil:
+					stats.errors.Add(1)
+					slog.ErrorContext(ctx, "mirror dir", "dir", dir, "err", err)
+					return
+				}
+
+				keepMu.Lock()
+				for _, p := range r.Paths {
+					keep[p] = struct{}{}
+				}
+				keepMu.Unlock()
+
+				stats.written.Add(uint64(r.Written))
+				stats.unchanged.Add(uint64(r.Unchanged))
+				if r.Written > 0 {
+					slog.InfoContext(ctx, "mirrored dir", "dir", dir, "dest", r.DestDir, "written", r.Written, "unchanged", r.Unchanged)
+				}
+			})
+		})
+	}
+	wg.Wait()
+
+	// only clean up after a complete run of the whole library, otherwise we'd remove what we didn't get to
+	if ctx.Err() != nil || stats.errors.Load() > 0 || !slices.Contains(dirs, cfg.PathFormat.Root()) {
+		return nil
+	}
+	removed, err := wrtag.CleanMirror(ctx, root, keep, !op.CanModifyDest())
+	if err != nil {
+		return fmt.Errorf("clean mirror: %w", err)
+	}
+	stats.removed.Add(uint64(len(removed)))
+	return nil
+}
+
+type mirrorStats struct {
+	saw       atomic.Uint64
+	written   atomic.Uint64
+	unchanged atomic.Uint64
+	removed   atomic.Uint64
+	errors    atomic.Uint64
+}
+
+func (s *mirrorStats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("saw", s.saw.Load()),
+		slog.Uint64("written", s.written.Load()),
+		slog.Uint64("unchanged", s.unchanged.Load()),
+		slog.Uint64("removed", s.removed.Load()),
+		slog.Uint64("errors", s.errors.Load()),
+	)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+
+	"go.senan.xyz/wrtag"
+	"go.senan.xyz/wrtag/researchlink"
+)
+
+// dirOutput is printed for each directory with -output json, one per line. Fields may be added, but existing
+// ones aren't changed or removed, so that scripts can rely on them.
+type dirOutput struct {
+	Dir           string        `json:"dir"`
+	ReleaseID     string        `json:"release_id,omitempty"`
+	Provider      string        `json:"provider,omitempty"`
+	URL           string        `json:"url,omitempty"`
+	Score         float64       `json:"score"`
+	Reason        string        `json:"reason,omitempty"`
+	DestDir       string        `json:"dest_dir,omitempty"`
+	Diff          []diffOutput  `json:"diff"`
+	Files         []fileOutput  `json:"files"`
+	MissingTracks []trackOutput `json:"missing_tracks,omitempty"`
+	ExtraFiles    []string      `json:"extra_files,omitempty"`
+	ResearchLinks []linkOutput  `json:"research_links,omitempty"`
+	Error         *errorOutput  `json:"error,omitempty"`
+}
+
+type diffOutput struct {
+	Field          string  `json:"field"`
+	File           string  `json:"file,omitempty"`
+	Before         string  `json:"before"`
+	After          string  `json:"after"`
+	Equal          bool    `json:"equal"`
+	Penalty        float64 `json:"penalty"`
+	BeforeLengthMS int64   `json:"before_length_ms,omitempty"`
+	AfterLengthMS  int64   `json:"after_length_ms,omitempty"`
+}
+
+type fileOutput struct {
+	Path       string `json:"path"`
+	DestPath   string `json:"dest_path"`
+	DiscNumber int    `json:"disc_number"`
+	Position   int    `json:"position"`
+	TrackID    string `json:"track_id,omitempty"`
+	Title      string `json:"title"`
+}
+
+type trackOutput struct {
+	Position int    `json:"position"`
+	Title    string `json:"title"`
+}
+
+type linkOutput struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type errorOutput struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// syncSummaryOutput is printed last by sync with -output json.
+type syncSummaryOutput struct {
+	Summary struct {
+		Saw       uint64 `json:"saw"`
+		Processed uint64 `json:"processed"`
+		Errors    uint64 `json:"errors"`
+		TookMS    int64  `json:"took_ms"`
+	} `json:"summary"`
+}
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+func validOutput(output string) error {
+	switch output {
+	case outputText, outputJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown output %q", output)
+}
+
+func newDirOutput(dir string, r *wrtag.SearchResult, links []researchlink.SearchResult, err error) dirOutput {
+	out := dirOutput{Dir: dir, Diff: []diffOutput{}, Files: []fileOutput{}}
+	if err != nil {
+		out.Error = &errorOutput{Kind: errorKind(err), Message: err.Error()}
+	}
+	for _, link := range links {
+		out.ResearchLinks = append(out.ResearchLinks, linkOutput{Name: link.Name, URL: link.URL})
+	}
+	if r == nil {
+		return out
+	}
+
+	if r.Release != nil {
+		out.ReleaseID = r.Release.ID
+	}
+	out.Provider = r.Provider
+	out.URL = r.URL
+	out.Score = r.Score
+	out.Reason = string(r.Reason)
+	out.DestDir = r.DestDir
+	for _, d := range r.Diff {
+		out.Diff = append(out.Diff, diffOutput{
+			Field:          d.Field,
+			File:           d.File,
+			Before:         diffText(d.Before),
+			After:          diffText(d.After),
+			Equal:          d.Equal,
+			Penalty:        d.Penalty,
+			BeforeLengthMS: d.BeforeLength.Milliseconds(),
+			AfterLengthMS:  d.AfterLength.Milliseconds(),
+		})
+	}
+	for _, f := range r.Files {
+		out.Files = append(out.Files, fileOutput{
+			Path:       f.Path,
+			DestPath:   f.DestPath,
+			DiscNumber: f.DiscNumber,
+			Position:   f.Track.Position,
+			TrackID:    f.Track.ID,
+			Title:      f.Track.Title,
+		})
+	}
+	for _, t := range r.MissingTracks {
+		out.MissingTracks = append(out.MissingTracks, trackOutput{Position: t.Position, Title: t.Title})
+	}
+	out.ExtraFiles = r.ExtraFiles
+	return out
+}
+
+// errorKind classifies an import error, so that scripts don't need to match error messages.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, wrtag.ErrScoreTooLow):
+		return "score_too_low"
+	case errors.Is(err, wrtag.ErrTrackCountMismatch):
+		return "track_mismatch"
+	case errors.Is(err, wrtag.ErrNeedsConfirmation):
+		return "needs_confirmation"
+	case errors.Is(err, wrtag.ErrRejected):
+		return "rejected"
+	case errors.Is(err, wrtag.ErrDuplicate):
+		return "duplicate"
+	case errors.Is(err, wrtag.ErrKeptExisting):
+		return "kept_existing"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "fatal"
+	}
+}
+
+func diffText(diffs []dmp.Diff) string {
+	var sb strings.Builder
+	for _, d := range diffs {
+		sb.WriteString(d.Text)
+	}
+	return sb.String()
+}
+
+// jsonLines writes values as JSON, one per line. It's safe to use from more than one goroutine.
+type jsonLines struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (jl *jsonLines) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	data = append(data, '\n')
+
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+	_, err = jl.w.Write(data)
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"go.senan.xyz/wrtag"
+	"go.senan.xyz/wrtag/cmd/internal/wrtagflag"
+)
+
+// runPlan matches srcDir and writes what importing it would do to w, as JSON that can be edited and given to
+// runApply.
+func runPlan(
+	ctx context.Context, cfg *wrtag.Config, w io.Writer,
+	op wrtag.FileSystemOperation, srcDir string, cond wrtag.ImportCondition, useMBID string,
+) error {
+	r, planErr := wrtag.Plan(ctx, cfg, op, srcDir, cond, useMBID)
+	if planErr != nil && !wrtag.IsNonFatalError(planErr) {
+		return fmt.Errorf("planning: %w", planErr)
+	}
+
+	slog.InfoContext(ctx, "matched",
+		"score", fmt.Sprintf("%.2f%%", r.Score),
+		"reason", r.Reason,
+		"url", r.URL,
+	)
+	if err := printDiff(r.Diff); err != nil {
+		return err
+	}
+
+	if planErr != nil {
+		return fmt.Errorf("planning: %w", planErr)
+	}
+	if r.Plan == nil {
+		return fmt.Errorf("nothing to do, release is already at %q", r.DestDir)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(r.Plan); err != nil {
+		return fmt.Errorf("write plan: %w", err)
+	}
+	return nil
+}
+
+// runApply reads a plan written by runPlan, and carries it out with the operation it was made for.
+func runApply(ctx context.Context, cfg *wrtag.Config, planPath string, dryRun bool) error {
+	data, err := os.ReadFile(planPath)
+	if err != nil {
+		return fmt.Errorf("read plan: %w", err)
+	}
+
+	// catch typos in hand edited plans, rather than quietly ignoring them
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var plan wrtag.ImportPlan
+	if err := dec.Decode(&plan); err != nil {
+		return fmt.Errorf("decode plan: %w", err)
+	}
+
+	op, err := wrtagflag.OperationByName(plan.Operation, dryRun)
+	if err != nil {
+		return fmt.Errorf("get operation by name: %w", err)
+	}
+	if err := wrtag.Apply(ctx, cfg, op, &plan); err != nil {
+		return fmt.Errorf("applying: %w", err)
+	}
+
+	slog.InfoContext(ctx, "applied plan", "operation", plan.Operation, "dest", plan.DestDir)
+	return nil
+}
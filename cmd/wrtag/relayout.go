@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"go.senan.xyz/wrtag"
+	"go.senan.xyz/wrtag/fileutil"
+)
+
+// runRelayout moves every release in dirs to where the path format says it should be, using only what's on disk.
+// The dirs are walked before anything is moved, so that releases aren't found again in their new place.
+func runRelayout(ctx context.Context, cfg *wrtag.Config, stats *relayoutStats, dirs []string, dryRun bool, numWorkers int) error {
+	var leaves []string
+	for _, d := range dirs {
+		err := fileutil.WalkLeaves(d, func(path string, _ fs.DirEntry) error {
+			if wrtag.IsStagingPath(path) {
+				return nil
+			}
+			leaves = append(leaves, path)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("walking paths: %w", err)
+		}
+	}
+
+	queue := make(chan string)
+	go func() {
+		defer close(queue)
+		for _, l := range leaves {
+			select {
+			case queue <- l:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// releases that would end up in the same dir, which a dry run can't find on disk
+	var claimsMu sync.Mutex
+	claims := map[string]string{}
+
+	var wg sync.WaitGroup
+	for range numWorkers {
+		wg.Go(func() {
+			ctxConsume(ctx, queue, func(dir string) {
+				stats.saw.Add(1)
+				r, err := wrtag.Relayout(ctx, cfg, dir, dryRun)
+				if err == nil {
+					claimsMu.Lock()
+					if other, ok := claims[r.DestDir]; ok {
+						err = fmt.Errorf("%w: %q would be moved there too", wrtag.ErrCollision, other)
+					} else {
+						claims[r.DestDir] = dir
+					}
+					claimsMu.Unlock()
+				}
+				switch {
+				case errors.Is(err, context.Canceled):
+				case errors.Is(err, wrtag.ErrCollision):
+					stats.collisions.Add(1)
+					slog.ErrorContext(ctx, "relayout collision", "dir", dir, "err", err)
+				case err != nil:
+					stats.errors.Add(1)
+					slog.ErrorContext(ctx, "relayout dir", "dir", dir, "err", err)
+				case len(r.Moves) > 0:
+					stats.moved.Add(1)
+					slog.InfoContext(ctx, "relaid out dir", "dir", dir, "dest", r.DestDir, "from", r.Source, "moves", len(r.Moves))
+				}
+			})
+		})
+	}
+	wg.Wait()
+
+	return nil
+}
+
+type relayoutStats struct {
+	saw        atomic.Uint64
+	moved      atomic.Uint64
+	collisions atomic.Uint64
+	errors     atomic.Uint64
+}
+
+func (s *relayoutStats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("saw", s.saw.Load()),
+		slog.Uint64("moved", s.moved.Load()),
+		slog.Uint64("collisions", s.collisions.Load()),
+		slog.Uint64("errors", s.errors.Load()),
+	)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.senan.xyz/wrtag"
+	"go.senan.xyz/wrtag/fileutil"
+)
+
+// verifyReport lists the releases that a sync would change, and the ones that couldn't be checked.
+type verifyReport struct {
+	Checked  int             `json:"checked"`
+	Drifted  int             `json:"drifted"`
+	Errors   int             `json:"errors"`
+	Releases []verifyRelease `json:"releases"`
+}
+
+type verifyRelease struct {
+	Dir     string `json:"dir"`
+	DestDir string `json:"dest_dir,omitempty"`
+	Error   string `json:"error,omitempty"`
+	*wrtag.Drift
+}
+
+// runVerify does a dry run sync of every release in dirs, and reports the ones that would change.
+func runVerify(ctx context.Context, cfg *wrtag.Config, dirs []string, numWorkers int) (*verifyReport, error) {
+	leaves := make(chan string)
+	var walkErr error
+	go func() {
+		defer close(leaves)
+		for _, d := range dirs {
+			err := fileutil.WalkLeaves(d, func(path string, _ fs.DirEntry) error {
+				if wrtag.IsStagingPath(path) {
+					return nil
+				}
+				leaves <- path
+				return nil
+			})
+			if err != nil {
+				walkErr = fmt.Errorf("walking paths: %w", err)
+				return
+			}
+		}
+	}()
+
+	var report verifyReport
+	var mu sync.Mutex
+
+	var wg sync.WaitGroup
+	for range numWorkers {
+		wg.Go(func() {
+			ctxConsume(ctx, leaves, func(dir string) {
+				r, err := wrtag.ProcessDir(ctx, cfg, wrtag.NewMove(true), dir, wrtag.HighScoreOrMBID, "")
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				report.Checked++
+				switch {
+				case err != nil:
+					slog.DebugContext(ctx, "verifying dir", "dir", dir, "err", err)
+					report.Errors++
+					report.Releases = append(report.Releases, verifyRelease{Dir: dir, Error: err.Error()})
+				case !r.Drift.Empty():
+					report.Drifted++
+					report.Releases = append(report.Releases, verifyRelease{Dir: dir, DestDir: r.DestDir, Drift: r.Drift})
+				}
+			})
+		})
+	}
+	wg.Wait()
+
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(report.Releases, func(a, b verifyRelease) int {
+		return cmp.Compare(a.Dir, b.Dir)
+	})
+	return &report, nil
+}
+
+func writeVerifyReport(w io.Writer, format string, report *verifyReport) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "text":
+		for _, r := range report.Releases {
+			if r.Error != "" {
+				fmt.Fprintf(w, "%s: error: %s\n", r.Dir, r.Error)
+				continue
+			}
+			fmt.Fprintf(w, "%s: %s\n", r.Dir, driftSummary(r.Drift))
+			if r.DestDir != r.Dir {
+				fmt.Fprintf(w, "  dir    %s\n", r.DestDir)
+			}
+			for _, m := range r.Moves {
+				fmt.Fprintf(w, "  move   %s -> %s\n", relTo(r.Dir, m.From), relTo(r.DestDir, m.To))
+			}
+			for _, t := range r.Retags {
+				fmt.Fprintf(w, "  retag  %s %s %q -> %q\n", relTo(r.Dir, t.Path), t.Key, t.From, t.To)
+			}
+			for _, p := range r.Deletes {
+				fmt.Fprintf(w, "  delete %s\n", relTo(r.DestDir, p))
+			}
+		}
+		fmt.Fprintf(w, "checked %d, drifted %d, errors %d\n", report.Checked, report.Drifted, report.Errors)
+		return nil
+	default:
+		return fmt.Errorf("unknown report format %q", format)
+	}
+}
+
+func driftSummary(d *wrtag.Drift) string {
+	var parts []string
+	count := func(n int, what string) {
+		if n == 0 {
+			return
+		}
+		if n > 1 {
+			what += "s"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", n, what))
+	}
+
+	retagged := map[string]struct{}{}
+	for _, t := range d.Retags {
+		retagged[t.Path] = struct{}{}
+	}
+
+	count(len(d.Moves), "move")
+	count(len(retagged), "retag")
+	count(len(d.Deletes), "delete")
+	return strings.Join(parts, ", ")
+}
+
+// relTo makes path relative to dir if it's inside it, to keep the report short.
+func relTo(dir, path string) string {
+	if rel, err := filepath.Rel(dir, path); err == nil && fileutil.HasPrefix(path, dir) {
+		return rel
+	}
+	return path
+}
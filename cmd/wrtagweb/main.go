@@ -4,6 +4,7 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/subtle"
 	"database/sql"
@@ -131,6 +132,13 @@ func main() {
 		return
 	}
 
+	if err := wrtag.RecoverStaged(ctx, cfg); err != nil {
+		slog.Error("recover staged imports", "err", err)
+		return
+	}
+
+	defer cfg.Index.Close()
+
 	var sse broadcast[uint64]
 	jobSSENew := func() { sse.send(0) }
 	jobSSEUpdate := func(id uint64) { sse.send(id) }
@@ -226,11 +234,16 @@ func main() {
 		if strings.Contains(useMBID, "/") {
 			useMBID = path.Base(useMBID) // accept release URL
 		}
+		provider := r.FormValue("provider")
+		if _, err := cfg.Provider(cmp.Or(provider, wrtag.DefaultProvider)); err != nil {
+			respErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
 		ctx := r.Context()
 
 		var job Job
-		if err := sqlb.QueryRow(ctx, db, &job, "update jobs set confirm=?, use_mbid=?, status=?, updated_time=? where id=? and status<>? returning *", confirm, useMBID, StatusEnqueued, time.Now(), id, StatusInProgress); err != nil {
+		if err := sqlb.QueryRow(ctx, db, &job, "update jobs set confirm=?, use_mbid=?, provider=?, status=?, updated_time=? where id=? and status<>? returning *", confirm, useMBID, provider, StatusEnqueued, time.Now(), id, StatusInProgress); err != nil {
 			respErr(w, http.StatusInternalServerError, "couldn't update job")
 			return
 		}
@@ -253,6 +266,49 @@ func main() {
 		jobSSENew()
 	})
 
+	mux.HandleFunc("POST /jobs/{id}/undo", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.PathValue("id"))
+
+		ctx := r.Context()
+
+		var job Job
+		if err := sqlb.QueryRow(ctx, db, &job, "select * from jobs where id=? and status=?", id, StatusComplete); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respErr(w, http.StatusNotFound, "no completed job to undo")
+				return
+			}
+			respErr(w, http.StatusInternalServerError, "couldn't get completed job")
+			return
+		}
+		if job.JournalID == "" {
+			respErr(w, http.StatusBadRequest, "job wasn't recorded in the journal")
+			return
+		}
+
+		entry, err := cfg.Journal.UndoID(ctx, job.JournalID)
+		if err != nil {
+			if errors.Is(err, wrtag.ErrNoJournalEntry) {
+				respErr(w, http.StatusNotFound, err.Error())
+				return
+			}
+			respErr(w, http.StatusInternalServerError, fmt.Sprintf("couldn't undo job: %v", err))
+			return
+		}
+		if err := wrtag.IndexDir(ctx, cfg.Index, entry.DestDir); err != nil {
+			slog.ErrorContext(ctx, "update index", "err", err)
+		}
+
+		// the files are back where they were, so the job can be retried with another release
+		if err := sqlb.QueryRow(ctx, db, &job, "update jobs set status=?, reason=?, error=?, operation=?, source_path=?, dest_path=?, journal_id=?, updated_time=? where id=? returning *", StatusNeedsInput, ReasonImportUndone, "import undone", entry.Operation, entry.SourceDir, "", "", time.Now(), id); err != nil {
+			respErr(w, http.StatusInternalServerError, "couldn't update job")
+			return
+		}
+
+		respTmpl(w, http.StatusOK, "job", job)
+
+		jobSSENew()
+	})
+
 	mux.HandleFunc("GET /dirs", func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Query().Get("path")
 		if path == "" || !filepath.IsAbs(path) {
@@ -332,11 +388,16 @@ func main() {
 			useMBID = path.Base(useMBID) // accept release URL
 		}
 		confirm, _ := strconv.ParseBool(r.FormValue("confirm"))
+		provider := r.FormValue("provider")
+		if _, err := cfg.Provider(cmp.Or(provider, wrtag.DefaultProvider)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		ctx := r.Context()
 
 		var job Job
-		if err := sqlb.QueryRow(ctx, db, &job, "insert into jobs (source_path, operation, use_mbid, confirm, time) values (?, ?, ?, ?, ?) returning *", pth, operationStr, useMBID, confirm, time.Now()); err != nil {
+		if err := sqlb.QueryRow(ctx, db, &job, "insert into jobs (source_path, operation, use_mbid, confirm, provider, time) values (?, ?, ?, ?, ?, ?) returning *", pth, operationStr, useMBID, confirm, provider, time.Now()); err != nil {
 			http.Error(w, fmt.Sprintf("error saving job: %v", err), http.StatusInternalServerError)
 			return
 		}
@@ -444,6 +505,12 @@ func processJob(ctx context.Context, cfg *wrtag.Config, notifs *notifications.No
 		ic = wrtag.Always
 	}
 
+	if job.Provider != "" {
+		jobCfg := *cfg
+		jobCfg.Providers = []string{job.Provider}
+		cfg = &jobCfg
+	}
+
 	searchResult, processErr := wrtag.ProcessDir(ctx, cfg, op, job.SourcePath, ic, job.UseMBID)
 
 	if searchResult != nil {
@@ -460,6 +527,9 @@ func processJob(ctx context.Context, cfg *wrtag.Config, notifs *notifications.No
 		if err != nil {
 			return fmt.Errorf("gen dest dir: %w", err)
 		}
+		if searchResult.DestDir != "" {
+			job.DestPath = searchResult.DestDir // may have a suffix if we kept a duplicate
+		}
 	}
 
 	if searchResult != nil {
@@ -469,16 +539,26 @@ func processJob(ctx context.Context, cfg *wrtag.Config, notifs *notifications.No
 
 	if processErr != nil {
 		job.Status = StatusError
+		job.Reason = ReasonNone
 		job.Error = processErr.Error()
-		if errors.Is(processErr, wrtag.ErrScoreTooLow) {
-			job.Status = StatusNeedsInput
+		switch {
+		case errors.Is(processErr, wrtag.ErrScoreTooLow):
+			job.Status, job.Reason = StatusNeedsInput, ReasonScoreTooLow
+		case errors.Is(processErr, wrtag.ErrNeedsConfirmation):
+			job.Status, job.Reason = StatusNeedsInput, ReasonNeedsConfirmation
+		case errors.Is(processErr, wrtag.ErrDuplicate):
+			job.Status, job.Reason = StatusNeedsInput, ReasonDuplicate
+		case errors.Is(processErr, wrtag.ErrKeptExisting):
+			job.Reason = ReasonKeptExisting
 		}
 	} else {
 		job.Status = StatusComplete
+		job.Reason = ReasonNone
 		job.Error = ""
 		job.UseMBID = ""
 		job.Operation = OperationMove // allow re-tag from dest
 		job.SourcePath = job.DestPath
+		job.JournalID = searchResult.JournalID
 	}
 
 	if err := sqlb.QueryRow(ctx, db, &job, "update jobs set ? where id=? returning *", sqlb.UpdateSQL(job), job.ID); err != nil {
@@ -595,6 +675,7 @@ var funcMap = htmltemplate.FuncMap{
 	"now":  func() int64 { return time.Now().UnixMilli() },
 	"file": func(p string) string { ur, _ := url.Parse("file://"); ur.Path = p; return ur.String() },
 	"url":  func(u string) htmltemplate.URL { return htmltemplate.URL(u) }, //nolint:gosec
+	"base": filepath.Base,
 	"join": func(delim string, items []string) string { return strings.Join(items, delim) },
 	"pad0": func(amount, n int) string { return fmt.Sprintf("%0*d", amount, n) },
 	"divc": func(a, b int) int { return int(math.Ceil(float64(a) / float64(b))) },
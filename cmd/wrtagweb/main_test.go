@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.senan.xyz/sqlb"
+	"go.senan.xyz/wrtag"
+	"go.senan.xyz/wrtag/musicbrainz"
+)
+
+func TestJobUseCandidate(t *testing.T) {
+	t.Parallel()
+
+	mbRelease := &musicbrainz.Release{ID: "e47d04a4-7460-427d-a731-cc82386d85f1", Title: "Kat Moda"}
+	discogsRelease := &musicbrainz.Release{Title: "Kat Moda"} // discogs releases have no mbid
+
+	job := Job{
+		ID:     1,
+		Status: StatusNeedsInput,
+		SearchResult: sqlb.JSON[*wrtag.SearchResult]{Data: &wrtag.SearchResult{
+			Release: mbRelease,
+			Candidates: []wrtag.Candidate{
+				{Release: mbRelease, Provider: "musicbrainz", ReleaseID: mbRelease.ID},
+				{Release: discogsRelease, Provider: "discogs", ReleaseID: "1014", URL: "https://www.discogs.com/release/1014"},
+			},
+		}},
+	}
+
+	var buff bytes.Buffer
+	require.NoError(t, uiTmpl.ExecuteTemplate(&buff, "job", job))
+
+	// the candidate is looked up with the provider it's from
+	assert.Contains(t, html.UnescapeString(buff.String()), `hx-vals='{"mbid": "1014", "provider": "discogs"}'`)
+}
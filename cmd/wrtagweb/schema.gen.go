@@ -10,7 +10,7 @@ import (
 func _() {
 	// Validate the struct fields haven't changed. If this doesn't compile you probably need to `go generate` again.
 	var j Job
-	_ = Job{j.ID, j.Status, j.Error, j.Operation, j.Time, j.UpdatedTime, j.UseMBID, j.SourcePath, j.DestPath, j.SearchResult, j.ResearchLinks, j.Confirm}
+	_ = Job{j.ID, j.Status, j.Reason, j.Error, j.Operation, j.Time, j.UpdatedTime, j.UseMBID, j.SourcePath, j.DestPath, j.SearchResult, j.ResearchLinks, j.Confirm, j.Provider, j.JournalID}
 }
 
 func (Job) IsGenerated(c string) bool {
@@ -22,7 +22,7 @@ func (Job) IsGenerated(c string) bool {
 }
 
 func (j Job) Values() []sql.NamedArg {
-	return []sql.NamedArg{sql.Named("id", j.ID), sql.Named("status", j.Status), sql.Named("error", j.Error), sql.Named("operation", j.Operation), sql.Named("time", j.Time), sql.Named("updated_time", j.UpdatedTime), sql.Named("use_mbid", j.UseMBID), sql.Named("source_path", j.SourcePath), sql.Named("dest_path", j.DestPath), sql.Named("search_result", j.SearchResult), sql.Named("research_links", j.ResearchLinks), sql.Named("confirm", j.Confirm)}
+	return []sql.NamedArg{sql.Named("id", j.ID), sql.Named("status", j.Status), sql.Named("reason", j.Reason), sql.Named("error", j.Error), sql.Named("operation", j.Operation), sql.Named("time", j.Time), sql.Named("updated_time", j.UpdatedTime), sql.Named("use_mbid", j.UseMBID), sql.Named("source_path", j.SourcePath), sql.Named("dest_path", j.DestPath), sql.Named("search_result", j.SearchResult), sql.Named("research_links", j.ResearchLinks), sql.Named("confirm", j.Confirm), sql.Named("provider", j.Provider), sql.Named("journal_id", j.JournalID)}
 }
 
 func (j *Job) ScanFrom(columns []string, rows *sql.Rows, buf []any) error {
@@ -32,6 +32,8 @@ func (j *Job) ScanFrom(columns []string, rows *sql.Rows, buf []any) error {
 			buf = append(buf, &j.ID)
 		case "status":
 			buf = append(buf, &j.Status)
+		case "reason":
+			buf = append(buf, &j.Reason)
 		case "error":
 			buf = append(buf, &j.Error)
 		case "operation":
@@ -52,6 +54,10 @@ func (j *Job) ScanFrom(columns []string, rows *sql.Rows, buf []any) error {
 			buf = append(buf, &j.ResearchLinks)
 		case "confirm":
 			buf = append(buf, &j.Confirm)
+		case "provider":
+			buf = append(buf, &j.Provider)
+		case "journal_id":
+			buf = append(buf, &j.JournalID)
 		default:
 			return fmt.Errorf("unknown column name %q", col)
 		}
@@ -24,16 +24,32 @@ const (
 	StatusComplete   JobStatus = "complete"
 )
 
+// JobReason is why a job needs input, or why it wasn't imported.
+type JobReason string
+
+const (
+	ReasonNone              JobReason = ""
+	ReasonScoreTooLow       JobReason = "score-too-low"
+	ReasonNeedsConfirmation JobReason = "needs-confirmation"
+	ReasonDuplicate         JobReason = "duplicate"
+	ReasonImportUndone      JobReason = "import-undone"
+	ReasonKeptExisting      JobReason = "kept-existing"
+)
+
 const (
-	OperationCopy    = "copy"
-	OperationMove    = "move"
-	OperationReflink = "reflink"
+	OperationCopy          = "copy"
+	OperationMove          = "move"
+	OperationReflink       = "reflink"
+	OperationReflinkOrCopy = "reflink-or-copy"
+	OperationHardlink      = "hardlink"
+	OperationSymlink       = "symlink"
 )
 
 //go:generate go tool sqlbgen type Job generated ID -- schema.gen.go
 type Job struct {
 	ID            uint64
 	Status        JobStatus
+	Reason        JobReason
 	Error         string
 	Operation     string
 	Time          time.Time
@@ -44,6 +60,8 @@ type Job struct {
 	SearchResult  sqlb.JSON[*wrtag.SearchResult]
 	ResearchLinks sqlb.JSON[[]researchlink.SearchResult]
 	Confirm       bool
+	Provider      string
+	JournalID     string
 }
 
 //go:embed schema.sql
@@ -30,3 +30,22 @@ alter table jobs
 -- 2025.09.14 add updated_time timestamp --
 alter table jobs
     add column updated_time timestamp;
+
+-- 2026.10.18 add provider --
+alter table jobs
+    add column provider text not null default "";
+
+-- 2026.10.18 add journal id --
+alter table jobs
+    add column journal_id text not null default "";
+
+-- 2026.10.18 add reason --
+alter table jobs
+    add column reason text not null default "";
+
+update jobs set reason = case
+    when error = 'import undone' then 'import-undone'
+    when error like '%release already in library' then 'duplicate'
+    when error like '%needs confirmation' then 'needs-confirmation'
+    else 'score-too-low' end
+    where status = 'needs-input';
@@ -0,0 +1,155 @@
+// Package destfs provides the filesystems that imports can be written to, either local or remote over SFTP.
+package destfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// FS is a filesystem that releases are imported to. Paths are absolute and slash separated on remote
+// filesystems.
+type FS interface {
+	Stat(name string) (fs.FileInfo, error)
+	// Lstat is like Stat, but doesn't follow a symlink at name.
+	Lstat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	MkdirAll(name string) error
+	Create(name string) (io.WriteCloser, error)
+	Chmod(name string, mode fs.FileMode) error
+	// Rename moves oldname to newname, replacing newname if it exists.
+	Rename(oldname, newname string) error
+	Remove(name string) error
+}
+
+// IsLocal returns whether fsys is the local filesystem, which a nil FS is too.
+func IsLocal(fsys FS) bool {
+	_, ok := fsys.(Local)
+	return fsys == nil || ok
+}
+
+// Upload copies the local file src to dest in fsys. It's written next to dest and renamed into place once it's
+// complete, so that a half written file is never at dest.
+func Upload(fsys FS, src, dest string, mode fs.FileMode) (err error) {
+	srcf, err := os.Open(src) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("open src: %w", err)
+	}
+	defer srcf.Close()
+
+	if err := fsys.MkdirAll(path.Dir(dest)); err != nil {
+		return fmt.Errorf("create dest dir: %w", err)
+	}
+
+	tmp := path.Join(path.Dir(dest), ".wrtag-upload-tmp-"+strconv.FormatInt(time.Now().UnixNano(), 36)+"-"+path.Base(dest))
+	defer func() {
+		if err != nil {
+			if rerr := fsys.Remove(tmp); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) {
+				err = errors.Join(err, rerr)
+			}
+		}
+	}()
+
+	w, err := fsys.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create tmp: %w", err)
+	}
+	if _, err := io.Copy(w, srcf); err != nil {
+		w.Close()
+		return fmt.Errorf("do copy: %w", err)
+	}
+	if f, ok := w.(*os.File); ok {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("sync tmp: %w", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("close tmp: %w", err)
+	}
+	if err := fsys.Chmod(tmp, mode); err != nil {
+		return fmt.Errorf("chmod tmp: %w", err)
+	}
+	if err := fsys.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("rename tmp: %w", err)
+	}
+	return nil
+}
+
+// Move moves the local file src to dest in fsys, keeping its mode. On the local filesystem it's renamed if it
+// can be. Otherwise, like on a remote filesystem, it's uploaded and then removed.
+func Move(fsys FS, src, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("stat src: %w", err)
+	}
+	if IsLocal(fsys) {
+		err := os.Rename(src, dest)
+		if err == nil {
+			return nil
+		}
+		if errNo := syscall.Errno(0); !errors.As(err, &errNo) || errNo != 18 /* invalid cross-device link */ {
+			return fmt.Errorf("rename: %w", err)
+		}
+	}
+	if err := Upload(fsys, src, dest, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("upload from move: %w", err)
+	}
+	if err := os.Remove(src); err != nil {
+		return fmt.Errorf("remove from move: %w", err)
+	}
+	return nil
+}
+
+// Local is the local filesystem.
+type Local struct{}
+
+func (Local) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (Local) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (Local) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (Local) MkdirAll(name string) error {
+	return os.MkdirAll(name, 0o750)
+}
+
+func (Local) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name) //nolint:gosec
+}
+
+func (Local) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (Local) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (Local) Remove(name string) error {
+	return os.Remove(name)
+}
@@ -0,0 +1,164 @@
+package destfs_test
+
+import (
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.senan.xyz/wrtag/destfs"
+)
+
+func TestUpload(t *testing.T) {
+	t.Parallel()
+
+	for name, newFS := range map[string]func(t *testing.T) destfs.FS{
+		"local": func(t *testing.T) destfs.FS { return destfs.Local{} },
+		"sftp":  newPipeSFTP,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fsys := newFS(t)
+			dir := t.TempDir()
+
+			src := filepath.Join(t.TempDir(), "src")
+			require.NoError(t, os.WriteFile(src, []byte("new"), 0o600))
+
+			// parents are created
+			dest := filepath.Join(dir, "a", "b", "dest")
+			require.NoError(t, destfs.Upload(fsys, src, dest, 0o640))
+			assertFile(t, dest, "new", 0o640)
+
+			// and existing files are replaced
+			require.NoError(t, os.WriteFile(src, []byte("newer"), 0o600))
+			require.NoError(t, destfs.Upload(fsys, src, dest, 0o640))
+			assertFile(t, dest, "newer", 0o640)
+
+			// with nothing left behind
+			infos, err := fsys.ReadDir(filepath.Dir(dest))
+			require.NoError(t, err)
+			require.Len(t, infos, 1)
+			assert.Equal(t, "dest", infos[0].Name())
+
+			require.NoError(t, fsys.Remove(dest))
+			_, err = fsys.Stat(dest)
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+
+			// a missing source doesn't leave anything behind either
+			require.Error(t, destfs.Upload(fsys, filepath.Join(dir, "missing"), dest, 0o640))
+			infos, err = fsys.ReadDir(filepath.Dir(dest))
+			require.NoError(t, err)
+			assert.Empty(t, infos)
+		})
+	}
+}
+
+func TestMove(t *testing.T) {
+	t.Parallel()
+
+	for name, newFS := range map[string]func(t *testing.T) destfs.FS{
+		"local": func(t *testing.T) destfs.FS { return destfs.Local{} },
+		"sftp":  newPipeSFTP,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fsys := newFS(t)
+			dir := t.TempDir()
+
+			src := filepath.Join(dir, "src")
+			require.NoError(t, os.WriteFile(src, []byte("new"), 0o640))
+
+			// the mode is kept, and the source is gone
+			dest := filepath.Join(dir, "dest")
+			require.NoError(t, destfs.Move(fsys, src, dest))
+			assertFile(t, dest, "new", 0o640)
+			_, err := os.Stat(src)
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+
+			// a missing source leaves the dest alone
+			require.Error(t, destfs.Move(fsys, src, dest))
+			assertFile(t, dest, "new", 0o640)
+		})
+	}
+}
+
+func TestSFTPReconnect(t *testing.T) {
+	t.Parallel()
+
+	var dials int
+	var client *sftp.Client
+	fsys := destfs.NewSFTP(func() (*sftp.Client, error) {
+		dials++
+		client = pipeClient(t)
+		return client, nil
+	})
+
+	dir := t.TempDir()
+	_, err := fsys.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, dials)
+
+	// the connection is lost, so the next call fails and the one after that dials again
+	require.NoError(t, client.Close())
+	_, err = fsys.Stat(dir)
+	require.ErrorIs(t, err, sftp.ErrSSHFxConnectionLost)
+
+	_, err = fsys.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 2, dials)
+}
+
+func TestIsLocal(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, destfs.IsLocal(nil))
+	assert.True(t, destfs.IsLocal(destfs.Local{}))
+	assert.False(t, destfs.IsLocal(destfs.NewSFTP(nil)))
+}
+
+func newPipeSFTP(t *testing.T) destfs.FS {
+	fsys := destfs.NewSFTP(func() (*sftp.Client, error) { return pipeClient(t), nil })
+	t.Cleanup(func() { _ = fsys.Close() })
+	return fsys
+}
+
+// pipeClient returns a client connected to an in-process server for the local filesystem.
+func pipeClient(t *testing.T) *sftp.Client {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	require.NoError(t, err)
+	go func() {
+		_ = server.Serve()
+		_ = server.Close()
+	}()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func assertFile(t *testing.T, path string, data string, mode fs.FileMode) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(got))
+
+	info, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, mode, info.Mode().Perm())
+}
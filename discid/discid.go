@@ -0,0 +1,291 @@
+// Package discid reads CD tables of contents from rip logs and CUE sheets, and calculates
+// MusicBrainz disc IDs from them.
+package discid
+
+import (
+	"bufio"
+	"crypto/sha1" //nolint:gosec // the disc id algorithm is defined with sha1
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+
+	"go.senan.xyz/wrtag/fileutil"
+)
+
+// https://musicbrainz.org/doc/Disc_ID_Calculation
+
+var ErrNoTOC = errors.New("no table of contents found")
+
+const (
+	sectorsPerSecond = 75
+	pregapSectors    = 150   // the 2 second lead-in before the first track
+	dataTrackGap     = 11400 // gap between the audio and data sessions on an enhanced CD
+)
+
+// TOC is a CD table of contents. Offsets are in sectors, and include the 150 sector lead-in.
+type TOC struct {
+	FirstTrack, LastTrack int
+	LeadOut               int
+	Offsets               []int
+}
+
+// DiscID returns the MusicBrainz disc ID for the TOC.
+func (t *TOC) DiscID() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%02X", t.FirstTrack)
+	fmt.Fprintf(&b, "%02X", t.LastTrack)
+	fmt.Fprintf(&b, "%08X", t.LeadOut)
+	for i := range 99 {
+		var offset int
+		if i < len(t.Offsets) {
+			offset = t.Offsets[i]
+		}
+		fmt.Fprintf(&b, "%08X", offset)
+	}
+
+	sum := sha1.Sum([]byte(b.String())) //nolint:gosec // the disc id algorithm is defined with sha1
+	return discIDEncoding.EncodeToString(sum[:])
+}
+
+// String formats the TOC the way the MusicBrainz web service expects for fuzzy lookups. For example
+// "1 6 95462 150 15363 32314 46592 63414 80489".
+func (t *TOC) String() string {
+	parts := []string{strconv.Itoa(t.FirstTrack), strconv.Itoa(t.LastTrack), strconv.Itoa(t.LeadOut)}
+	for _, o := range t.Offsets {
+		parts = append(parts, strconv.Itoa(o))
+	}
+	return strings.Join(parts, " ")
+}
+
+var discIDEncoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789._").WithPadding('-')
+
+// Find looks for a rip log in dir, and then a CUE sheet. Logs are preferred since they have the exact TOC, while
+// a CUE sheet needs the length of the audio it references from fileLength. It returns nil if no TOC was found.
+// If there are several, like for a multi disc release, only the first is used.
+func Find(dir string, fileLength func(path string) (time.Duration, error)) (*TOC, error) {
+	logs, err := fileutil.GlobDir(dir, "*.log")
+	if err != nil {
+		return nil, fmt.Errorf("glob for logs: %w", err)
+	}
+	for _, path := range logs {
+		toc, err := parseFile(path, ParseLog)
+		if errors.Is(err, ErrNoTOC) {
+			continue // maybe some other sort of log
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse log: %w", err)
+		}
+		return toc, nil
+	}
+
+	cues, err := fileutil.GlobDir(dir, "*.cue")
+	if err != nil {
+		return nil, fmt.Errorf("glob for cues: %w", err)
+	}
+	for _, path := range cues {
+		toc, err := parseFile(path, func(r io.Reader) (*TOC, error) {
+			return ParseCue(r, func(name string) (time.Duration, error) {
+				return fileLength(filepath.Join(dir, name))
+			})
+		})
+		if errors.Is(err, ErrNoTOC) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse cue: %w", err)
+		}
+		return toc, nil
+	}
+
+	return nil, nil
+}
+
+func parseFile(path string, parse func(io.Reader) (*TOC, error)) (*TOC, error) {
+	f, err := os.Open(path) //nolint:gosec // path is from the release dir
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	// EAC writes its logs in UTF-16, XLD in UTF-8
+	r := transform.NewReader(f, unicode.BOMOverride(encoding.Nop.NewDecoder()))
+	return parse(r)
+}
+
+// EAC and XLD both have a TOC section like
+//
+//	Track |   Start  |  Length  | Start sector | End sector
+//	---------------------------------------------------------
+//	   1  |  0:00.00 |  3:24.59 |         0    |    15358
+//	   2  |  3:24.59 |  4:13.65 |     15359    |    34373
+var logTOCLineExpr = regexp.MustCompile(`^\s*(\d+)\s*\|\s*[\d:.]+\s*\|\s*[\d:.]+\s*\|\s*(\d+)\s*\|\s*(\d+)\s*$`)
+
+// ParseLog reads the TOC from an EAC or XLD rip log.
+func ParseLog(r io.Reader) (*TOC, error) {
+	type logTrack struct{ num, start, end int }
+	var tracks []logTrack
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		m := logTOCLineExpr.FindStringSubmatch(sc.Text())
+		if m == nil {
+			if len(tracks) > 0 {
+				break // end of the TOC section
+			}
+			continue
+		}
+		num, _ := strconv.Atoi(m[1])
+		start, _ := strconv.Atoi(m[2])
+		end, _ := strconv.Atoi(m[3])
+		tracks = append(tracks, logTrack{num, start, end})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	if len(tracks) == 0 {
+		return nil, ErrNoTOC
+	}
+
+	last := tracks[len(tracks)-1]
+	leadOut := last.end + 1
+
+	// enhanced CDs have a data track in a second session, which isn't part of the disc id
+	if len(tracks) > 1 {
+		if prev := tracks[len(tracks)-2]; last.start-(prev.end+1) == dataTrackGap {
+			tracks = tracks[:len(tracks)-1]
+			leadOut = prev.end + 1
+		}
+	}
+
+	toc := &TOC{
+		FirstTrack: tracks[0].num,
+		LastTrack:  tracks[len(tracks)-1].num,
+		LeadOut:    leadOut + pregapSectors,
+	}
+	for _, t := range tracks {
+		toc.Offsets = append(toc.Offsets, t.start+pregapSectors)
+	}
+	return toc, nil
+}
+
+// ParseCue reads the TOC from a CUE sheet. CUE sheets don't say where the disc ends, so fileLength is used to get
+// the length of each audio file referenced. Since those lengths aren't sector accurate, the TOC may be slightly off,
+// which is fine for a fuzzy TOC lookup but may not give the exact disc ID.
+func ParseCue(r io.Reader, fileLength func(name string) (time.Duration, error)) (*TOC, error) {
+	var files []string
+	type cueTrack struct {
+		num, file, index int // index 01 frames, relative to the start of its file
+		audio            bool
+	}
+	var tracks []cueTrack
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := cueFields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "FILE":
+			files = append(files, fields[1])
+		case "TRACK":
+			num, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("parse track number %q: %w", fields[1], err)
+			}
+			audio := len(fields) > 2 && strings.EqualFold(fields[2], "AUDIO")
+			tracks = append(tracks, cueTrack{num: num, file: -1, index: -1, audio: audio})
+		case "INDEX":
+			if len(tracks) == 0 || len(fields) < 3 || fields[1] != "01" {
+				continue
+			}
+			frames, err := parseMSF(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("parse index: %w", err)
+			}
+			// the file for the track is the one where it actually starts. with a file per track, the
+			// pregap (index 00) may be at the end of the previous file
+			tracks[len(tracks)-1].file = len(files) - 1
+			tracks[len(tracks)-1].index = frames
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+
+	// data tracks can't be placed without sector accurate lengths, so only consider the audio session
+	for len(tracks) > 0 && !tracks[len(tracks)-1].audio {
+		tracks = tracks[:len(tracks)-1]
+	}
+	if len(tracks) == 0 || len(files) == 0 {
+		return nil, ErrNoTOC
+	}
+
+	// where each file starts on the disc
+	fileStarts := make([]int, len(files)+1)
+	for i, name := range files {
+		length, err := fileLength(name)
+		if err != nil {
+			return nil, fmt.Errorf("get length of %q: %w", name, err)
+		}
+		fileStarts[i+1] = fileStarts[i] + int(length.Seconds()*sectorsPerSecond+0.5)
+	}
+
+	toc := &TOC{
+		FirstTrack: tracks[0].num,
+		LastTrack:  tracks[len(tracks)-1].num,
+		LeadOut:    fileStarts[tracks[len(tracks)-1].file+1] + pregapSectors,
+	}
+	for _, t := range tracks {
+		if t.file < 0 || t.index < 0 {
+			return nil, fmt.Errorf("track %d has no file or index: %w", t.num, ErrNoTOC)
+		}
+		toc.Offsets = append(toc.Offsets, fileStarts[t.file]+t.index+pregapSectors)
+	}
+	return toc, nil
+}
+
+// cueFields splits a CUE sheet line on spaces, keeping quoted strings together.
+func cueFields(line string) []string {
+	var fields []string
+	line = strings.TrimSpace(line)
+	for line != "" {
+		var field string
+		if rest, ok := strings.CutPrefix(line, `"`); ok {
+			field, line, _ = strings.Cut(rest, `"`)
+		} else {
+			field, line, _ = strings.Cut(line, " ")
+		}
+		fields = append(fields, field)
+		line = strings.TrimSpace(line)
+	}
+	return fields
+}
+
+// parseMSF parses a "mm:ss:ff" timestamp into sectors.
+func parseMSF(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var nums [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q: %w", s, err)
+		}
+		nums[i] = n
+	}
+	return (nums[0]*60+nums[1])*sectorsPerSecond + nums[2], nil
+}
@@ -0,0 +1,102 @@
+package discid
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscID(t *testing.T) {
+	t.Parallel()
+
+	toc := TOC{
+		FirstTrack: 1,
+		LastTrack:  6,
+		LeadOut:    95462,
+		Offsets:    []int{150, 15363, 32314, 46592, 63414, 80489},
+	}
+	assert.Equal(t, "49HHV7Eb8UKF3aQiNmu1GR8vKTY-", toc.DiscID())
+	assert.Equal(t, "1 6 95462 150 15363 32314 46592 63414 80489", toc.String())
+}
+
+func TestParseLog(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"eac.log", "xld.log"} {
+		toc, err := parseFile("testdata/"+name, ParseLog)
+		require.NoError(t, err, name)
+		assert.Equal(t, "1 6 95462 150 15363 32314 46592 63414 80489", toc.String(), name)
+	}
+}
+
+func TestParseLogDataTrack(t *testing.T) {
+	t.Parallel()
+
+	const log = `
+     Track |   Start  |  Length  | Start sector | End sector
+    ---------------------------------------------------------
+        1  |  0:00.00 |  3:24.38 |         0    |    15212
+        2  |  3:24.38 |  3:46.01 |     15213    |    32163
+        3  |  7:10.39 | 10:00.00 |     43564    |    88563
+`
+	toc, err := ParseLog(strings.NewReader(log))
+	require.NoError(t, err)
+	assert.Equal(t, "1 2 32314 150 15363", toc.String())
+}
+
+func TestParseLogNoTOC(t *testing.T) {
+	t.Parallel()
+
+	_, err := ParseLog(strings.NewReader("some other log\n"))
+	require.ErrorIs(t, err, ErrNoTOC)
+}
+
+func TestParseCue(t *testing.T) {
+	t.Parallel()
+
+	lengths := map[string]time.Duration{
+		"image.flac": 95312 * time.Second / sectorsPerSecond,
+		"01.flac":    15213 * time.Second / sectorsPerSecond,
+		"02.flac":    16951 * time.Second / sectorsPerSecond,
+	}
+	fileLength := func(name string) (time.Duration, error) { return lengths[name], nil }
+
+	// one file for the whole disc
+	const imageCue = `
+FILE "image.flac" WAVE
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    INDEX 00 03:20:00
+    INDEX 01 03:22:63
+  TRACK 03 AUDIO
+    INDEX 01 07:08:64
+  TRACK 04 AUDIO
+    INDEX 01 10:19:17
+  TRACK 05 AUDIO
+    INDEX 01 14:03:39
+  TRACK 06 AUDIO
+    INDEX 01 17:51:14
+`
+	toc, err := ParseCue(strings.NewReader(imageCue), fileLength)
+	require.NoError(t, err)
+	assert.Equal(t, "1 6 95462 150 15363 32314 46592 63414 80489", toc.String())
+	assert.Equal(t, "49HHV7Eb8UKF3aQiNmu1GR8vKTY-", toc.DiscID())
+
+	// a file per track, with the pregap at the end of the previous file
+	const splitCue = `
+FILE "01.flac" WAVE
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    INDEX 00 03:20:00
+FILE "02.flac" WAVE
+    INDEX 01 00:00:00
+`
+	toc, err = ParseCue(strings.NewReader(splitCue), fileLength)
+	require.NoError(t, err)
+	assert.Equal(t, "1 2 32314 150 15363", toc.String())
+}
@@ -0,0 +1,414 @@
+// Package discogs provides a client for the Discogs API, mapping its releases into the MusicBrainz release
+// model so they can be tagged and formatted in the same way.
+package discogs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.senan.xyz/wrtag/clientutil"
+	"go.senan.xyz/wrtag/musicbrainz"
+	"golang.org/x/time/rate"
+)
+
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+	Limiter    *rate.Limiter
+
+	// Cache optionally stores responses so they can be reused without waiting for the Limiter.
+	Cache *clientutil.Cache
+}
+
+// Name is the name of the Discogs provider.
+func (c *Client) Name() string {
+	return "discogs"
+}
+
+// ReleaseURL is the Discogs web page for a release ID.
+func (c *Client) ReleaseURL(id string) string {
+	return "https://www.discogs.com/release/" + id
+}
+
+// SearchReleases returns the IDs of the top limit releases for a query, in Discogs' search order. Discogs
+// doesn't score its results, so the scores are always 0.
+func (c *Client) SearchReleases(ctx context.Context, q musicbrainz.ReleaseQuery, limit int) ([]musicbrainz.ReleaseSearchResult, error) {
+	// https://www.discogs.com/developers#page:database,header:database-search
+
+	urlV := url.Values{}
+	if q.Release != "" {
+		urlV.Set("release_title", q.Release)
+	}
+	if q.Artist != "" {
+		urlV.Set("artist", q.Artist)
+	}
+	if q.Label != "" {
+		urlV.Set("label", q.Label)
+	}
+	if q.CatalogueNum != "" {
+		urlV.Set("catno", q.CatalogueNum)
+	}
+	if q.Barcode != "" {
+		urlV.Set("barcode", q.Barcode)
+	}
+	if !q.Date.IsZero() {
+		urlV.Set("year", strconv.Itoa(q.Date.Year()))
+	}
+	if len(urlV) == 0 {
+		return nil, musicbrainz.ErrNoResults
+	}
+	urlV.Set("type", "release")
+	urlV.Set("per_page", strconv.Itoa(max(limit, 1)))
+
+	url, _ := url.Parse(joinPath(c.BaseURL, "database", "search"))
+	url.RawQuery = urlV.Encode()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+
+	var sr struct {
+		Results []struct {
+			ID   int    `json:"id"`
+			Type string `json:"type"`
+		} `json:"results"`
+	}
+	if err := c.request(ctx, req, &sr); err != nil {
+		return nil, fmt.Errorf("request search: %w", err)
+	}
+
+	var results []musicbrainz.ReleaseSearchResult
+	for _, r := range sr.Results {
+		if r.Type != "release" || r.ID == 0 {
+			continue
+		}
+		results = append(results, musicbrainz.ReleaseSearchResult{ID: strconv.Itoa(r.ID)})
+	}
+	if len(results) == 0 {
+		return nil, musicbrainz.ErrNoResults
+	}
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// GetRelease gets a Discogs release by ID, mapped into a MusicBrainz release. The MusicBrainz IDs of the
+// release and everything in it are left empty.
+func (c *Client) GetRelease(ctx context.Context, id string) (*musicbrainz.Release, error) {
+	release, err := c.getRelease(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return release.mapRelease(), nil
+}
+
+// GetCoverURL returns the URL of the primary image of a release, or any image if it has no primary one.
+func (c *Client) GetCoverURL(ctx context.Context, id string, _ *musicbrainz.Release) (string, error) {
+	release, err := c.getRelease(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	for _, img := range release.Images {
+		if img.Type == "primary" {
+			return img.URI, nil
+		}
+	}
+	if len(release.Images) > 0 {
+		return release.Images[0].URI, nil
+	}
+	return "", nil
+}
+
+func (c *Client) getRelease(ctx context.Context, id string) (*Release, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, joinPath(c.BaseURL, "releases", id), nil)
+
+	var release Release
+	if err := c.request(ctx, req, &release); err != nil {
+		return nil, fmt.Errorf("request release: %w", err)
+	}
+	return &release, nil
+}
+
+func (c *Client) request(ctx context.Context, r *http.Request, dest any) error {
+	if c.Token != "" {
+		r.Header.Set("Authorization", "Discogs token="+c.Token)
+	}
+
+	r = r.WithContext(ctx)
+	resp, err := c.Cache.Do(r, func(r *http.Request) (*http.Response, error) {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		return c.HTTPClient.Do(r)
+	})
+	if err != nil {
+		return fmt.Errorf("make discogs request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("discogs returned non 2xx: %w", musicbrainz.StatusError(resp.StatusCode))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(dest); err != nil {
+		return fmt.Errorf("decode discogs response: %w", err)
+	}
+	return nil
+}
+
+type Release struct {
+	ID       int      `json:"id"`
+	Title    string   `json:"title"`
+	Country  string   `json:"country"`
+	Released string   `json:"released"`
+	Year     int      `json:"year"`
+	Genres   []string `json:"genres"`
+	Styles   []string `json:"styles"`
+	Artists  []Artist `json:"artists"`
+	Labels   []struct {
+		Name  string `json:"name"`
+		CatNo string `json:"catno"`
+	} `json:"labels"`
+	Formats []struct {
+		Name         string   `json:"name"`
+		Qty          string   `json:"qty"`
+		Descriptions []string `json:"descriptions"`
+	} `json:"formats"`
+	Identifiers []struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"identifiers"`
+	Images []struct {
+		Type string `json:"type"`
+		URI  string `json:"uri"`
+	} `json:"images"`
+	Tracklist []Track `json:"tracklist"`
+}
+
+type Artist struct {
+	Name string `json:"name"`
+	ANV  string `json:"anv"`
+	Join string `json:"join"`
+}
+
+type Track struct {
+	Position  string   `json:"position"`
+	Type      string   `json:"type_"`
+	Title     string   `json:"title"`
+	Duration  string   `json:"duration"`
+	Artists   []Artist `json:"artists"`
+	SubTracks []Track  `json:"sub_tracks"`
+}
+
+func (r *Release) mapRelease() *musicbrainz.Release {
+	var release musicbrainz.Release
+	release.Title = r.Title
+	release.Country = r.Country
+	release.Artists = mapArtists(r.Artists)
+	release.Date.Time = parseReleased(r.Released, r.Year)
+
+	for _, id := range r.Identifiers {
+		if id.Type == "Barcode" {
+			release.Barcode = strings.ReplaceAll(id.Value, " ", "")
+			break
+		}
+	}
+	for _, l := range r.Labels {
+		var li musicbrainz.LabelInfo
+		li.Label.Name = trimNumbering(l.Name)
+		if !strings.EqualFold(l.CatNo, "none") {
+			li.CatalogNumber = l.CatNo
+		}
+		release.LabelInfo = append(release.LabelInfo, li)
+	}
+	for _, g := range slices.Concat(r.Genres, r.Styles) {
+		name := strings.ToLower(g)
+		release.Genres = append(release.Genres, musicbrainz.Genre{ID: name, Name: name, Count: 1})
+	}
+
+	release.ReleaseGroup.Title = r.Title
+	release.ReleaseGroup.Artists = release.Artists
+	release.ReleaseGroup.FirstReleaseDate = release.Date
+	release.ReleaseGroup.PrimaryType = musicbrainz.Album
+
+	var format string
+	if len(r.Formats) > 0 {
+		f := r.Formats[0]
+		format = mapFormat(f.Name, f.Descriptions)
+		for _, d := range f.Descriptions {
+			switch d {
+			case "EP":
+				release.ReleaseGroup.PrimaryType = musicbrainz.EP
+			case "Single":
+				release.ReleaseGroup.PrimaryType = musicbrainz.Single
+			case "Compilation":
+				release.ReleaseGroup.SecondaryTypes = append(release.ReleaseGroup.SecondaryTypes, musicbrainz.Compilation)
+			}
+		}
+	}
+
+	media := map[int]*musicbrainz.Media{}
+	var positions []int
+	for _, t := range flattenTracks(r.Tracklist) {
+		disc := discNumber(t.Position)
+		m, ok := media[disc]
+		if !ok {
+			m = &musicbrainz.Media{Position: disc, Format: format}
+			media[disc] = m
+			positions = append(positions, disc)
+		}
+
+		artists := release.Artists
+		if len(t.Artists) > 0 {
+			artists = mapArtists(t.Artists)
+		}
+		length := parseDuration(t.Duration)
+
+		var track musicbrainz.Track
+		track.Position = len(m.Tracks) + 1
+		track.Number = t.Position
+		track.Title = t.Title
+		track.Length = length
+		track.Artists = artists
+		track.Recording.Title = t.Title
+		track.Recording.Length = length
+		track.Recording.Artists = artists
+
+		m.Tracks = append(m.Tracks, track)
+		m.TrackCount = len(m.Tracks)
+	}
+	slices.Sort(positions)
+	for i, p := range positions {
+		m := media[p]
+		m.Position = i + 1
+		release.Media = append(release.Media, *m)
+	}
+	if len(release.Media) == 0 {
+		release.Media = []musicbrainz.Media{{Position: 1, Format: format}}
+	}
+	return &release
+}
+
+// flattenTracks returns the playable tracks in a tracklist, skipping headings, and using the sub tracks of
+// index tracks.
+func flattenTracks(tracklist []Track) []Track {
+	var tracks []Track
+	for _, t := range tracklist {
+		switch t.Type {
+		case "heading":
+			continue
+		case "index":
+			tracks = append(tracks, flattenTracks(t.SubTracks)...)
+			continue
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+var discPositionExpr = regexp.MustCompile(`^(?:CD|DVD)?(\d+)[-.]\d+`)
+
+// discNumber finds the disc number from a track position like "2-05" or "CD2-5". Positions with only a track
+// number, or vinyl sides like "A1" and "B2", are on the first disc.
+func discNumber(position string) int {
+	m := discPositionExpr.FindStringSubmatch(position)
+	if m == nil {
+		return 1
+	}
+	n, _ := strconv.Atoi(m[1])
+	return max(n, 1)
+}
+
+// parseDuration parses a track duration like "4:02" or "1:02:03" into milliseconds, or 0 if it's unknown.
+func parseDuration(duration string) int {
+	if duration == "" {
+		return 0
+	}
+	var secs int
+	for part := range strings.SplitSeq(duration, ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0
+		}
+		secs = secs*60 + n
+	}
+	return int((time.Duration(secs) * time.Second).Milliseconds())
+}
+
+// parseReleased parses a release date like "1997-03-00", where unknown parts are 0, falling back to the year.
+func parseReleased(released string, year int) time.Time {
+	var parts []int
+	for p := range strings.SplitSeq(released, "-") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	if len(parts) == 0 || parts[0] == 0 {
+		if year == 0 {
+			return time.Time{}
+		}
+		return time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	for len(parts) < 3 {
+		parts = append(parts, 0)
+	}
+	return time.Date(parts[0], time.Month(max(parts[1], 1)), max(parts[2], 1), 0, 0, 0, 0, time.UTC)
+}
+
+// mapFormat maps a Discogs format to the closest MusicBrainz one, like "Vinyl" with "12"" to "12" Vinyl".
+func mapFormat(name string, descriptions []string) string {
+	switch name {
+	case "File":
+		return "Digital Media"
+	case "Vinyl":
+		for _, d := range descriptions {
+			if d == `7"` || d == `10"` || d == `12"` {
+				return d + " Vinyl"
+			}
+		}
+	}
+	return name
+}
+
+func mapArtists(artists []Artist) []musicbrainz.ArtistCredit {
+	var credits []musicbrainz.ArtistCredit
+	for i, a := range artists {
+		var ac musicbrainz.ArtistCredit
+		ac.Artist.Name = trimNumbering(a.Name)
+		ac.Name = trimNumbering(a.Name)
+		if a.ANV != "" {
+			ac.Name = a.ANV
+		}
+		if i < len(artists)-1 {
+			switch join := strings.TrimSpace(a.Join); join {
+			case "", ",":
+				ac.JoinPhrase = ", "
+			default:
+				ac.JoinPhrase = " " + join + " "
+			}
+		}
+		credits = append(credits, ac)
+	}
+	return credits
+}
+
+var numberingExpr = regexp.MustCompile(`\s+\(\d+\)$`)
+
+// trimNumbering removes the number Discogs adds to tell apart artists and labels with the same name, like
+// "Jeff Mills (2)".
+func trimNumbering(name string) string {
+	return numberingExpr.ReplaceAllString(name, "")
+}
+
+func joinPath(base string, p ...string) string {
+	r, _ := url.JoinPath(base, p...)
+	return r
+}
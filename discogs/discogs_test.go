@@ -0,0 +1,66 @@
+package discogs
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/wrtag/musicbrainz"
+)
+
+func TestMapRelease(t *testing.T) {
+	t.Parallel()
+
+	var r Release
+	err := json.Unmarshal([]byte(`{
+		"title": "Sounds",
+		"released": "2004-03-00",
+		"artists": [{"name": "Jeff Mills (2)", "join": "&"}, {"name": "Robert Hood", "anv": "Rob Hood"}],
+		"formats": [{"name": "CD", "descriptions": ["Album", "Compilation"]}],
+		"tracklist": [
+			{"type_": "heading", "title": "Part One"},
+			{"position": "1-1", "type_": "track", "title": "A", "duration": "4:02"},
+			{"position": "1-2", "type_": "index", "title": "B", "sub_tracks": [
+				{"position": "1-2a", "type_": "track", "title": "B1"},
+				{"position": "1-2b", "type_": "track", "title": "B2"}
+			]},
+			{"position": "2-1", "type_": "track", "title": "C", "duration": "1:02:03", "artists": [{"name": "Other"}]}
+		]
+	}`), &r)
+	require.NoError(t, err)
+
+	release := r.mapRelease()
+	assert.Equal(t, "Jeff Mills & Rob Hood", musicbrainz.ArtistsCreditString(release.Artists))
+	assert.Equal(t, []string{"Jeff Mills", "Robert Hood"}, musicbrainz.ArtistsNames(release.Artists))
+	assert.Equal(t, time.Date(2004, time.March, 1, 0, 0, 0, 0, time.UTC), release.Date.Time)
+	assert.Equal(t, []musicbrainz.ReleaseGroupSecondaryType{musicbrainz.Compilation}, release.ReleaseGroup.SecondaryTypes)
+
+	require.Len(t, release.Media, 2)
+	assert.Equal(t, "CD", release.Media[0].Format)
+
+	var titles []string
+	for _, t := range release.Media[0].Tracks {
+		titles = append(titles, t.Title)
+	}
+	assert.Equal(t, []string{"A", "B1", "B2"}, titles)
+	assert.Equal(t, 242_000, release.Media[0].Tracks[0].Length)
+
+	c := release.Media[1].Tracks[0]
+	assert.Equal(t, 1, c.Position)
+	assert.Equal(t, 3_723_000, c.Length)
+	assert.Equal(t, "Other", musicbrainz.ArtistsCreditString(c.Artists))
+}
+
+func TestDiscNumber(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, 1, discNumber("1"))
+	assert.Equal(t, 1, discNumber("A1"))
+	assert.Equal(t, 1, discNumber("B2"))
+	assert.Equal(t, 2, discNumber("2-05"))
+	assert.Equal(t, 2, discNumber("CD2-5"))
+	assert.Equal(t, 3, discNumber("3.1"))
+}
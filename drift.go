@@ -0,0 +1,77 @@
+package wrtag
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+)
+
+// Drift is what an import would change, found by a dry run. For a release that's already in the library,
+// no drift means it's where the path format says it should be, with the tags that a sync would write.
+type Drift struct {
+	Moves   []DriftMove  `json:"moves,omitempty"`
+	Retags  []DriftRetag `json:"retags,omitempty"`
+	Deletes []string     `json:"deletes,omitempty"`
+}
+
+// DriftMove is a file that would be moved.
+type DriftMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DriftRetag is a tag that would be changed in a file. A tag that would be removed has no To values, and a
+// new tag has no From values.
+type DriftRetag struct {
+	Path string   `json:"path"`
+	Key  string   `json:"key"`
+	From []string `json:"from,omitempty"`
+	To   []string `json:"to,omitempty"`
+}
+
+// Empty returns whether nothing would change.
+func (d *Drift) Empty() bool {
+	return d == nil || len(d.Moves) == 0 && len(d.Retags) == 0 && len(d.Deletes) == 0
+}
+
+func (d *Drift) addMove(from, to string) {
+	if d == nil || filepath.Clean(from) == filepath.Clean(to) {
+		return
+	}
+	d.Moves = append(d.Moves, DriftMove{From: from, To: to})
+}
+
+func (d *Drift) addRetags(path string, before, after map[string][]string) {
+	if d == nil {
+		return
+	}
+	keys := slices.Collect(maps.Keys(before))
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		from, to := before[k], after[k]
+		if slices.Equal(from, to) || len(from) == 0 && len(to) == 0 {
+			continue
+		}
+		d.Retags = append(d.Retags, DriftRetag{Path: path, Key: k, From: from, To: to})
+	}
+}
+
+// addDeletes records paths that would be trimmed, except the sources of moves. A dry run doesn't move
+// anything, so those are still in the destination when it's trimmed.
+func (d *Drift) addDeletes(paths []string) {
+	if d == nil {
+		return
+	}
+	for _, p := range paths {
+		if slices.ContainsFunc(d.Moves, func(m DriftMove) bool { return filepath.Clean(m.From) == filepath.Clean(p) }) {
+			continue
+		}
+		d.Deletes = append(d.Deletes, p)
+	}
+}
@@ -0,0 +1,224 @@
+package wrtag
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"go.senan.xyz/wrtag/destfs"
+	"go.senan.xyz/wrtag/tags"
+	"go.senan.xyz/wrtag/tags/normtag"
+)
+
+var (
+	ErrDuplicate    = errors.New("release already in library")
+	ErrKeptExisting = errors.New("kept the existing copy in library")
+)
+
+// DuplicatePolicy decides what happens when a release is imported into a destination that already has the
+// same release, by MusicBrainz release ID. Only the destination directory is checked, so a copy elsewhere in
+// the library, for example from an older path format, isn't a duplicate.
+type DuplicatePolicy string
+
+const (
+	// DuplicateReplaceBetter replaces the existing release if the new one is at least as good quality, and
+	// otherwise fails with ErrKeptExisting. It's the default.
+	DuplicateReplaceBetter DuplicatePolicy = "replace-better"
+	// DuplicateKeepExisting never replaces the existing release, failing with ErrKeptExisting.
+	DuplicateKeepExisting DuplicatePolicy = "keep-existing"
+	// DuplicateKeepBoth imports the new release next to the existing one, with a numbered suffix like "Album (2)".
+	DuplicateKeepBoth DuplicatePolicy = "keep-both"
+	// DuplicateAsk fails with ErrDuplicate, so that the import can be confirmed. A confirmed import replaces
+	// the existing release.
+	DuplicateAsk DuplicatePolicy = "ask"
+)
+
+// ParseDuplicatePolicy parses one of the DuplicatePolicy names.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(strings.TrimSpace(s)); p {
+	case DuplicateReplaceBetter, DuplicateKeepExisting, DuplicateKeepBoth, DuplicateAsk:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy %q", s)
+}
+
+// DuplicateDecision is what was done with a release that was already in the library.
+type DuplicateDecision string
+
+const (
+	DecisionReplaced     DuplicateDecision = "replaced"
+	DecisionKeptExisting DuplicateDecision = "kept existing"
+	DecisionKeptBoth     DuplicateDecision = "kept both"
+	DecisionNeedsInput   DuplicateDecision = "needs input"
+)
+
+// Duplicate describes a release that was already in the library when importing it again.
+type Duplicate struct {
+	Dir      string // the existing release
+	Existing Quality
+	New      Quality
+	Decision DuplicateDecision
+}
+
+// Quality is the audio quality of a release, taken from its worst track.
+type Quality struct {
+	Codec      string
+	Lossless   bool
+	BitRate    uint // in kbit/s
+	SampleRate uint // in Hz
+	BitDepth   uint // 0 for lossy codecs
+}
+
+// Compare orders lossless audio above lossy. Lossless audio is compared by bit depth then sample rate, and lossy
+// audio by bit rate.
+func (q Quality) Compare(o Quality) int {
+	if q.Lossless != o.Lossless {
+		return cmpBool(q.Lossless, o.Lossless)
+	}
+	if q.Lossless {
+		return cmp.Or(
+			cmp.Compare(q.BitDepth, o.BitDepth),
+			cmp.Compare(q.SampleRate, o.SampleRate),
+		)
+	}
+	return cmp.Compare(q.BitRate, o.BitRate)
+}
+
+func (q Quality) String() string {
+	if q == (Quality{}) {
+		return "unknown"
+	}
+	if q.Lossless {
+		return fmt.Sprintf("%s %dbit %gkHz", q.Codec, q.BitDepth, float64(q.SampleRate)/1000)
+	}
+	return fmt.Sprintf("%s %dkbps", q.Codec, q.BitRate)
+}
+
+var losslessCodecs = map[string]struct{}{
+	"flac": {}, "alac": {}, "pcm": {}, "wav": {}, "aiff": {}, "wavpack": {}, "ape": {}, "tta": {}, "dsf": {},
+}
+
+// ReadQuality reads the quality of the worst of paths.
+func ReadQuality(paths []string) (Quality, error) {
+	var worst Quality
+	for i, p := range paths {
+		q, err := readQuality(p)
+		if err != nil {
+			return Quality{}, err
+		}
+		if i == 0 || q.Compare(worst) < 0 {
+			worst = q
+		}
+	}
+	return worst, nil
+}
+
+func readQuality(path string) (Quality, error) {
+	props, err := tags.ReadProperties(path)
+	if err != nil {
+		return Quality{}, fmt.Errorf("read properties %q: %w", filepath.Base(path), err)
+	}
+	return propertiesQuality(props), nil
+}
+
+func propertiesQuality(props tags.Properties) Quality {
+	codec := strings.ToLower(cmp.Or(props.InnerCodec, props.Format))
+	_, lossless := losslessCodecs[codec]
+	return Quality{
+		Codec:      codec,
+		Lossless:   lossless,
+		BitRate:    props.BitRate,
+		SampleRate: props.SampleRate,
+		BitDepth:   props.BitDepth,
+	}
+}
+
+// findDuplicate looks for releaseID in destDir, and compares its quality with the new files. It returns nil
+// if destDir doesn't have the release.
+//
+// The tracks in a remote library would have to be downloaded to be read, so there anything in destDir is taken
+// to be the release, and its quality is unknown.
+func findDuplicate(fsys destfs.FS, destDir, releaseID string, pathTags []PathTags) (*Duplicate, error) {
+	if releaseID == "" {
+		return nil, nil
+	}
+	if _, err := fsys.Stat(destDir); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	dup := &Duplicate{Dir: destDir}
+	if destfs.IsLocal(fsys) {
+		_, existing, err := ReadReleaseDir(destDir)
+		if errors.Is(err, ErrNoTracks) || errors.Is(err, ErrNotSortable) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read existing: %w", err)
+		}
+		if normtag.Get(existing[0].Tags, normtag.MusicBrainzReleaseID) != releaseID {
+			return nil, nil
+		}
+		if dup.Existing, err = ReadQuality(pathTagsPaths(existing)); err != nil {
+			return nil, fmt.Errorf("existing quality: %w", err)
+		}
+	} else {
+		entries, err := fsys.ReadDir(destDir)
+		if err != nil {
+			return nil, fmt.Errorf("read existing: %w", err)
+		}
+		if len(entries) == 0 {
+			return nil, nil
+		}
+	}
+
+	var err error
+	if dup.New, err = ReadQuality(pathTagsPaths(pathTags)); err != nil {
+		return nil, fmt.Errorf("new quality: %w", err)
+	}
+	return dup, nil
+}
+
+// decideDuplicate applies the policy to a duplicate. A confirmed import replaces the existing release when
+// asking. Replacing a better release asks too if the existing quality is unknown.
+func decideDuplicate(policy DuplicatePolicy, cond ImportCondition, dup *Duplicate) DuplicateDecision {
+	switch policy {
+	case DuplicateKeepExisting:
+		return DecisionKeptExisting
+	case DuplicateKeepBoth:
+		return DecisionKeptBoth
+	case DuplicateAsk:
+		if cond == Always {
+			return DecisionReplaced
+		}
+		return DecisionNeedsInput
+	default:
+		if dup.Existing == (Quality{}) {
+			return decideDuplicate(DuplicateAsk, cond, dup)
+		}
+		if dup.New.Compare(dup.Existing) < 0 {
+			return DecisionKeptExisting
+		}
+		return DecisionReplaced
+	}
+}
+
+// keepBothDir finds a free directory next to destDir in fsys to import a second copy of a release into. srcDir
+// is free too, so that a copy kept before stays where it is.
+func keepBothDir(fsys destfs.FS, destDir, srcDir string) string {
+	for n := 2; ; n++ {
+		dir := fmt.Sprintf("%s (%d)", destDir, n)
+		if dir == srcDir {
+			return dir
+		}
+		if _, err := fsys.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			return dir
+		}
+	}
+}
+
+func pathTagsPaths(pathTags []PathTags) []string {
+	return mapFunc(pathTags, func(_ int, pt PathTags) string { return pt.Path })
+}
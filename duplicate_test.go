@@ -0,0 +1,50 @@
+package wrtag
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQualityCompare(t *testing.T) {
+	t.Parallel()
+
+	mp3v0 := Quality{Codec: "mpeg", BitRate: 245, SampleRate: 44100}
+	mp3320 := Quality{Codec: "mpeg", BitRate: 320, SampleRate: 44100}
+	aac256 := Quality{Codec: "aac", BitRate: 256, SampleRate: 48000}
+	cd := Quality{Codec: "flac", Lossless: true, BitRate: 900, SampleRate: 44100, BitDepth: 16}
+	hires := Quality{Codec: "flac", Lossless: true, BitRate: 2800, SampleRate: 96000, BitDepth: 24}
+	alac := Quality{Codec: "alac", Lossless: true, BitRate: 1000, SampleRate: 44100, BitDepth: 16}
+
+	assert.Equal(t, 1, mp3320.Compare(mp3v0))
+	assert.Equal(t, 1, mp3320.Compare(aac256)) // sample rate doesn't matter for lossy
+	assert.Equal(t, 1, cd.Compare(mp3320))
+	assert.Equal(t, -1, cd.Compare(hires))
+	assert.Equal(t, 0, cd.Compare(alac)) // bit rate doesn't matter for lossless
+
+	assert.Equal(t, "flac 24bit 96kHz", hires.String())
+	assert.Equal(t, "flac 16bit 44.1kHz", cd.String())
+	assert.Equal(t, "mpeg 320kbps", mp3320.String())
+}
+
+func TestDecideDuplicate(t *testing.T) {
+	t.Parallel()
+
+	better := &Duplicate{Existing: Quality{Codec: "mpeg", BitRate: 320}, New: Quality{Codec: "flac", Lossless: true}}
+	worse := &Duplicate{Existing: better.New, New: better.Existing}
+	same := &Duplicate{Existing: better.New, New: better.New}
+	unknown := &Duplicate{New: better.New} // in a remote library
+
+	assert.Equal(t, DecisionReplaced, decideDuplicate("", HighScore, better))
+	assert.Equal(t, DecisionReplaced, decideDuplicate(DuplicateReplaceBetter, HighScore, same))
+	assert.Equal(t, DecisionKeptExisting, decideDuplicate(DuplicateReplaceBetter, HighScore, worse))
+	assert.Equal(t, DecisionKeptExisting, decideDuplicate(DuplicateKeepExisting, Always, better))
+	assert.Equal(t, DecisionKeptBoth, decideDuplicate(DuplicateKeepBoth, HighScore, worse))
+	assert.Equal(t, DecisionNeedsInput, decideDuplicate(DuplicateAsk, HighScore, better))
+	assert.Equal(t, DecisionReplaced, decideDuplicate(DuplicateAsk, Always, worse))
+
+	// an unknown existing quality can't be compared, so replacing it is asked about
+	assert.Equal(t, DecisionNeedsInput, decideDuplicate(DuplicateReplaceBetter, HighScore, unknown))
+	assert.Equal(t, DecisionReplaced, decideDuplicate(DuplicateReplaceBetter, Always, unknown))
+	assert.Equal(t, DecisionKeptExisting, decideDuplicate(DuplicateKeepExisting, Always, unknown))
+}
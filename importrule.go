@@ -0,0 +1,264 @@
+package wrtag
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNeedsConfirmation = errors.New("needs confirmation")
+	ErrRejected          = errors.New("rejected by import rule")
+)
+
+// ImportAction is what an ImportRule does with a match when all of its conditions hold.
+type ImportAction string
+
+const (
+	// ActionImport imports the match without asking.
+	ActionImport ImportAction = "import"
+	// ActionConfirm only imports the match if it was confirmed, for example with the -yes flag or from the web UI.
+	ActionConfirm ImportAction = "confirm"
+	// ActionReject never imports the match, even when confirmed.
+	ActionReject ImportAction = "reject"
+)
+
+// ImportRules decide whether a match is imported, needs confirmation, or is rejected. They're checked in order,
+// and the first rule with all of its conditions met decides. If none do, a match is imported if its score
+// is at least Config.MinScore.
+type ImportRules []ImportRule
+
+// ImportRule is an action, and the conditions a match must meet for it to apply. Conditions are separated
+// by " and ", since commas separate stackable values, for example
+//
+//	import score >= 90 and barcode matches
+//	confirm compilation
+//	reject track score < 50
+//
+// The conditions are
+//
+//	score <op> <n>        the overall score compared with n, where op is one of <, <=, >, >=
+//	track score <op> <n>  the score of the worst matching track
+//	<field> matches       a diff field like "barcode" or "catalogue num" is present on both sides and equal
+//	compilation           the release is by Various Artists
+//	mbid                  the MusicBrainz ID was tagged or given
+//	disc id               the release was found by an exact disc ID
+//
+// and any of them can be negated with a "not " prefix.
+type ImportRule struct {
+	Action     ImportAction
+	Conditions []RuleCondition
+}
+
+// RuleCondition is one condition of an ImportRule, as parsed by ParseImportRule.
+type RuleCondition struct {
+	Not     bool
+	Subject string // "score", "track score", "matches", "compilation", "mbid", or "disc id"
+	Field   string // the field for "matches"
+	Op      string // the comparison for "score" and "track score"
+	Value   float64
+}
+
+// ParseImportRule parses an ImportRule like "import score >= 90 and barcode matches".
+func ParseImportRule(str string) (ImportRule, error) {
+	action, condsRaw, _ := strings.Cut(strings.TrimSpace(str), " ")
+
+	var rule ImportRule
+	switch rule.Action = ImportAction(action); rule.Action {
+	case ActionImport, ActionConfirm, ActionReject:
+	default:
+		return ImportRule{}, fmt.Errorf("invalid import rule action %q. expected one of %q, %q, %q", action, ActionImport, ActionConfirm, ActionReject)
+	}
+
+	if strings.Contains(condsRaw, ",") {
+		return ImportRule{}, fmt.Errorf("invalid import rule conditions %q. separate them with \" and \"", condsRaw)
+	}
+	for raw := range strings.SplitSeq(condsRaw, " and ") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		cond, err := parseRuleCondition(raw)
+		if err != nil {
+			return ImportRule{}, fmt.Errorf("condition %q: %w", raw, err)
+		}
+		rule.Conditions = append(rule.Conditions, cond)
+	}
+	return rule, nil
+}
+
+func parseRuleCondition(str string) (RuleCondition, error) {
+	var cond RuleCondition
+	if rest, ok := strings.CutPrefix(str, "not "); ok {
+		cond.Not = true
+		str = strings.TrimSpace(rest)
+	}
+
+	switch str {
+	case "compilation", "mbid", "disc id":
+		cond.Subject = str
+		return cond, nil
+	}
+	if field, ok := strings.CutSuffix(str, " matches"); ok {
+		cond.Subject = "matches"
+		cond.Field = strings.TrimSpace(field)
+		return cond, nil
+	}
+
+	fields := strings.Fields(str)
+	if len(fields) < 3 {
+		return RuleCondition{}, errors.New("unknown condition")
+	}
+	subject, op, value := strings.Join(fields[:len(fields)-2], " "), fields[len(fields)-2], fields[len(fields)-1]
+	switch subject {
+	case "score", "track score":
+	default:
+		return RuleCondition{}, fmt.Errorf("unknown condition subject %q", subject)
+	}
+	switch op {
+	case "<", "<=", ">", ">=":
+	default:
+		return RuleCondition{}, fmt.Errorf("invalid comparison %q", op)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return RuleCondition{}, fmt.Errorf("parse value: %w", err)
+	}
+	cond.Subject, cond.Op, cond.Value = subject, op, v
+	return cond, nil
+}
+
+func (r ImportRule) String() string {
+	var conds []string
+	for _, c := range r.Conditions {
+		conds = append(conds, c.String())
+	}
+	if len(conds) == 0 {
+		return string(r.Action)
+	}
+	return fmt.Sprintf("%s %s", r.Action, strings.Join(conds, " and "))
+}
+
+func (c RuleCondition) String() string {
+	var s string
+	switch c.Subject {
+	case "score", "track score":
+		s = fmt.Sprintf("%s %s %s", c.Subject, c.Op, strconv.FormatFloat(c.Value, 'f', -1, 64))
+	case "matches":
+		s = c.Field + " matches"
+	default:
+		s = c.Subject
+	}
+	if c.Not {
+		return "not " + s
+	}
+	return s
+}
+
+// ruleMatch is what import rules are checked against.
+type ruleMatch struct {
+	score       float64
+	diff        []Diff
+	compilation bool
+	mbid        bool
+	discID      bool
+}
+
+// match reports whether m meets all of the rule's conditions.
+func (r ImportRule) match(m ruleMatch) bool {
+	for _, c := range r.Conditions {
+		if c.match(m) == c.Not {
+			return false
+		}
+	}
+	return true
+}
+
+func (c RuleCondition) match(m ruleMatch) bool {
+	switch c.Subject {
+	case "score":
+		return compareOp(c.Op, m.score, c.Value)
+	case "track score":
+		score, ok := worstTrackScore(m.diff)
+		return ok && compareOp(c.Op, score, c.Value)
+	case "matches":
+		for _, d := range m.diff {
+			if d.Field == c.Field {
+				return d.Equal && d.Size > 0
+			}
+		}
+		return false
+	case "compilation":
+		return m.compilation
+	case "mbid":
+		return m.mbid
+	case "disc id":
+		return m.discID
+	}
+	return false
+}
+
+// worstTrackScore is the lowest score of any track diff that was scored, out of 100.
+func worstTrackScore(diff []Diff) (float64, bool) {
+	var worst float64
+	var ok bool
+	for _, d := range diff {
+		if !strings.HasPrefix(d.Field, "track ") || d.Size == 0 {
+			continue
+		}
+		score := 100 - d.Distance*100/d.Size
+		if !ok || score < worst {
+			worst, ok = score, true
+		}
+	}
+	return worst, ok
+}
+
+func compareOp(op string, a, b float64) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// decideImport works out if a match should be imported under cond, and why. The first of the rules to match
+// decides, otherwise a score of at least minScore is always enough, and cond decides whether an MBID or exact
+// disc ID match will do, or if it was confirmed anyway.
+func decideImport(rules ImportRules, minScore float64, cond ImportCondition, m ruleMatch) (ImportReason, error) {
+	for _, r := range rules {
+		if !r.match(m) {
+			continue
+		}
+		reason := ImportReason("rule: " + r.String())
+		switch r.Action {
+		case ActionReject:
+			return reason, ErrRejected
+		case ActionConfirm:
+			if cond != Always {
+				return reason, ErrNeedsConfirmation
+			}
+			return ReasonConfirmed, nil
+		}
+		return reason, nil
+	}
+
+	switch {
+	case m.score >= minScore:
+		return ReasonHighScore, nil
+	case cond == HighScoreOrMBID && m.mbid:
+		return ReasonMBID, nil
+	case cond == HighScoreOrMBID && m.discID:
+		return ReasonDiscID, nil
+	case cond == Always:
+		return ReasonConfirmed, nil
+	}
+	return ReasonScoreTooLow, ErrScoreTooLow
+}
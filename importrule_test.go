@@ -0,0 +1,99 @@
+package wrtag
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImportRule(t *testing.T) {
+	t.Parallel()
+
+	rule, err := ParseImportRule("import score >= 90 and barcode matches and not compilation")
+	require.NoError(t, err)
+	assert.Equal(t, ActionImport, rule.Action)
+	assert.Equal(t, []RuleCondition{
+		{Subject: "score", Op: ">=", Value: 90},
+		{Subject: "matches", Field: "barcode"},
+		{Subject: "compilation", Not: true},
+	}, rule.Conditions)
+	assert.Equal(t, "import score >= 90 and barcode matches and not compilation", rule.String())
+
+	rule, err = ParseImportRule("reject track score < 50%")
+	require.NoError(t, err)
+	assert.Equal(t, []RuleCondition{{Subject: "track score", Op: "<", Value: 50}}, rule.Conditions)
+
+	rule, err = ParseImportRule("confirm")
+	require.NoError(t, err)
+	assert.Empty(t, rule.Conditions)
+
+	_, err = ParseImportRule("maybe score > 50")
+	require.ErrorContains(t, err, "invalid import rule action")
+	_, err = ParseImportRule("import score = 50")
+	require.ErrorContains(t, err, "invalid comparison")
+	_, err = ParseImportRule("import label > 50")
+	require.ErrorContains(t, err, "unknown condition subject")
+	_, err = ParseImportRule("import score > high")
+	require.ErrorContains(t, err, "parse value")
+	_, err = ParseImportRule("import lucky")
+	require.ErrorContains(t, err, "unknown condition")
+	_, err = ParseImportRule("import score > 90, mbid")
+	require.ErrorContains(t, err, `separate them with " and "`)
+}
+
+func TestDecideImport(t *testing.T) {
+	t.Parallel()
+
+	// no rules, the score threshold decides
+	decide := func(cond ImportCondition, m ruleMatch) ImportReason {
+		reason, _ := decideImport(nil, DefaultMinScore, cond, m)
+		return reason
+	}
+	assert.Equal(t, ReasonHighScore, decide(HighScore, ruleMatch{score: 96}))
+	assert.Equal(t, ReasonScoreTooLow, decide(HighScore, ruleMatch{score: 90, mbid: true, discID: true}))
+	assert.Equal(t, ReasonMBID, decide(HighScoreOrMBID, ruleMatch{score: 90, mbid: true, discID: true}))
+	assert.Equal(t, ReasonDiscID, decide(HighScoreOrMBID, ruleMatch{score: 90, discID: true}))
+	assert.Equal(t, ReasonScoreTooLow, decide(HighScoreOrMBID, ruleMatch{score: 90}))
+	assert.Equal(t, ReasonConfirmed, decide(Always, ruleMatch{score: 90}))
+	assert.Equal(t, ReasonHighScore, decide(Always, ruleMatch{score: 100}))
+
+	// with a lower threshold
+	reason, err := decideImport(nil, 85, HighScore, ruleMatch{score: 90})
+	require.NoError(t, err)
+	assert.Equal(t, ReasonHighScore, reason)
+
+	var rules ImportRules
+	for _, r := range []string{
+		"reject track score < 50",
+		"confirm compilation",
+		"import score >= 90 and barcode matches",
+	} {
+		rule, err := ParseImportRule(r)
+		require.NoError(t, err)
+		rules = append(rules, rule)
+	}
+
+	barcode := Diff{Field: "barcode", Equal: true, Size: 12}
+	goodTrack := Diff{Field: "track 1", Size: 10, Distance: 1}
+	badTrack := Diff{Field: "track 2", Size: 10, Distance: 6}
+
+	reason, err = decideImport(rules, DefaultMinScore, HighScore, ruleMatch{score: 91, diff: []Diff{barcode, goodTrack}})
+	require.NoError(t, err)
+	assert.Equal(t, ImportReason("rule: import score >= 90 and barcode matches"), reason)
+
+	// barcode missing locally
+	_, err = decideImport(rules, DefaultMinScore, HighScore, ruleMatch{score: 91, diff: []Diff{{Field: "barcode", Equal: true}, goodTrack}})
+	require.ErrorIs(t, err, ErrScoreTooLow)
+
+	// compilations need confirming, even with a high score
+	_, err = decideImport(rules, DefaultMinScore, HighScore, ruleMatch{score: 100, compilation: true})
+	require.ErrorIs(t, err, ErrNeedsConfirmation)
+	reason, err = decideImport(rules, DefaultMinScore, Always, ruleMatch{score: 100, compilation: true})
+	require.NoError(t, err)
+	assert.Equal(t, ReasonConfirmed, reason)
+
+	// and a bad track is rejected, even if confirmed
+	_, err = decideImport(rules, DefaultMinScore, Always, ruleMatch{score: 96, diff: []Diff{barcode, goodTrack, badTrack}})
+	require.ErrorIs(t, err, ErrRejected)
+}
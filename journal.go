@@ -0,0 +1,573 @@
+package wrtag
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.senan.xyz/wrtag/fileutil"
+	"go.senan.xyz/wrtag/tags"
+)
+
+var ErrNoJournalEntry = errors.New("no import to undo")
+
+// UndoLast can be passed to Journal.Undo to undo the most recent import, wherever it was.
+const UndoLast = "last"
+
+// DefaultJournalMaxAge is how long journal entries are kept for by default.
+const DefaultJournalMaxAge = 30 * 24 * time.Hour
+
+// Journal records what each import changed on disk so that it can be undone. Entries are appended to a
+// JSON lines file in Dir. Files that an import would otherwise delete, like leftovers in the source directory
+// or unknown files in the destination, are moved into Dir instead, so that undoing can put them back.
+//
+// Entries older than MaxAge are pruned, along with the files they stashed, so they can't be undone any more.
+// The journal is locked while it's used, so several processes can share a Dir.
+//
+// A nil *Journal, or one with no Dir, is valid, and records nothing.
+type Journal struct {
+	Dir string
+	// MaxAge is how long entries are kept for. Defaults to DefaultJournalMaxAge.
+	MaxAge time.Duration
+
+	mu sync.Mutex
+}
+
+// JournalEntry is a single import, or the undoing of one.
+type JournalEntry struct {
+	ID        string           `json:"id"`
+	Time      time.Time        `json:"time"`
+	Operation string           `json:"operation,omitempty"`
+	SourceDir string           `json:"source_dir,omitempty"`
+	DestDir   string           `json:"dest_dir,omitempty"`
+	Root      string           `json:"root,omitempty"`
+	Files     []JournalFile    `json:"files,omitempty"`
+	Cover     *JournalCover    `json:"cover,omitempty"`
+	Removed   []JournalRemoved `json:"removed,omitempty"`
+
+	// Undoes is the ID of the entry that this entry undid.
+	Undoes string `json:"undoes,omitempty"`
+}
+
+// JournalFile is a file that was moved or copied. Tracks have the tags they had before the import.
+type JournalFile struct {
+	Source string              `json:"source"`
+	Dest   string              `json:"dest"`
+	Tags   map[string][]string `json:"tags,omitempty"`
+}
+
+type CoverAction string
+
+const (
+	CoverKept       CoverAction = "kept"
+	CoverDownloaded CoverAction = "downloaded"
+)
+
+// JournalCover is what happened to the release's cover. A kept cover was moved or copied from the source
+// like any other file, a downloaded one has no source.
+type JournalCover struct {
+	Action CoverAction `json:"action"`
+	Source string      `json:"source,omitempty"`
+	Dest   string      `json:"dest"`
+}
+
+// JournalRemoved is a file or directory that was removed. Files are stashed in the journal directory, at a
+// path relative to it. Directories have no stash.
+type JournalRemoved struct {
+	Path  string `json:"path"`
+	Stash string `json:"stash,omitempty"`
+}
+
+func (j *Journal) enabled() bool {
+	return j != nil && j.Dir != ""
+}
+
+func (j *Journal) path() string {
+	return filepath.Join(j.Dir, "journal.jsonl")
+}
+
+func (j *Journal) stashDir(id string) string {
+	return filepath.Join(j.Dir, "removed", id)
+}
+
+func (j *Journal) maxAge() time.Duration {
+	if j.MaxAge == 0 {
+		return DefaultJournalMaxAge
+	}
+	return j.MaxAge
+}
+
+// lock locks the journal for this process and any others that share its dir, until the returned func is called.
+func (j *Journal) lock() (func(), error) {
+	j.mu.Lock()
+
+	if err := os.MkdirAll(j.Dir, os.ModePerm); err != nil {
+		j.mu.Unlock()
+		return nil, fmt.Errorf("make journal dir: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(j.Dir, "journal.lock"), os.O_CREATE|os.O_RDWR, 0o644) //nolint:gosec
+	if err != nil {
+		j.mu.Unlock()
+		return nil, fmt.Errorf("open lock: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		j.mu.Unlock()
+		return nil, fmt.Errorf("lock journal: %w", err)
+	}
+	return func() {
+		f.Close() // releases the lock
+		j.mu.Unlock()
+	}, nil
+}
+
+// overridden in _unix.go to lock with flock.
+var lockFile = func(*os.File) error { return nil }
+
+// begin starts an entry for an import, or returns nil if the journal is disabled.
+func (j *Journal) begin(op FileSystemOperation, srcDir, destDir, root string) *JournalEntry {
+	if !j.enabled() {
+		return nil
+	}
+	return &JournalEntry{
+		ID:        newJournalID(),
+		Time:      time.Now(),
+		Operation: operationName(op),
+		SourceDir: srcDir,
+		DestDir:   destDir,
+		Root:      root,
+	}
+}
+
+// append prunes any old entries, then writes an entry to the end of the journal.
+func (j *Journal) append(entry *JournalEntry) error {
+	unlock, err := j.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := j.pruneLocked(entry.ID); err != nil {
+		return fmt.Errorf("prune: %w", err)
+	}
+	return j.appendLocked(entry)
+}
+
+func (j *Journal) appendLocked(entry *JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshal entry: %w", err)
+	}
+	data = append(data, '\n')
+
+	f, err := os.OpenFile(j.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write entry: %w", err)
+	}
+	return f.Close()
+}
+
+// pruneLocked drops entries older than MaxAge, and removes the files that they stashed. Stashes are found by the
+// time in their ID, so that any left by an import that was never recorded are removed too. The stash for the
+// current entry is kept however long its import took.
+func (j *Journal) pruneLocked(currentID string) error {
+	cutoff := time.Now().Add(-j.maxAge())
+
+	stashes, err := os.ReadDir(filepath.Join(j.Dir, "removed"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read stashes: %w", err)
+	}
+	for _, s := range stashes {
+		if s.Name() == currentID {
+			continue
+		}
+		if t, ok := journalIDTime(s.Name()); ok && t.Before(cutoff) {
+			if err := os.RemoveAll(j.stashDir(s.Name())); err != nil {
+				return fmt.Errorf("remove stash: %w", err)
+			}
+		}
+	}
+
+	entries, err := j.entriesLocked()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 || !entries[0].Time.Before(cutoff) {
+		return nil
+	}
+	keep := slices.DeleteFunc(entries, func(e JournalEntry) bool { return e.Time.Before(cutoff) })
+
+	var buf bytes.Buffer
+	for _, e := range keep {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("marshal entry: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	tmp := j.path() + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil { //nolint:gosec
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := os.Rename(tmp, j.path()); err != nil {
+		return fmt.Errorf("replace journal: %w", err)
+	}
+	return nil
+}
+
+// Entries reads every entry in the journal, oldest first.
+func (j *Journal) Entries() ([]JournalEntry, error) {
+	if !j.enabled() {
+		return nil, nil
+	}
+
+	unlock, err := j.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return j.entriesLocked()
+}
+
+func (j *Journal) entriesLocked() ([]JournalEntry, error) {
+	f, err := os.Open(j.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("decode entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+	return entries, nil
+}
+
+// Last returns the most recent import into dir that hasn't been undone, or the most recent of all if dir
+// is UndoLast.
+func (j *Journal) Last(dir string) (*JournalEntry, error) {
+	entries, err := j.Entries()
+	if err != nil {
+		return nil, err
+	}
+	return lastEntry(entries, dir)
+}
+
+func lastEntry(entries []JournalEntry, dir string) (*JournalEntry, error) {
+
+	if dir != UndoLast {
+		dir = filepath.Clean(dir)
+		if d, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = d
+		}
+	}
+
+	undone := map[string]struct{}{}
+	for _, entry := range slices.Backward(entries) {
+		if entry.Undoes != "" {
+			undone[entry.Undoes] = struct{}{}
+			continue
+		}
+		if _, ok := undone[entry.ID]; ok {
+			continue
+		}
+		if dir != UndoLast && entry.DestDir != dir {
+			continue
+		}
+		return &entry, nil
+	}
+	return nil, ErrNoJournalEntry
+}
+
+// Undo reverts the most recent import into dir, or the most recent of all if dir is UndoLast. Moved files
+// are moved back and have their original tags written again, copied files are deleted, and removed files are
+// put back. Each step can be repeated, so an undo that fails part way can be tried again.
+func (j *Journal) Undo(ctx context.Context, dir string) (*JournalEntry, error) {
+	return j.undo(ctx, func(entries []JournalEntry) (*JournalEntry, error) {
+		return lastEntry(entries, dir)
+	})
+}
+
+// UndoID reverts the import with the entry ID id, like Undo. It can only be undone if it's the most recent
+// import into its dir that hasn't been, since a later one may have replaced the same files.
+func (j *Journal) UndoID(ctx context.Context, id string) (*JournalEntry, error) {
+	return j.undo(ctx, func(entries []JournalEntry) (*JournalEntry, error) {
+		i := slices.IndexFunc(entries, func(e JournalEntry) bool { return e.ID == id && e.Undoes == "" })
+		if i < 0 {
+			return nil, ErrNoJournalEntry
+		}
+		last, err := lastEntry(entries, entries[i].DestDir)
+		if err != nil {
+			return nil, ErrNoJournalEntry // already undone
+		}
+		if last.ID != id {
+			return nil, fmt.Errorf("a later import into %q must be undone first", last.DestDir)
+		}
+		return last, nil
+	})
+}
+
+func (j *Journal) undo(ctx context.Context, find func([]JournalEntry) (*JournalEntry, error)) (*JournalEntry, error) {
+	if !j.enabled() {
+		return nil, errors.New("no journal dir configured")
+	}
+
+	entries, err := j.Entries()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := find(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	// imports lock their paths before the journal, so do the same here
+	unlockPaths := lockPaths(entry.SourceDir, entry.DestDir)
+	defer unlockPaths()
+
+	unlock, err := j.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// something may have been undone or imported since we looked
+	entries, err = j.entriesLocked()
+	if err != nil {
+		return nil, err
+	}
+	if again, err := find(entries); err != nil || again.ID != entry.ID {
+		return nil, errors.New("journal changed while undoing, try again")
+	}
+
+	move := entry.Operation == "move"
+
+	for _, f := range slices.Backward(entry.Files) {
+		if err := undoFile(f, move); err != nil {
+			return nil, fmt.Errorf("restore %q: %w", f.Source, err)
+		}
+	}
+
+	if c := entry.Cover; c != nil {
+		switch c.Action {
+		case CoverKept:
+			if err := undoFile(JournalFile{Source: c.Source, Dest: c.Dest}, move); err != nil {
+				return nil, fmt.Errorf("restore cover: %w", err)
+			}
+		case CoverDownloaded:
+			if err := os.Remove(c.Dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("remove downloaded cover: %w", err)
+			}
+		}
+	}
+
+	for _, r := range slices.Backward(entry.Removed) {
+		if r.Stash == "" {
+			if err := os.MkdirAll(r.Path, os.ModePerm); err != nil {
+				return nil, fmt.Errorf("restore dir: %w", err)
+			}
+			continue
+		}
+		stash := filepath.Join(j.Dir, r.Stash)
+		if _, err := os.Stat(stash); errors.Is(err, os.ErrNotExist) {
+			continue // already put back
+		}
+		if err := os.MkdirAll(filepath.Dir(r.Path), os.ModePerm); err != nil {
+			return nil, fmt.Errorf("create removed file dir: %w", err)
+		}
+		if err := moveFile(stash, r.Path); err != nil {
+			return nil, fmt.Errorf("restore removed file %q: %w", r.Path, err)
+		}
+	}
+
+	// clean up the dirs that the import created, if nothing else is in them
+	var dirs []string
+	for _, f := range entry.Files {
+		if f.Source != f.Dest {
+			dirs = append(dirs, filepath.Dir(f.Dest))
+		}
+	}
+	if c := entry.Cover; c != nil && c.Source != c.Dest {
+		dirs = append(dirs, filepath.Dir(c.Dest))
+	}
+	slices.SortFunc(dirs, func(a, b string) int { return len(b) - len(a) })
+	for _, d := range slices.Compact(dirs) {
+		removeEmptyDirs(d, entry.Root)
+	}
+
+	if err := os.RemoveAll(j.stashDir(entry.ID)); err != nil {
+		slog.WarnContext(ctx, "remove journal stash", "id", entry.ID, "err", err)
+	}
+
+	if err := j.appendLocked(&JournalEntry{ID: newJournalID(), Time: time.Now(), Undoes: entry.ID}); err != nil {
+		return nil, fmt.Errorf("record undo: %w", err)
+	}
+
+	slog.DebugContext(ctx, "undid import", "id", entry.ID, "dest", entry.DestDir, "source", entry.SourceDir)
+	return entry, nil
+}
+
+func undoFile(f JournalFile, move bool) error {
+	if f.Source != f.Dest {
+		switch _, err := os.Stat(f.Dest); {
+		case errors.Is(err, os.ErrNotExist):
+			// already undone
+		case err != nil:
+			return err
+		case move:
+			if err := os.MkdirAll(filepath.Dir(f.Source), os.ModePerm); err != nil {
+				return fmt.Errorf("create source dir: %w", err)
+			}
+			if err := moveFile(f.Dest, f.Source); err != nil {
+				return err
+			}
+		default:
+			if err := os.Remove(f.Dest); err != nil {
+				return fmt.Errorf("remove copy: %w", err)
+			}
+		}
+	}
+	if move && f.Tags != nil {
+		if err := tags.WriteTags(f.Source, f.Tags, tags.Clear); err != nil {
+			return fmt.Errorf("write original tags: %w", err)
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents for as long as they're empty, stopping at root.
+func removeEmptyDirs(dir, root string) {
+	for d := dir; root != "" && fileutil.HasPrefix(d, root) && d != filepath.Clean(root); d = filepath.Dir(d) {
+		if err := os.Remove(d); err != nil {
+			return
+		}
+	}
+}
+
+// record adds a moved or copied file to the journal entry, if there is one.
+func (dc DirContext) record(src, dest string, t map[string][]string) {
+	if dc.entry == nil {
+		return
+	}
+	dc.entry.Files = append(dc.entry.Files, JournalFile{Source: src, Dest: dest, Tags: t})
+}
+
+// recordCover adds what happened to the cover to the journal entry, if there is one.
+func (dc DirContext) recordCover(action CoverAction, src, dest string) {
+	if dc.entry == nil {
+		return
+	}
+	dc.entry.Cover = &JournalCover{Action: action, Source: src, Dest: dest}
+}
+
+// remove deletes a file, or stashes it in the journal if there is an entry for the import.
+func (dc DirContext) remove(path string) error {
+	if dc.entry == nil {
+		return dc.destFS().Remove(path)
+	}
+
+	stash := filepath.Join("removed", dc.entry.ID, strconv.Itoa(len(dc.entry.Removed)))
+	if err := os.MkdirAll(filepath.Join(dc.journal.Dir, filepath.Dir(stash)), os.ModePerm); err != nil {
+		return fmt.Errorf("create stash dir: %w", err)
+	}
+	if err := moveFile(path, filepath.Join(dc.journal.Dir, stash)); err != nil {
+		return fmt.Errorf("stash: %w", err)
+	}
+	dc.entry.Removed = append(dc.entry.Removed, JournalRemoved{Path: path, Stash: stash})
+	return nil
+}
+
+// replace stashes an existing file at dest that src is about to replace, if there is an entry for the import.
+// Otherwise the file is left to be overwritten.
+func (dc DirContext) replace(src, dest string) error {
+	if dc.entry == nil || filepath.Clean(src) == filepath.Clean(dest) {
+		return nil
+	}
+	if _, err := dc.destFS().Lstat(dest); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return dc.remove(dest)
+}
+
+// removeDir deletes an empty directory, and records it in the journal entry if there is one.
+func (dc DirContext) removeDir(path string) error {
+	if err := dc.destFS().Remove(path); err != nil {
+		return err
+	}
+	if dc.entry != nil {
+		dc.entry.Removed = append(dc.entry.Removed, JournalRemoved{Path: path})
+	}
+	return nil
+}
+
+func operationName(op FileSystemOperation) string {
+	switch op.(type) {
+	case Move:
+		return "move"
+	case Copy:
+		return "copy"
+	case Reflink:
+		return "reflink"
+	case ReflinkOrCopy:
+		return "reflink-or-copy"
+	case Hardlink:
+		return "hardlink"
+	case Symlink:
+		return "symlink"
+	}
+	return fmt.Sprintf("%T", op)
+}
+
+var journalIDMu sync.Mutex
+var journalIDLast int64
+
+// journalIDTime is the time that an ID from newJournalID was made.
+func journalIDTime(id string) (time.Time, bool) {
+	nanos, err := strconv.ParseInt(id, 36, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// newJournalID returns a unique and increasing ID for an entry, based on the current time.
+func newJournalID() string {
+	journalIDMu.Lock()
+	defer journalIDMu.Unlock()
+
+	id := max(time.Now().UnixNano(), journalIDLast+1)
+	journalIDLast = id
+	return strconv.FormatInt(id, 36)
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package wrtag
+
+import (
+	"os"
+	"syscall"
+)
+
+func init() {
+	lockFile = func(f *os.File) error {
+		return syscall.Flock(int(f.Fd()), syscall.LOCK_EX) //nolint:gosec
+	}
+}
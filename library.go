@@ -0,0 +1,107 @@
+package wrtag
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"go.senan.xyz/wrtag/library"
+	"go.senan.xyz/wrtag/musicbrainz"
+	"go.senan.xyz/wrtag/tags"
+	"go.senan.xyz/wrtag/tags/normtag"
+)
+
+// IndexDir reads the release in dir and puts it in the library index, with the properties of each track.
+// If dir has no tracks anymore, it's removed from the index.
+func IndexDir(ctx context.Context, ix *library.Index, dir string) error {
+	if !ix.Enabled() {
+		return nil
+	}
+
+	cover, pathTags, err := ReadReleaseDir(dir)
+	if errors.Is(err, ErrNoTracks) {
+		return ix.DeleteRelease(ctx, dir)
+	}
+	if err != nil {
+		return fmt.Errorf("read dir: %w", err)
+	}
+
+	first := pathTags[0].Tags
+	release := library.Release{
+		Dir:              dir,
+		MBReleaseID:      normtag.Get(first, normtag.MusicBrainzReleaseID),
+		MBReleaseGroupID: normtag.Get(first, normtag.MusicBrainzReleaseGroupID),
+		MBAlbumArtistID:  normtag.Get(first, normtag.MusicBrainzAlbumArtistID),
+		Title:            normtag.Get(first, normtag.Album),
+		Artist:           cmp.Or(normtag.Get(first, normtag.AlbumArtist), normtag.Get(first, normtag.Artist)),
+		Date:             normtag.Get(first, normtag.Date),
+		HasCover:         cover != "",
+	}
+
+	tracks := make([]library.Track, 0, len(pathTags))
+	for _, pt := range pathTags {
+		props, err := tags.ReadProperties(pt.Path)
+		if err != nil {
+			return fmt.Errorf("read properties %q: %w", filepath.Base(pt.Path), err)
+		}
+		q := propertiesQuality(props)
+		discNumber, _ := strconv.Atoi(normtag.Get(pt.Tags, normtag.DiscNumber))
+		trackNumber, _ := strconv.Atoi(normtag.Get(pt.Tags, normtag.TrackNumber))
+		tracks = append(tracks, library.Track{
+			Path:          pt.Path,
+			MBRecordingID: normtag.Get(pt.Tags, normtag.MusicBrainzRecordingID),
+			MBTrackID:     normtag.Get(pt.Tags, normtag.MusicBrainzTrackID),
+			Title:         normtag.Get(pt.Tags, normtag.Title),
+			Artist:        normtag.Get(pt.Tags, normtag.Artist),
+			DiscNumber:    discNumber,
+			TrackNumber:   trackNumber,
+			Codec:         q.Codec,
+			Lossless:      q.Lossless,
+			Length:        props.Length,
+			BitRate:       q.BitRate,
+			SampleRate:    q.SampleRate,
+			BitDepth:      q.BitDepth,
+		})
+	}
+
+	return ix.PutRelease(ctx, release, tracks)
+}
+
+// updateIndex indexes destDir after an import. If the source was in the index too, like when a re-tag moved
+// a release, it's indexed again so that it's removed if it's empty, and its sync state goes with it.
+func updateIndex(ctx context.Context, ix *library.Index, srcDir, destDir string) error {
+	if !ix.Enabled() {
+		return nil
+	}
+	if err := IndexDir(ctx, ix, destDir); err != nil {
+		return err
+	}
+	if srcDir == destDir {
+		return nil
+	}
+	if err := ix.MoveSyncState(ctx, srcDir, destDir); err != nil {
+		return err
+	}
+	if _, err := ix.Release(ctx, srcDir); errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return IndexDir(ctx, ix, srcDir)
+}
+
+// releaseHash identifies the release data that tags are written from, along with the tag config, so that a sync
+// can tell if there's anything new to write.
+func releaseHash(release *musicbrainz.Release, tagConfig TagConfig) string {
+	h := sha256.New()
+	_ = json.NewEncoder(h).Encode(release)
+	fmt.Fprintf(h, "%v", tagConfig)
+	return hex.EncodeToString(h.Sum(nil))
+}
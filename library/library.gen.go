@@ -0,0 +1,142 @@
+// Code generated by "sqlbgen type Release type Track type SyncState -- library.gen.go"; DO NOT EDIT.
+
+package library
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func _() {
+	// Validate the struct fields haven't changed. If this doesn't compile you probably need to `go generate` again.
+	var r Release
+	_ = Release{r.Dir, r.MBReleaseID, r.MBReleaseGroupID, r.MBAlbumArtistID, r.Title, r.Artist, r.Date, r.NumTracks, r.HasCover, r.UpdatedTime, r.SyncTime}
+}
+
+func (Release) IsGenerated(c string) bool {
+	return false
+}
+
+func (r Release) Values() []sql.NamedArg {
+	return []sql.NamedArg{sql.Named("dir", r.Dir), sql.Named("mb_release_id", r.MBReleaseID), sql.Named("mb_release_group_id", r.MBReleaseGroupID), sql.Named("mb_album_artist_id", r.MBAlbumArtistID), sql.Named("title", r.Title), sql.Named("artist", r.Artist), sql.Named("date", r.Date), sql.Named("num_tracks", r.NumTracks), sql.Named("has_cover", r.HasCover), sql.Named("updated_time", r.UpdatedTime), sql.Named("sync_time", r.SyncTime)}
+}
+
+func (r *Release) ScanFrom(columns []string, rows *sql.Rows, buf []any) error {
+	for _, col := range columns {
+		switch col {
+		case "dir":
+			buf = append(buf, &r.Dir)
+		case "mb_release_id":
+			buf = append(buf, &r.MBReleaseID)
+		case "mb_release_group_id":
+			buf = append(buf, &r.MBReleaseGroupID)
+		case "mb_album_artist_id":
+			buf = append(buf, &r.MBAlbumArtistID)
+		case "title":
+			buf = append(buf, &r.Title)
+		case "artist":
+			buf = append(buf, &r.Artist)
+		case "date":
+			buf = append(buf, &r.Date)
+		case "num_tracks":
+			buf = append(buf, &r.NumTracks)
+		case "has_cover":
+			buf = append(buf, &r.HasCover)
+		case "updated_time":
+			buf = append(buf, &r.UpdatedTime)
+		case "sync_time":
+			buf = append(buf, &r.SyncTime)
+		default:
+			return fmt.Errorf("unknown column name %q", col)
+		}
+	}
+	return rows.Scan(buf...)
+}
+
+func _() {
+	// Validate the struct fields haven't changed. If this doesn't compile you probably need to `go generate` again.
+	var t Track
+	_ = Track{t.Path, t.ReleaseDir, t.MBRecordingID, t.MBTrackID, t.Title, t.Artist, t.DiscNumber, t.TrackNumber, t.Codec, t.Lossless, t.Length, t.BitRate, t.SampleRate, t.BitDepth}
+}
+
+func (Track) IsGenerated(c string) bool {
+	return false
+}
+
+func (t Track) Values() []sql.NamedArg {
+	return []sql.NamedArg{sql.Named("path", t.Path), sql.Named("release_dir", t.ReleaseDir), sql.Named("mb_recording_id", t.MBRecordingID), sql.Named("mb_track_id", t.MBTrackID), sql.Named("title", t.Title), sql.Named("artist", t.Artist), sql.Named("disc_number", t.DiscNumber), sql.Named("track_number", t.TrackNumber), sql.Named("codec", t.Codec), sql.Named("lossless", t.Lossless), sql.Named("length", t.Length), sql.Named("bit_rate", t.BitRate), sql.Named("sample_rate", t.SampleRate), sql.Named("bit_depth", t.BitDepth)}
+}
+
+func (t *Track) ScanFrom(columns []string, rows *sql.Rows, buf []any) error {
+	for _, col := range columns {
+		switch col {
+		case "path":
+			buf = append(buf, &t.Path)
+		case "release_dir":
+			buf = append(buf, &t.ReleaseDir)
+		case "mb_recording_id":
+			buf = append(buf, &t.MBRecordingID)
+		case "mb_track_id":
+			buf = append(buf, &t.MBTrackID)
+		case "title":
+			buf = append(buf, &t.Title)
+		case "artist":
+			buf = append(buf, &t.Artist)
+		case "disc_number":
+			buf = append(buf, &t.DiscNumber)
+		case "track_number":
+			buf = append(buf, &t.TrackNumber)
+		case "codec":
+			buf = append(buf, &t.Codec)
+		case "lossless":
+			buf = append(buf, &t.Lossless)
+		case "length":
+			buf = append(buf, &t.Length)
+		case "bit_rate":
+			buf = append(buf, &t.BitRate)
+		case "sample_rate":
+			buf = append(buf, &t.SampleRate)
+		case "bit_depth":
+			buf = append(buf, &t.BitDepth)
+		default:
+			return fmt.Errorf("unknown column name %q", col)
+		}
+	}
+	return rows.Scan(buf...)
+}
+
+func _() {
+	// Validate the struct fields haven't changed. If this doesn't compile you probably need to `go generate` again.
+	var s SyncState
+	_ = SyncState{s.Dir, s.LastAttempt, s.LastSuccess, s.LastError, s.Failures, s.ReleaseHash}
+}
+
+func (SyncState) IsGenerated(c string) bool {
+	return false
+}
+
+func (s SyncState) Values() []sql.NamedArg {
+	return []sql.NamedArg{sql.Named("dir", s.Dir), sql.Named("last_attempt", s.LastAttempt), sql.Named("last_success", s.LastSuccess), sql.Named("last_error", s.LastError), sql.Named("failures", s.Failures), sql.Named("release_hash", s.ReleaseHash)}
+}
+
+func (s *SyncState) ScanFrom(columns []string, rows *sql.Rows, buf []any) error {
+	for _, col := range columns {
+		switch col {
+		case "dir":
+			buf = append(buf, &s.Dir)
+		case "last_attempt":
+			buf = append(buf, &s.LastAttempt)
+		case "last_success":
+			buf = append(buf, &s.LastSuccess)
+		case "last_error":
+			buf = append(buf, &s.LastError)
+		case "failures":
+			buf = append(buf, &s.Failures)
+		case "release_hash":
+			buf = append(buf, &s.ReleaseHash)
+		default:
+			return fmt.Errorf("unknown column name %q", col)
+		}
+	}
+	return rows.Scan(buf...)
+}
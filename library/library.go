@@ -0,0 +1,368 @@
+// Package library keeps an index of the releases and tracks in a music library, so that questions like "do I
+// have this release?" or "which releases have no cover?" can be answered without walking the library and
+// reading every file.
+package library
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	"github.com/rogpeppe/go-internal/txtar"
+	"go.senan.xyz/sqlb"
+)
+
+// Index is a SQLite database of the releases in a library, keyed by their directory. It's opened on first use.
+//
+// A nil *Index, or one with no Path, is valid and does nothing.
+type Index struct {
+	Path string
+
+	mu  sync.Mutex
+	db  *sql.DB
+	err error
+}
+
+//go:generate go tool sqlbgen type Release type Track type SyncState -- library.gen.go
+
+// Release is a release directory in the library.
+type Release struct {
+	Dir              string
+	MBReleaseID      string
+	MBReleaseGroupID string
+	MBAlbumArtistID  string
+	Title            string
+	Artist           string
+	Date             string
+	NumTracks        int
+	HasCover         bool
+	UpdatedTime      time.Time
+	SyncTime         sql.NullTime // when the release was last synced, if ever
+}
+
+// Track is a track in a release directory.
+type Track struct {
+	Path          string
+	ReleaseDir    string
+	MBRecordingID string
+	MBTrackID     string
+	Title         string
+	Artist        string
+	DiscNumber    int
+	TrackNumber   int
+	Codec         string
+	Lossless      bool
+	Length        time.Duration
+	BitRate       uint // in kbit/s
+	SampleRate    uint // in Hz
+	BitDepth      uint
+}
+
+// SyncState is what happened the last time a directory was synced. It's kept apart from the releases, since a
+// directory that fails to sync may not be a release at all.
+type SyncState struct {
+	Dir         string
+	LastAttempt time.Time
+	LastSuccess sql.NullTime
+	LastError   string
+	Failures    int    // how many syncs in a row have failed
+	ReleaseHash string // of the release data the last successful sync wrote
+}
+
+// Enabled returns whether the index has somewhere to be kept.
+func (ix *Index) Enabled() bool {
+	return ix != nil && ix.Path != ""
+}
+
+// PutRelease adds or replaces a release and all of its tracks. The release keeps its sync time if it was
+// already in the index.
+func (ix *Index) PutRelease(ctx context.Context, release Release, tracks []Track) error {
+	if !ix.Enabled() {
+		return nil
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if !release.SyncTime.Valid {
+		err := sqlb.QueryRow(ctx, tx, sqlb.Scan(&release.SyncTime), "select sync_time from releases where dir=?", release.Dir)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("get sync time: %w", err)
+		}
+	}
+	if release.UpdatedTime.IsZero() {
+		release.UpdatedTime = time.Now()
+	}
+	release.NumTracks = len(tracks)
+
+	if err := deleteRelease(ctx, tx, release.Dir); err != nil {
+		return err
+	}
+	if err := sqlb.Exec(ctx, tx, "insert into releases ?", sqlb.InsertSQL(release)); err != nil {
+		return fmt.Errorf("insert release: %w", err)
+	}
+	for i := range tracks {
+		tracks[i].ReleaseDir = release.Dir
+	}
+	if len(tracks) > 0 {
+		if err := sqlb.Exec(ctx, tx, "insert into tracks ?", sqlb.InsertSQL(tracks...)); err != nil {
+			return fmt.Errorf("insert tracks: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// DeleteRelease removes a release and its tracks, if it's in the index.
+func (ix *Index) DeleteRelease(ctx context.Context, dir string) error {
+	if !ix.Enabled() {
+		return nil
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return err
+	}
+	return deleteRelease(ctx, db, dir)
+}
+
+// SetSynced records that the release in dir was synced at t.
+func (ix *Index) SetSynced(ctx context.Context, dir string, t time.Time) error {
+	if !ix.Enabled() {
+		return nil
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return err
+	}
+	if err := sqlb.Exec(ctx, db, "update releases set sync_time=? where dir=?", t, dir); err != nil {
+		return fmt.Errorf("set sync time: %w", err)
+	}
+	return nil
+}
+
+// SyncState returns the sync state of dir, or sql.ErrNoRows if it's never been synced.
+func (ix *Index) SyncState(ctx context.Context, dir string) (SyncState, error) {
+	if !ix.Enabled() {
+		return SyncState{}, sql.ErrNoRows
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return SyncState{}, err
+	}
+	var state SyncState
+	if err := sqlb.QueryRow(ctx, db, &state, "select * from sync_state where dir=?", dir); err != nil {
+		return SyncState{}, err
+	}
+	return state, nil
+}
+
+// PutSyncState adds or replaces the sync state of a directory.
+func (ix *Index) PutSyncState(ctx context.Context, state SyncState) error {
+	if !ix.Enabled() {
+		return nil
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return err
+	}
+	if err := sqlb.Exec(ctx, db, "insert or replace into sync_state ?", sqlb.InsertSQL(state)); err != nil {
+		return fmt.Errorf("put sync state: %w", err)
+	}
+	return nil
+}
+
+// MoveSyncState moves the sync state of a directory that was moved, replacing any at the destination.
+func (ix *Index) MoveSyncState(ctx context.Context, srcDir, destDir string) error {
+	if !ix.Enabled() || srcDir == destDir {
+		return nil
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return err
+	}
+	if err := sqlb.Exec(ctx, db, "delete from sync_state where dir=? and exists (select 1 from sync_state where dir=?)", destDir, srcDir); err != nil {
+		return fmt.Errorf("delete sync state: %w", err)
+	}
+	if err := sqlb.Exec(ctx, db, "update sync_state set dir=? where dir=?", destDir, srcDir); err != nil {
+		return fmt.Errorf("move sync state: %w", err)
+	}
+	return nil
+}
+
+// Reset removes every release and track from the index, before it's built again. Sync states are kept.
+func (ix *Index) Reset(ctx context.Context) error {
+	if !ix.Enabled() {
+		return nil
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return err
+	}
+	if err := sqlb.Exec(ctx, db, "delete from tracks"); err != nil {
+		return fmt.Errorf("delete tracks: %w", err)
+	}
+	if err := sqlb.Exec(ctx, db, "delete from releases"); err != nil {
+		return fmt.Errorf("delete releases: %w", err)
+	}
+	return nil
+}
+
+// Release returns the release in dir, or sql.ErrNoRows if it isn't in the index.
+func (ix *Index) Release(ctx context.Context, dir string) (Release, error) {
+	if !ix.Enabled() {
+		return Release{}, sql.ErrNoRows
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return Release{}, err
+	}
+	var release Release
+	if err := sqlb.QueryRow(ctx, db, &release, "select * from releases where dir=?", dir); err != nil {
+		return Release{}, err
+	}
+	return release, nil
+}
+
+// Releases returns every release in the index, ordered by directory.
+func (ix *Index) Releases(ctx context.Context) ([]Release, error) {
+	return ix.releases(ctx, "select * from releases order by dir")
+}
+
+// ReleasesByMBID returns the releases with a MusicBrainz release ID. There's usually only one, unless the
+// library has more than one copy.
+func (ix *Index) ReleasesByMBID(ctx context.Context, mbid string) ([]Release, error) {
+	return ix.releases(ctx, "select * from releases where mb_release_id=? order by dir", mbid)
+}
+
+// Tracks returns the tracks of the release in dir, in disc and track order.
+func (ix *Index) Tracks(ctx context.Context, dir string) ([]Track, error) {
+	if !ix.Enabled() {
+		return nil, nil
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var tracks []Track
+	if err := sqlb.QueryRows(ctx, db, sqlb.Append(&tracks), "select * from tracks where release_dir=? order by disc_number, track_number, path", dir); err != nil {
+		return nil, err
+	}
+	return tracks, nil
+}
+
+// Close closes the database, if it was opened.
+func (ix *Index) Close() error {
+	if ix == nil {
+		return nil
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.db == nil {
+		return nil
+	}
+	err := ix.db.Close()
+	ix.db, ix.err = nil, nil
+	return err
+}
+
+func (ix *Index) releases(ctx context.Context, query string, args ...any) ([]Release, error) {
+	if !ix.Enabled() {
+		return nil, nil
+	}
+	db, err := ix.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var releases []Release
+	if err := sqlb.QueryRows(ctx, db, sqlb.Append(&releases), query, args...); err != nil {
+		return nil, err
+	}
+	return releases, nil
+}
+
+func (ix *Index) open(ctx context.Context) (*sql.DB, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.db != nil || ix.err != nil {
+		return ix.db, ix.err
+	}
+
+	ix.db, ix.err = openDB(ctx, ix.Path)
+	if ix.err != nil {
+		ix.err = fmt.Errorf("open index: %w", ix.err)
+	}
+	return ix.db, ix.err
+}
+
+func openDB(ctx context.Context, path string) (*sql.DB, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("make path abs: %w", err)
+	}
+
+	// wait on other writers, like wrtag and wrtagweb using the same index
+	dbURI, _ := url.Parse("file://?_pragma=busy_timeout(10000)&_pragma=journal_mode(wal)&_pragma=foreign_keys(1)&_txlock=immediate")
+	dbURI.Path = path
+
+	db, err := sql.Open("sqlite3", dbURI.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return db, nil
+}
+
+func deleteRelease(ctx context.Context, db sqlb.ExecDB, dir string) error {
+	if err := sqlb.Exec(ctx, db, "delete from tracks where release_dir=?", dir); err != nil {
+		return fmt.Errorf("delete tracks: %w", err)
+	}
+	if err := sqlb.Exec(ctx, db, "delete from releases where dir=?", dir); err != nil {
+		return fmt.Errorf("delete release: %w", err)
+	}
+	return nil
+}
+
+//go:embed schema.sql
+var schema []byte
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	var nextVer int
+	if err := sqlb.QueryRow(ctx, db, sqlb.Scan(&nextVer), "pragma user_version"); err != nil {
+		return fmt.Errorf("get schema version: %w", err)
+	}
+
+	migrations := txtar.Parse(schema)
+	for i := nextVer; i < len(migrations.Files); i++ {
+		migration := migrations.Files[i]
+		slog.DebugContext(ctx, "running index migration", "name", migration.Name)
+
+		if err := sqlb.Exec(ctx, db, string(migration.Data)); err != nil {
+			return fmt.Errorf("run migration %d: %w", i, err)
+		}
+		if err := sqlb.Exec(ctx, db, fmt.Sprintf("pragma user_version = %d", i+1)); err != nil {
+			return fmt.Errorf("run migration %d: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package library
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	ix := &Index{Path: filepath.Join(t.TempDir(), "index.db")}
+	t.Cleanup(func() { ix.Close() })
+
+	_, err := ix.Release(ctx, "/music/a")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	err = ix.PutRelease(ctx, Release{Dir: "/music/a", MBReleaseID: "mbid-a", Title: "A", HasCover: true}, []Track{
+		{Path: "/music/a/2.flac", TrackNumber: 2, Codec: "flac", Lossless: true, Length: 3 * time.Minute},
+		{Path: "/music/a/1.flac", TrackNumber: 1, Codec: "flac", Lossless: true, Length: 2 * time.Minute},
+	})
+	require.NoError(t, err)
+
+	release, err := ix.Release(ctx, "/music/a")
+	require.NoError(t, err)
+	assert.Equal(t, "A", release.Title)
+	assert.Equal(t, 2, release.NumTracks)
+	assert.True(t, release.HasCover)
+	assert.False(t, release.SyncTime.Valid)
+
+	tracks, err := ix.Tracks(ctx, "/music/a")
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	assert.Equal(t, "/music/a/1.flac", tracks[0].Path)
+	assert.Equal(t, "/music/a", tracks[0].ReleaseDir)
+	assert.Equal(t, 2*time.Minute, tracks[0].Length)
+
+	// the sync time is kept when the release is indexed again
+	synced := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, ix.SetSynced(ctx, "/music/a", synced))
+	require.NoError(t, ix.PutRelease(ctx, Release{Dir: "/music/a", MBReleaseID: "mbid-a", Title: "A"}, []Track{
+		{Path: "/music/a/1.mp3", TrackNumber: 1, Codec: "mpeg", BitRate: 320},
+	}))
+	release, err = ix.Release(ctx, "/music/a")
+	require.NoError(t, err)
+	assert.True(t, release.SyncTime.Time.Equal(synced))
+	assert.False(t, release.HasCover)
+
+	tracks, err = ix.Tracks(ctx, "/music/a")
+	require.NoError(t, err)
+	require.Len(t, tracks, 1)
+	assert.Equal(t, uint(320), tracks[0].BitRate)
+
+	require.NoError(t, ix.PutRelease(ctx, Release{Dir: "/music/a (2)", MBReleaseID: "mbid-a"}, nil))
+	releases, err := ix.ReleasesByMBID(ctx, "mbid-a")
+	require.NoError(t, err)
+	require.Len(t, releases, 2)
+	assert.Equal(t, "/music/a", releases[0].Dir)
+	assert.Equal(t, "/music/a (2)", releases[1].Dir)
+
+	require.NoError(t, ix.DeleteRelease(ctx, "/music/a"))
+	_, err = ix.Release(ctx, "/music/a")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	tracks, err = ix.Tracks(ctx, "/music/a")
+	require.NoError(t, err)
+	assert.Empty(t, tracks)
+
+	require.NoError(t, ix.Reset(ctx))
+	releases, err = ix.Releases(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, releases)
+}
+
+func TestIndexDisabled(t *testing.T) {
+	t.Parallel()
+
+	var ix *Index
+	require.NoError(t, ix.PutRelease(t.Context(), Release{Dir: "/music/a"}, nil))
+	require.NoError(t, ix.SetSynced(t.Context(), "/music/a", time.Now()))
+	_, err := ix.Release(t.Context(), "/music/a")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	require.NoError(t, ix.Close())
+}
+
+func TestSyncState(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	ix := &Index{Path: filepath.Join(t.TempDir(), "index.db")}
+	t.Cleanup(func() { ix.Close() })
+
+	_, err := ix.SyncState(ctx, "/music/a")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	attempt := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, ix.PutSyncState(ctx, SyncState{Dir: "/music/a", LastAttempt: attempt, LastError: "score too low", Failures: 1}))
+	require.NoError(t, ix.PutSyncState(ctx, SyncState{Dir: "/music/a", LastAttempt: attempt, LastError: "score too low", Failures: 2}))
+
+	state, err := ix.SyncState(ctx, "/music/a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, state.Failures)
+	assert.Equal(t, "score too low", state.LastError)
+	assert.True(t, state.LastAttempt.Equal(attempt))
+	assert.False(t, state.LastSuccess.Valid)
+
+	// state follows a dir that was moved, and survives a rebuild
+	require.NoError(t, ix.PutSyncState(ctx, SyncState{Dir: "/music/b", LastAttempt: attempt}))
+	require.NoError(t, ix.MoveSyncState(ctx, "/music/a", "/music/b"))
+	require.NoError(t, ix.Reset(ctx))
+
+	_, err = ix.SyncState(ctx, "/music/a")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	state, err = ix.SyncState(ctx, "/music/b")
+	require.NoError(t, err)
+	assert.Equal(t, 2, state.Failures)
+}
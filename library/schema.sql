@@ -0,0 +1,53 @@
+/*
+migrations are executed in order. the current version number is stored in the DB with PRAGMA user_version = <user_version>.
+when the index is opened, it will execute this from <user_version>..<latest index>.
+ */
+-- 2026.10.18 init --
+create table releases (
+    dir text primary key,
+    mb_release_id text not null default "",
+    mb_release_group_id text not null default "",
+    mb_album_artist_id text not null default "",
+    title text not null default "",
+    artist text not null default "",
+    date text not null default "",
+    num_tracks integer not null default 0,
+    has_cover boolean not null default false,
+    updated_time timestamp not null,
+    sync_time timestamp
+);
+
+create index idx_releases_mb_release_id on releases (mb_release_id);
+
+create index idx_releases_mb_release_group_id on releases (mb_release_group_id);
+
+create table tracks (
+    path text primary key,
+    release_dir text not null references releases (dir) on delete cascade,
+    mb_recording_id text not null default "",
+    mb_track_id text not null default "",
+    title text not null default "",
+    artist text not null default "",
+    disc_number integer not null default 0,
+    track_number integer not null default 0,
+    codec text not null default "",
+    lossless boolean not null default false,
+    length integer not null default 0,
+    bit_rate integer not null default 0,
+    sample_rate integer not null default 0,
+    bit_depth integer not null default 0
+);
+
+create index idx_tracks_release_dir on tracks (release_dir);
+
+create index idx_tracks_mb_recording_id on tracks (mb_recording_id);
+
+-- 2026.10.18 sync state --
+create table sync_state (
+    dir text primary key,
+    last_attempt timestamp not null,
+    last_success timestamp,
+    last_error text not null default "",
+    failures integer not null default 0,
+    release_hash text not null default ""
+);
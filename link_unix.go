@@ -0,0 +1,15 @@
+//go:build unix
+
+package wrtag
+
+import (
+	"os"
+	"syscall"
+)
+
+func init() {
+	isHardlinked = func(info os.FileInfo) bool {
+		st, ok := info.Sys().(*syscall.Stat_t)
+		return ok && st.Nlink > 1
+	}
+}
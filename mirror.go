@@ -0,0 +1,174 @@
+package wrtag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.senan.xyz/wrtag/fileutil"
+)
+
+// MirrorResult is what Mirror did for a release, or would do for a dry run.
+type MirrorResult struct {
+	DestDir string
+
+	// Paths are every file the release has in the mirror, whether they were written this time or not.
+	Paths []string
+
+	Written   int
+	Unchanged int
+}
+
+// Mirror writes a release that's already in the library to the mirror under MirrorPathFormat, with the given
+// Transcode. Like Relayout, the release is read from the cache or the tags that were written when it was imported,
+// without any network requests, so the mirror is laid out like the library would be.
+//
+// Files in the mirror have the modification time of their source. Those that still do are unchanged, and aren't
+// written again. The cover is copied, or scaled down to fit in MirrorCoverSize pixels if it's set.
+func Mirror(ctx context.Context, cfg *Config, op Transcode, srcDir string) (*MirrorResult, error) {
+	if cfg.MirrorPathFormat.Root() == "" {
+		return nil, errors.New("no mirror path format provided")
+	}
+
+	cover, pathTags, err := ReadReleaseDir(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	release, releaseTracks, _, err := localRelease(ctx, cfg, pathTags)
+	if err != nil {
+		return nil, err
+	}
+
+	destDir, err := DestDir(&cfg.MirrorPathFormat, release)
+	if err != nil {
+		return nil, fmt.Errorf("gen dest dir: %w", err)
+	}
+
+	res := &MirrorResult{DestDir: destDir}
+
+	unlock := lockPaths(destDir)
+	defer unlock()
+
+	dc := NewDirContext()
+	for i, pt := range pathTags {
+		rt := releaseTracks[i]
+		destPath, err := cfg.MirrorPathFormat.Execute(*release, rt.media, rt.track, op.Format().Ext)
+		if err != nil {
+			return nil, fmt.Errorf("create path: %w", err)
+		}
+		destPath = fileutil.TrimLength(destPath, 255)
+		if slices.Contains(res.Paths, destPath) {
+			return nil, fmt.Errorf("%w: more than one track would be mirrored to %q", ErrCollision, destPath)
+		}
+		res.Paths = append(res.Paths, destPath)
+
+		wrote, err := mirrorPath(dc, op, pt.Path, destPath, func(src, dest string) error {
+			return op.ProcessPath(ctx, dc, src, dest, cfg.FileMode)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("mirror path %q: %w", filepath.Base(pt.Path), err)
+		}
+		res.count(wrote)
+	}
+
+	if cover != "" {
+		destCover := coverDest(destDir, cover)
+		res.Paths = append(res.Paths, destCover)
+
+		wrote, err := mirrorPath(dc, op, cover, destCover, func(src, dest string) error {
+			if cfg.MirrorCoverSize <= 0 {
+				return op.ProcessPath(ctx, dc, src, dest, cfg.FileMode)
+			}
+			if !op.CanModifyDest() {
+				slog.InfoContext(ctx, "scale cover", "from", src, "to", dest, "size", cfg.MirrorCoverSize)
+				return nil
+			}
+			return scaleCover(ctx, src, dest, cfg.MirrorCoverSize, cfg.FileMode)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("mirror cover: %w", err)
+		}
+		res.count(wrote)
+	}
+
+	return res, nil
+}
+
+func (r *MirrorResult) count(wrote bool) {
+	if wrote {
+		r.Written++
+	} else {
+		r.Unchanged++
+	}
+}
+
+// mirrorPath writes src to dest with write, unless dest already has the modification time of src. After writing,
+// dest is given that modification time so that it's skipped next time.
+func mirrorPath(dc DirContext, op Transcode, src, dest string, write func(src, dest string) error) (bool, error) {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false, fmt.Errorf("stat source: %w", err)
+	}
+	if destInfo, err := os.Stat(dest); err == nil && destInfo.ModTime().Equal(srcInfo.ModTime()) {
+		dc.knownDestPaths[dest] = struct{}{}
+		return false, nil
+	}
+
+	if err := write(src, dest); err != nil {
+		return false, err
+	}
+	if !op.CanModifyDest() {
+		return true, nil
+	}
+	if err := os.Chtimes(dest, time.Time{}, srcInfo.ModTime()); err != nil {
+		return false, fmt.Errorf("set mod time: %w", err)
+	}
+	return true, nil
+}
+
+// CleanMirror removes the files under root that aren't in keep, along with any directories left empty. It returns
+// the files that were removed, or would be for a dry run.
+func CleanMirror(ctx context.Context, root string, keep map[string]struct{}, dryRun bool) ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if _, ok := keep[path]; ok {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".wrtag-transcode-tmp-") {
+			return nil // probably being written by another mirror
+		}
+		removed = append(removed, path)
+		if dryRun {
+			slog.InfoContext(ctx, "delete mirror file", "path", path)
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "deleted mirror file", "path", path)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("walk mirror: %w", err)
+	}
+	if !dryRun {
+		for _, path := range removed {
+			removeEmptyDirs(filepath.Dir(path), root)
+		}
+	}
+	return removed, nil
+}
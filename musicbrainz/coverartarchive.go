@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"go.senan.xyz/wrtag/clientutil"
 	"golang.org/x/time/rate"
 )
 
@@ -14,6 +15,9 @@ type CAAClient struct {
 	BaseURL    string
 	HTTPClient *http.Client
 	Limiter    *rate.Limiter
+
+	// Cache optionally stores responses so they can be reused without waiting for the Limiter.
+	Cache *clientutil.Cache
 }
 
 func (c *CAAClient) GetCoverURL(ctx context.Context, release *Release) (string, error) {
@@ -70,12 +74,13 @@ type caaResponse struct {
 }
 
 func (c *CAAClient) request(ctx context.Context, r *http.Request, dest any) error {
-	if err := c.Limiter.Wait(ctx); err != nil {
-		return err
-	}
-
 	r = r.WithContext(ctx)
-	resp, err := c.HTTPClient.Do(r)
+	resp, err := c.Cache.Do(r, func(r *http.Request) (*http.Response, error) {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		return c.HTTPClient.Do(r)
+	})
 	if err != nil {
 		return fmt.Errorf("make caa request: %w", err)
 	}
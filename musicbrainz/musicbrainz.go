@@ -19,6 +19,7 @@ import (
 	"unicode"
 
 	"github.com/araddon/dateparse"
+	"go.senan.xyz/wrtag/clientutil"
 	"golang.org/x/time/rate"
 )
 
@@ -28,6 +29,9 @@ type MBClient struct {
 	BaseURL    string
 	HTTPClient *http.Client
 	Limiter    *rate.Limiter
+
+	// Cache optionally stores responses so they can be reused without waiting for the Limiter.
+	Cache *clientutil.Cache
 }
 
 func (c *MBClient) GetRelease(ctx context.Context, mbid string) (*Release, error) {
@@ -72,6 +76,28 @@ func (c *MBClient) SearchRelease(ctx context.Context, q ReleaseQuery) (*Release,
 		return release, nil
 	}
 
+	results, err := c.SearchReleases(ctx, q, 1)
+	if err != nil {
+		return nil, err
+	}
+	releaseKey := results[0]
+
+	release, err := c.GetRelease(ctx, releaseKey.ID)
+	if err != nil {
+		return nil, fmt.Errorf("get release by mbid %s: %w", releaseKey.ID, err)
+	}
+
+	return release, nil
+}
+
+// ReleaseSearchResult is a single hit from a release search, along with the MusicBrainz search score (0-100).
+type ReleaseSearchResult struct {
+	ID    string `json:"id"`
+	Score int    `json:"score"`
+}
+
+// SearchReleases returns the IDs of the top limit releases for a query, ordered by their MusicBrainz search score.
+func (c *MBClient) SearchReleases(ctx context.Context, q ReleaseQuery, limit int) ([]ReleaseSearchResult, error) {
 	// https://beta.musicbrainz.org/doc/MusicBrainz_API/Search#Release
 
 	var params []string
@@ -113,7 +139,7 @@ func (c *MBClient) SearchRelease(ctx context.Context, q ReleaseQuery) (*Release,
 
 	urlV := url.Values{}
 	urlV.Set("fmt", "json")
-	urlV.Set("limit", "1")
+	urlV.Set("limit", strconv.Itoa(max(limit, 1)))
 	urlV.Set("query", queryStr)
 
 	url, _ := url.Parse(joinPath(c.BaseURL, "release"))
@@ -121,34 +147,149 @@ func (c *MBClient) SearchRelease(ctx context.Context, q ReleaseQuery) (*Release,
 	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
 
 	var sr struct {
-		Releases []struct {
-			ID    string `json:"id"`
-			Score int    `json:"score"`
-		} `json:"releases"`
+		Releases []ReleaseSearchResult `json:"releases"`
 	}
 	if err := c.request(ctx, req, &sr); err != nil {
 		return nil, fmt.Errorf("request release: %w", err)
 	}
-	if len(sr.Releases) == 0 || sr.Releases[0].ID == "" {
+
+	results := slices.DeleteFunc(sr.Releases, func(r ReleaseSearchResult) bool { return r.ID == "" })
+	if len(results) == 0 {
 		return nil, ErrNoResults
 	}
-	releaseKey := sr.Releases[0]
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
 
-	release, err := c.GetRelease(ctx, releaseKey.ID)
-	if err != nil {
-		return nil, fmt.Errorf("get release by mbid %s: %w", releaseKey.ID, err)
+func (c *MBClient) GetRecording(ctx context.Context, mbid string) (*Recording, error) {
+	urlV := url.Values{}
+	urlV.Set("fmt", "json")
+	urlV.Set("inc", "artist-credits genres isrcs artist-rels")
+
+	url, _ := url.Parse(joinPath(c.BaseURL, "recording", mbid))
+	url.RawQuery = urlV.Encode()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+
+	var rec Recording
+	if err := c.request(ctx, req, &rec); err != nil {
+		return nil, fmt.Errorf("request recording: %w", err)
 	}
 
-	return release, nil
+	return &rec, nil
 }
 
-func (c *MBClient) request(ctx context.Context, r *http.Request, dest any) error {
-	if err := c.Limiter.Wait(ctx); err != nil {
-		return err
+type RecordingQuery struct {
+	MBRecordingID string
+	MBArtistID    string
+
+	Recording string
+	Artist    string
+	ISRC      string
+}
+
+// RecordingSearchResult is a single hit from a recording search, along with the MusicBrainz search score (0-100).
+type RecordingSearchResult struct {
+	ID    string `json:"id"`
+	Score int    `json:"score"`
+}
+
+// SearchRecordings returns the IDs of the top limit recordings for a query, ordered by their MusicBrainz search score.
+func (c *MBClient) SearchRecordings(ctx context.Context, q RecordingQuery, limit int) ([]RecordingSearchResult, error) {
+	// https://beta.musicbrainz.org/doc/MusicBrainz_API/Search#Recording
+
+	var params []string
+	if q.MBArtistID != "" {
+		params = append(params, field("arid", q.MBArtistID))
+	}
+	if q.Recording != "" {
+		params = append(params, field("recording", strings.ToLower(q.Recording)))
+	}
+	if q.Artist != "" {
+		params = append(params, field("artist", strings.ToLower(q.Artist)))
+	}
+	if q.ISRC != "" {
+		params = append(params, boostField(field("isrc", q.ISRC), 5)) // boosted, unique per recording
 	}
+	if len(params) == 0 {
+		return nil, ErrNoResults
+	}
+
+	urlV := url.Values{}
+	urlV.Set("fmt", "json")
+	urlV.Set("limit", strconv.Itoa(max(limit, 1)))
+	urlV.Set("query", strings.Join(params, " "))
 
+	url, _ := url.Parse(joinPath(c.BaseURL, "recording"))
+	url.RawQuery = urlV.Encode()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+
+	var sr struct {
+		Recordings []RecordingSearchResult `json:"recordings"`
+	}
+	if err := c.request(ctx, req, &sr); err != nil {
+		return nil, fmt.Errorf("request recording: %w", err)
+	}
+
+	results := slices.DeleteFunc(sr.Recordings, func(r RecordingSearchResult) bool { return r.ID == "" })
+	if len(results) == 0 {
+		return nil, ErrNoResults
+	}
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// LookupDiscID finds the releases with a disc matching discID. If none match exactly, releases with a disc similar to
+// toc are returned instead, and exact is false. The toc is in the format "<first track> <last track> <lead-out> <offsets>...".
+func (c *MBClient) LookupDiscID(ctx context.Context, discID, toc string) (releaseIDs []string, exact bool, err error) {
+	// https://musicbrainz.org/doc/MusicBrainz_API#discid
+
+	urlV := url.Values{}
+	urlV.Set("fmt", "json")
+	if toc != "" {
+		urlV.Set("toc", toc)
+	}
+
+	url, _ := url.Parse(joinPath(c.BaseURL, "discid", discID))
+	url.RawQuery = urlV.Encode()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+
+	var dr struct {
+		ID       string `json:"id"`
+		Releases []struct {
+			ID string `json:"id"`
+		} `json:"releases"`
+	}
+	if err := c.request(ctx, req, &dr); err != nil {
+		if se := StatusError(0); errors.As(err, &se) && se == http.StatusNotFound {
+			return nil, false, ErrNoResults
+		}
+		return nil, false, fmt.Errorf("request discid: %w", err)
+	}
+	for _, r := range dr.Releases {
+		if r.ID != "" {
+			releaseIDs = append(releaseIDs, r.ID)
+		}
+	}
+	if len(releaseIDs) == 0 {
+		return nil, false, ErrNoResults
+	}
+	return releaseIDs, dr.ID == discID, nil
+}
+
+func (c *MBClient) request(ctx context.Context, r *http.Request, dest any) error {
 	r = r.WithContext(ctx)
-	resp, err := c.HTTPClient.Do(r)
+	resp, err := c.Cache.Do(r, func(r *http.Request) (*http.Response, error) {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		return c.HTTPClient.Do(r)
+	})
 	if err != nil {
 		return fmt.Errorf("search: %w", err)
 	}
@@ -216,24 +357,26 @@ type Relation struct {
 }
 
 type Track struct {
-	ID        string `json:"id"`
-	Length    int    `json:"length"`
-	Recording struct {
-		FirstReleaseDate string         `json:"first-release-date"`
-		Genres           []Genre        `json:"genres"`
-		Video            bool           `json:"video"`
-		Disambiguation   string         `json:"disambiguation"`
-		ID               string         `json:"id"`
-		Length           int            `json:"length"`
-		Title            string         `json:"title"`
-		Artists          []ArtistCredit `json:"artist-credit"`
-		Relations        []Relation     `json:"relations"`
-		ISRCs            []string       `json:"isrcs"`
-	} `json:"recording"`
-	Number   string         `json:"number"`
-	Position int            `json:"position"`
-	Title    string         `json:"title"`
-	Artists  []ArtistCredit `json:"artist-credit"`
+	ID        string         `json:"id"`
+	Length    int            `json:"length"`
+	Recording Recording      `json:"recording"`
+	Number    string         `json:"number"`
+	Position  int            `json:"position"`
+	Title     string         `json:"title"`
+	Artists   []ArtistCredit `json:"artist-credit"`
+}
+
+type Recording struct {
+	FirstReleaseDate string         `json:"first-release-date"`
+	Genres           []Genre        `json:"genres"`
+	Video            bool           `json:"video"`
+	Disambiguation   string         `json:"disambiguation"`
+	ID               string         `json:"id"`
+	Length           int            `json:"length"`
+	Title            string         `json:"title"`
+	Artists          []ArtistCredit `json:"artist-credit"`
+	Relations        []Relation     `json:"relations"`
+	ISRCs            []string       `json:"isrcs"`
 }
 
 type Work struct {
@@ -484,6 +627,17 @@ func IsCompilation(rg ReleaseGroup) bool {
 	})
 }
 
+// AnyRecordingGenres is like AnyGenres for a recording on its own, using the recording's genres, or its artists'.
+func AnyRecordingGenres(recording *Recording) []Genre {
+	genres := recording.Genres
+	if len(genres) == 0 {
+		for _, a := range recording.Artists {
+			genres = append(genres, a.Artist.Genres...)
+		}
+	}
+	return mergeAndSortGenres(genres)
+}
+
 func AnyGenres(release *Release) (genres []Genre) {
 	defer func() {
 		genres = mergeAndSortGenres(genres)
@@ -29,6 +29,10 @@ type Format struct {
 }
 
 func (pf *Format) Parse(str string) error {
+	return pf.parse(str, validate)
+}
+
+func (pf *Format) parse(str string, validate func(Format) error) error {
 	str = strings.TrimSpace(str)
 	if str == "" {
 		return fmt.Errorf("%w: empty format", ErrInvalidFormat)
@@ -66,9 +70,12 @@ func (pf *Format) Execute(release musicbrainz.Release, media musicbrainz.Media,
 	}
 
 	data := Data{Release: release, Media: media, Track: track, Ext: ext}
+	return pf.execute(withLegacyFields(data))
+}
 
+func (pf *Format) execute(data any) (string, error) {
 	var buff strings.Builder
-	if err := pf.tt.Execute(&buff, withLegacyFields(data)); err != nil {
+	if err := pf.tt.Execute(&buff, data); err != nil {
 		return "", fmt.Errorf("create path: %w", err)
 	}
 	destPath := buff.String()
@@ -90,6 +97,33 @@ type Data struct {
 	Ext     string
 }
 
+// SinglesFormat is a Format for tracks that are imported on their own, rather than as part of a release.
+type SinglesFormat struct {
+	f Format
+}
+
+func (pf *SinglesFormat) Parse(str string) error {
+	return pf.f.parse(str, func(f Format) error {
+		return validateSingles(SinglesFormat{f})
+	})
+}
+
+func (pf *SinglesFormat) Root() string {
+	return pf.f.Root()
+}
+
+func (pf *SinglesFormat) Execute(recording musicbrainz.Recording, ext string) (string, error) {
+	if len(pf.f.tt.Templates()) == 0 {
+		return "", errors.New("not initialised yet")
+	}
+	return pf.f.execute(SinglesData{Recording: recording, Ext: ext})
+}
+
+type SinglesData struct {
+	Recording musicbrainz.Recording
+	Ext       string
+}
+
 func validate(f Format) error {
 	var idc = 1
 	newID := func() string {
@@ -225,6 +259,63 @@ func validate(f Format) error {
 	return nil
 }
 
+func validateSingles(f SinglesFormat) error {
+	var idc = 1
+	newID := func() string {
+		idc++
+		return fmt.Sprintf("00000000-0000-0000-0000-%012d", idc)
+	}
+
+	newRecording := func(artist, title string) musicbrainz.Recording {
+		var recording musicbrainz.Recording
+		recording.ID = newID()
+		recording.Title = title
+		recording.Artists = append(recording.Artists, musicbrainz.ArtistCredit{Name: artist, Artist: musicbrainz.Artist{ID: newID(), Name: artist}})
+		return recording
+	}
+
+	compare := func(r1, r2 musicbrainz.Recording) (bool, error) {
+		path1, err := f.Execute(r1, "")
+		if err != nil {
+			return false, fmt.Errorf("execute data 1: %w", err)
+		}
+		path2, err := f.Execute(r2, "")
+		if err != nil {
+			return false, fmt.Errorf("execute data 2: %w", err)
+		}
+		return path1 == path2, nil
+	}
+
+	if eq, err := compare(newRecording("ar", "track 1"), newRecording("ar", "track 2")); err != nil {
+		return err
+	} else if eq {
+		return fmt.Errorf("%w: two different tracks have the same path", ErrAmbiguousFormat)
+	}
+
+	if eq, err := compare(newRecording("ar 1", "track same"), newRecording("ar 2", "track same")); err != nil {
+		return err
+	} else if eq {
+		return fmt.Errorf("%w: tracks with the same title by different artists have the same path", ErrAmbiguousFormat)
+	}
+
+	{
+		sep := string(filepath.Separator)
+		cleanPath, err := f.Execute(newRecording("ar", "track"), "")
+		if err != nil {
+			return fmt.Errorf("execute clean data: %w", err)
+		}
+		dirtyPath, err := f.Execute(newRecording("a"+sep+"r", "tr"+sep+"ack"), "")
+		if err != nil {
+			return fmt.Errorf("execute dirty data: %w", err)
+		}
+		if strings.Count(cleanPath, sep) != strings.Count(dirtyPath, sep) {
+			return fmt.Errorf("%w: path separator in data leaks into output path (missing safepath?)", ErrInvalidFormat)
+		}
+	}
+
+	return nil
+}
+
 var funcMap = texttemplate.FuncMap{
 	"join":                func(delim string, items []string) string { return strings.Join(items, delim) },
 	"pad0":                func(amount, n int) string { return fmt.Sprintf("%0*d", amount, n) },
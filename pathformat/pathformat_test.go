@@ -100,6 +100,30 @@ func TestPathFormat(t *testing.T) {
 	assert.Equal(t, `/music/albums/House, The/Valvable/1.flac`, path)
 }
 
+func TestSinglesFormat(t *testing.T) {
+	t.Parallel()
+
+	var pf pathformat.SinglesFormat
+	_, err := pf.Execute(musicbrainz.Recording{}, "")
+	require.Error(t, err) // we didn't initialise with Parse() yet
+
+	require.ErrorIs(t, pf.Parse(`/singles/{{ .Recording.Title | safepath }}{{ .Ext }}`), pathformat.ErrAmbiguousFormat)       // no artist
+	require.ErrorIs(t, pf.Parse(`/singles/{{ artistsString .Recording.Artists | safepath }}`), pathformat.ErrAmbiguousFormat) // no title
+	require.ErrorIs(t, pf.Parse(`/singles/{{ artistsString .Recording.Artists }}/{{ .Recording.Title }}`), pathformat.ErrInvalidFormat)
+
+	require.NoError(t, pf.Parse(`/music/singles/{{ .Recording.ID }}{{ .Ext }}`))
+	require.NoError(t, pf.Parse(`/music/singles/{{ artistsString .Recording.Artists | safepath }}/{{ .Recording.Title | safepath }}{{ .Ext }}`))
+	assert.Equal(t, "/music/singles", pf.Root())
+
+	recording := musicbrainz.Recording{
+		Title:   "Sharon's Tone",
+		Artists: []musicbrainz.ArtistCredit{{Name: "credit name", Artist: musicbrainz.Artist{Name: "Luke Vibert"}}},
+	}
+	path, err := pf.Execute(recording, ".flac")
+	require.NoError(t, err)
+	assert.Equal(t, `/music/singles/Luke Vibert/Sharon's Tone.flac`, path)
+}
+
 // the .ReleaseDisambiguation and .IsCompilation fields became the disambiguation and
 // isCompilation funcs, but stay available on the template data so old formats keep working.
 func TestLegacyFields(t *testing.T) {
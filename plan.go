@@ -0,0 +1,252 @@
+package wrtag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.senan.xyz/wrtag/destfs"
+	"go.senan.xyz/wrtag/fileutil"
+	"go.senan.xyz/wrtag/tags"
+)
+
+// ErrStalePlan is returned by Apply when the source dir has changed since the plan was made.
+var ErrStalePlan = errors.New("source changed since planning")
+
+const planVersion = 1
+
+// ImportPlan is everything an import will do, worked out by Plan without changing anything. It can be saved as
+// JSON, edited by hand, and carried out later with Apply. Each file's destination and tags are written as
+// they are in the plan, so a track mapping can be changed by swapping the sources of two files.
+type ImportPlan struct {
+	Version   int          `json:"version"`
+	Operation string       `json:"operation"`
+	SourceDir string       `json:"source_dir"`
+	DestDir   string       `json:"dest_dir"`
+	ReleaseID string       `json:"release_id"`
+	Provider  string       `json:"provider"`
+	URL       string       `json:"url,omitempty"`
+	Score     float64      `json:"score"`
+	Reason    ImportReason `json:"reason"`
+
+	Files  []PlanFile `json:"files"`
+	Cover  *PlanCover `json:"cover,omitempty"`
+	Extras []PlanPath `json:"extras,omitempty"` // local files with no release track, put in the extras dir
+	Keep   []PlanPath `json:"keep,omitempty"`   // files kept with the release, like logs
+
+	// Delete are leftover files in the destination dir that are removed, unless the import puts something
+	// in their place.
+	Delete []string `json:"delete,omitempty"`
+
+	// Source is every file that was in the source dir when planning, to check that nothing changed before
+	// applying.
+	Source []PlanSource `json:"source"`
+
+	// sourceTags are the tags each file had when planning, so that ProcessDir doesn't have to read them again.
+	sourceTags map[string]map[string][]string
+}
+
+// PlanFile is a local file, the release track it was matched to, and the tags it will have.
+type PlanFile struct {
+	Source     string              `json:"source"`
+	Dest       string              `json:"dest"`
+	DiscNumber int                 `json:"disc_number"`
+	Position   int                 `json:"position"`
+	TrackID    string              `json:"track_id,omitempty"`
+	Title      string              `json:"title"`
+	Tags       map[string][]string `json:"tags"`
+}
+
+// PlanPath is a file that's moved or copied without being tagged.
+type PlanPath struct {
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+}
+
+// PlanCover is what happens to the release's cover. A kept cover is moved or copied from Source. A downloaded
+// one is fetched from URL, unless it's the same size as Source, in which case that's kept instead.
+type PlanCover struct {
+	Action CoverAction `json:"action"`
+	Source string      `json:"source,omitempty"`
+	URL    string      `json:"url,omitempty"`
+}
+
+// PlanSource is a file in the source dir when planning.
+type PlanSource struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Apply carries out a plan made by Plan, maybe after it was saved and edited. The op must be the same as the
+// plan's Operation, though it may be a dry run. It fails with ErrStalePlan if the files in the source dir have
+// changed since planning.
+func Apply(ctx context.Context, cfg *Config, op FileSystemOperation, plan *ImportPlan) error {
+	if err := plan.validate(cfg.PathFormat.Root()); err != nil {
+		return fmt.Errorf("validate plan: %w", err)
+	}
+	if name := operationName(op); name != plan.Operation {
+		return fmt.Errorf("plan is for %s, not %s", plan.Operation, name)
+	}
+
+	source, err := sourceFiles(plan.SourceDir)
+	if err != nil {
+		return fmt.Errorf("read source files: %w", err)
+	}
+	if !slices.EqualFunc(source, plan.Source, PlanSource.equal) {
+		return ErrStalePlan
+	}
+
+	plan.sourceTags = map[string]map[string][]string{}
+	for _, f := range plan.Files {
+		t, err := tags.ReadTags(f.Source)
+		if err != nil {
+			return fmt.Errorf("read tags %q: %w", filepath.Base(f.Source), err)
+		}
+		plan.sourceTags[f.Source] = t
+	}
+
+	if _, _, err := apply(ctx, cfg, op, plan); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validate checks that a plan that may have been edited only reads from its source dir, and only writes to its
+// destination dir in the library.
+func (p *ImportPlan) validate(root string) error {
+	if p.Version != planVersion {
+		return fmt.Errorf("unknown version %d", p.Version)
+	}
+	if !filepath.IsAbs(p.SourceDir) || !filepath.IsAbs(p.DestDir) {
+		return errors.New("source and dest dirs must be absolute")
+	}
+	if !fileutil.HasPrefix(p.DestDir, root) || filepath.Clean(p.DestDir) == filepath.Clean(root) {
+		return fmt.Errorf("dest dir %q isn't in the library", p.DestDir)
+	}
+	if len(p.Files) == 0 {
+		return ErrNoTracks
+	}
+
+	dests := map[string]struct{}{}
+	checkPath := func(src, dest string) error {
+		if !fileutil.HasPrefix(src, p.SourceDir) {
+			return fmt.Errorf("%q isn't in the source dir", src)
+		}
+		if !fileutil.HasPrefix(dest, p.DestDir) {
+			return fmt.Errorf("%q isn't in the dest dir", dest)
+		}
+		if _, ok := dests[dest]; ok {
+			return fmt.Errorf("more than one file goes to %q", dest)
+		}
+		dests[dest] = struct{}{}
+		return nil
+	}
+	for _, f := range p.Files {
+		if err := checkPath(f.Source, f.Dest); err != nil {
+			return err
+		}
+	}
+	for _, f := range slices.Concat(p.Extras, p.Keep) {
+		if err := checkPath(f.Source, f.Dest); err != nil {
+			return err
+		}
+	}
+	if p.Cover != nil {
+		switch {
+		case p.Cover.Action != CoverKept && p.Cover.Action != CoverDownloaded:
+			return fmt.Errorf("unknown cover action %q", p.Cover.Action)
+		case p.Cover.Action == CoverKept && p.Cover.Source == "":
+			return errors.New("kept cover has no source")
+		case p.Cover.Action == CoverDownloaded && p.Cover.URL == "":
+			return errors.New("downloaded cover has no url")
+		case p.Cover.Source != "" && !fileutil.HasPrefix(p.Cover.Source, p.SourceDir):
+			return fmt.Errorf("%q isn't in the source dir", p.Cover.Source)
+		}
+	}
+	for _, d := range p.Delete {
+		if !fileutil.HasPrefix(d, p.DestDir) {
+			return fmt.Errorf("%q isn't in the dest dir", d)
+		}
+	}
+	return nil
+}
+
+// sourceFiles returns every file in dir.
+func sourceFiles(dir string) ([]PlanSource, error) {
+	var files []PlanSource
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if IsStagingPath(p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, PlanSource{Path: p, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (s PlanSource) equal(o PlanSource) bool {
+	return s.Path == o.Path && s.Size == o.Size && s.ModTime.Equal(o.ModTime)
+}
+
+// leftoverPaths returns the files already in a plan's destination dir that the import doesn't put there or read from.
+func leftoverPaths(fsys destfs.FS, p *ImportPlan) ([]string, error) {
+	entries, err := fsys.ReadDir(p.DestDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	known := map[string]struct{}{}
+	for _, f := range p.Files {
+		known[f.Source], known[f.Dest] = struct{}{}, struct{}{}
+	}
+	for _, f := range slices.Concat(p.Extras, p.Keep) {
+		known[f.Source], known[f.Dest] = struct{}{}, struct{}{}
+	}
+	if p.Cover != nil {
+		known[p.Cover.Source] = struct{}{}
+		switch p.Cover.Action {
+		case CoverKept:
+			known[coverDest(p.DestDir, p.Cover.Source)] = struct{}{}
+		case CoverDownloaded:
+			known[coverDest(p.DestDir, path.Base(p.Cover.URL))] = struct{}{}
+		}
+	}
+
+	var leftovers []string
+	for _, entry := range entries {
+		path := filepath.Join(p.DestDir, entry.Name())
+		if _, ok := known[path]; ok || entry.IsDir() {
+			continue
+		}
+		leftovers = append(leftovers, path)
+	}
+	return leftovers, nil
+}
+
+// coverDest is where a cover goes in destDir, keeping the extension of p.
+func coverDest(destDir, p string) string {
+	return filepath.Join(destDir, "cover"+strings.ToLower(filepath.Ext(p)))
+}
@@ -0,0 +1,77 @@
+package wrtag
+
+import (
+	"context"
+	"fmt"
+
+	"go.senan.xyz/wrtag/musicbrainz"
+)
+
+// Provider is a source of release metadata. Releases from any provider are mapped into the MusicBrainz
+// release model, so that they're scored, tagged, and formatted in the same way. IDs are the provider's own.
+type Provider interface {
+	Name() string
+	SearchReleases(ctx context.Context, q musicbrainz.ReleaseQuery, limit int) ([]musicbrainz.ReleaseSearchResult, error)
+	GetRelease(ctx context.Context, id string) (*musicbrainz.Release, error)
+	GetCoverURL(ctx context.Context, id string, release *musicbrainz.Release) (string, error)
+	ReleaseURL(id string) string
+}
+
+// DefaultProvider is the provider used when none are configured.
+const DefaultProvider = "musicbrainz"
+
+// MusicBrainzProvider provides releases from MusicBrainz, and their covers from the Cover Art Archive.
+type MusicBrainzProvider struct {
+	MB  *musicbrainz.MBClient
+	CAA *musicbrainz.CAAClient
+}
+
+var _ Provider = (*MusicBrainzProvider)(nil)
+
+func (p *MusicBrainzProvider) Name() string {
+	return "musicbrainz"
+}
+
+func (p *MusicBrainzProvider) SearchReleases(ctx context.Context, q musicbrainz.ReleaseQuery, limit int) ([]musicbrainz.ReleaseSearchResult, error) {
+	return p.MB.SearchReleases(ctx, q, limit)
+}
+
+func (p *MusicBrainzProvider) GetRelease(ctx context.Context, id string) (*musicbrainz.Release, error) {
+	return p.MB.GetRelease(ctx, id)
+}
+
+func (p *MusicBrainzProvider) GetCoverURL(ctx context.Context, _ string, release *musicbrainz.Release) (string, error) {
+	return p.CAA.GetCoverURL(ctx, release)
+}
+
+func (p *MusicBrainzProvider) ReleaseURL(id string) string {
+	return "https://musicbrainz.org/release/" + id
+}
+
+// Provider returns the configured provider with the name.
+func (cfg *Config) Provider(name string) (Provider, error) {
+	switch name {
+	case "musicbrainz":
+		return &MusicBrainzProvider{MB: &cfg.MusicBrainzClient, CAA: &cfg.CoverArtArchiveClient}, nil
+	case "discogs":
+		return &cfg.DiscogsClient, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", name)
+}
+
+// providers returns the providers to search in order, falling back to MusicBrainz if none are configured.
+func (cfg *Config) providers() ([]Provider, error) {
+	names := cfg.Providers
+	if len(names) == 0 {
+		names = []string{DefaultProvider}
+	}
+	var providers []Provider
+	for _, name := range names {
+		p, err := cfg.Provider(name)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
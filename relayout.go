@@ -0,0 +1,423 @@
+package wrtag
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.senan.xyz/wrtag/fileutil"
+	"go.senan.xyz/wrtag/musicbrainz"
+	"go.senan.xyz/wrtag/tags/normtag"
+)
+
+var (
+	ErrCollision   = errors.New("destination already taken")
+	ErrNoReleaseID = errors.New("no musicbrainz release id tagged")
+)
+
+// Relayout sources, for where a release was put together from.
+const (
+	RelayoutFromCache = "cache"
+	RelayoutFromTags  = "tags"
+)
+
+// RelayoutResult is where a release was moved to, or would be for a dry run.
+type RelayoutResult struct {
+	DestDir string
+	Source  string
+	Moves   []DriftMove
+}
+
+// Relayout moves a release that's already in the library to where the path format says it should be, without
+// any network requests. The release is read from a cached MusicBrainz response if there is one, otherwise it's
+// put together from the tags that were written when it was imported. Tags are left as they are.
+//
+// Other files in the release dir keep their place relative to it. A destination that's already taken by
+// something else is reported with ErrCollision, and nothing is moved.
+func Relayout(ctx context.Context, cfg *Config, srcDir string, dryRun bool) (*RelayoutResult, error) {
+	srcDir = filepath.Clean(srcDir)
+
+	_, pathTags, err := ReadReleaseDir(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	release, releaseTracks, source, err := localRelease(ctx, cfg, pathTags)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RelayoutResult{Source: source}
+
+	destDir, err := DestDir(&cfg.PathFormat, release)
+	if err != nil {
+		return nil, fmt.Errorf("gen dest dir: %w", err)
+	}
+	origDestDir := destDir
+	if dir, err := filepath.EvalSymlinks(destDir); err == nil {
+		destDir = dir
+	}
+	res.DestDir = destDir
+
+	var moves []DriftMove
+	for i, pt := range pathTags {
+		rt := releaseTracks[i]
+		destPath, err := cfg.PathFormat.Execute(*release, rt.media, rt.track, strings.ToLower(filepath.Ext(pt.Path)))
+		if err != nil {
+			return nil, fmt.Errorf("create path: %w", err)
+		}
+		if origDestDir != destDir {
+			destPath = filepath.Join(destDir, strings.TrimPrefix(destPath, origDestDir))
+		}
+		destPath = fileutil.TrimLength(destPath, 255)
+		moves = append(moves, DriftMove{From: pt.Path, To: destPath})
+	}
+
+	// everything else in the dir comes along too
+	err = filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if slices.ContainsFunc(pathTags, func(pt PathTags) bool { return pt.Path == path }) {
+			return nil
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		moves = append(moves, DriftMove{From: path, To: filepath.Join(destDir, rel)})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk release dir: %w", err)
+	}
+
+	op := NewMove(dryRun)
+	res.Moves, err = relayoutMoves(ctx, cfg, op, srcDir, destDir, moves)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Moves) == 0 {
+		return res, nil
+	}
+
+	dc := NewDirContext()
+	switch {
+	case srcDir == destDir, fileutil.HasPrefix(destDir, srcDir):
+		// the release is still in there
+	case fileutil.HasPrefix(srcDir, destDir):
+		// the parents of the old dir are where the release is now, so only clean up the dir itself
+		if err := safeRemoveAll(ctx, dc, srcDir, dryRun); err != nil {
+			return nil, fmt.Errorf("clean: %w", err)
+		}
+	default:
+		if err := op.PostSource(ctx, dc, cfg.PathFormat.Root(), srcDir); err != nil {
+			return nil, fmt.Errorf("clean: %w", err)
+		}
+	}
+
+	if !dryRun {
+		if err := updateIndex(ctx, cfg.Index, srcDir, destDir); err != nil {
+			slog.ErrorContext(ctx, "update index", "err", err)
+		}
+	}
+
+	return res, nil
+}
+
+// relayoutMoves checks for collisions and does the moves that aren't no-ops, with the release locked.
+func relayoutMoves(ctx context.Context, cfg *Config, op Move, srcDir, destDir string, moves []DriftMove) ([]DriftMove, error) {
+	unlock := lockPaths(srcDir, destDir)
+	defer unlock()
+
+	if err := checkCollisions(srcDir, destDir, moves); err != nil {
+		return nil, err
+	}
+
+	var drift Drift
+	for _, m := range moves {
+		drift.addMove(m.From, m.To)
+	}
+	if len(drift.Moves) == 0 {
+		return nil, nil
+	}
+
+	dc := NewDirContext()
+	if op.CanModifyDest() {
+		dc.journal, dc.entry = cfg.Journal, cfg.Journal.begin(op, srcDir, destDir, cfg.PathFormat.Root())
+	}
+	for _, m := range drift.Moves {
+		if err := op.ProcessPath(ctx, dc, m.From, m.To, cfg.FileMode); err != nil {
+			return nil, fmt.Errorf("move %q: %w", filepath.Base(m.From), err)
+		}
+		dc.record(m.From, m.To, nil)
+	}
+	if dc.entry != nil {
+		if err := cfg.Journal.append(dc.entry); err != nil {
+			slog.ErrorContext(ctx, "write journal entry", "err", err)
+		}
+	}
+	return drift.Moves, nil
+}
+
+// checkCollisions makes sure that moves won't overwrite anything, including each other. A move to a path that's
+// already taken by another file of the release is a collision too, since they'd need to be swapped.
+func checkCollisions(srcDir, destDir string, moves []DriftMove) error {
+	dests := map[string]string{}
+	for _, m := range moves {
+		if other, ok := dests[m.To]; ok {
+			return fmt.Errorf("%w: %q and %q would both be moved to %q", ErrCollision, other, m.From, m.To)
+		}
+		dests[m.To] = m.From
+	}
+
+	for _, m := range moves {
+		if filepath.Clean(m.From) == filepath.Clean(m.To) {
+			continue
+		}
+		if _, err := os.Lstat(m.To); err == nil {
+			return fmt.Errorf("%w: %q is in the way of %q", ErrCollision, m.To, m.From)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("stat dest: %w", err)
+		}
+	}
+
+	// another release may be where this one would go, even if none of the file names clash
+	if srcDir == destDir || fileutil.HasPrefix(srcDir, destDir) {
+		return nil
+	}
+	entries, err := os.ReadDir(destDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read dest dir: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			return fmt.Errorf("%w: %q already has files in it", ErrCollision, destDir)
+		}
+	}
+	return nil
+}
+
+// localRelease gets a release that's already in the library from the cache if it's there, or otherwise from the
+// tags of its files, without any network requests. It returns which of RelayoutFromCache or RelayoutFromTags
+// it came from.
+func localRelease(ctx context.Context, cfg *Config, pathTags []PathTags) (*musicbrainz.Release, []releaseTrack, string, error) {
+	mbid := normtag.Get(pathTags[0].Tags, normtag.MusicBrainzReleaseID)
+	for _, pt := range pathTags {
+		if id := normtag.Get(pt.Tags, normtag.MusicBrainzReleaseID); id == "" || id != mbid {
+			return nil, nil, "", fmt.Errorf("%w: %q", ErrNoReleaseID, filepath.Base(pt.Path))
+		}
+	}
+
+	if release, tracks := cachedRelease(ctx, cfg, mbid, pathTags); release != nil {
+		return release, tracks, RelayoutFromCache, nil
+	}
+	release, tracks := releaseFromTags(pathTags)
+	return release, tracks, RelayoutFromTags, nil
+}
+
+// cachedRelease gets the release from the MusicBrainz response cache, without making any requests. It returns nil
+// if there's no cache, the release isn't in it, or the files can't all be found in the release by their track IDs.
+func cachedRelease(ctx context.Context, cfg *Config, mbid string, pathTags []PathTags) (*musicbrainz.Release, []releaseTrack) {
+	mb := cfg.MusicBrainzClient
+	if mb.Cache == nil || mb.Cache.Dir == "" {
+		return nil, nil
+	}
+	cache := *mb.Cache
+	cache.Offline = true
+	mb.Cache = &cache
+
+	release, err := mb.GetRelease(ctx, mbid)
+	if err != nil {
+		slog.DebugContext(ctx, "release not cached", "mbid", mbid, "err", err)
+		return nil, nil
+	}
+
+	byID := map[string]releaseTrack{}
+	for _, rt := range releaseTracks(release.Media) {
+		byID[rt.track.ID] = rt
+	}
+	tracks := make([]releaseTrack, 0, len(pathTags))
+	for _, pt := range pathTags {
+		rt, ok := byID[normtag.Get(pt.Tags, normtag.MusicBrainzTrackID)]
+		if !ok {
+			slog.DebugContext(ctx, "cached release doesn't have track", "mbid", mbid, "path", pt.Path)
+			return nil, nil
+		}
+		tracks = append(tracks, rt)
+	}
+	return release, tracks
+}
+
+// releaseFromTags puts together as much of a release as it can from the tags written by WriteRelease, with a
+// track for each file. Data that isn't in the tags, like artist sort names and aliases, is left empty.
+func releaseFromTags(pathTags []PathTags) (*musicbrainz.Release, []releaseTrack) {
+	first := pathTags[0].Tags
+
+	artists := creditsFromTags(first, normtag.AlbumArtist, normtag.AlbumArtists, normtag.AlbumArtistsCredit, normtag.MusicBrainzAlbumArtistID)
+
+	var release musicbrainz.Release
+	release.ID = normtag.Get(first, normtag.MusicBrainzReleaseID)
+	release.Title = normtag.Get(first, normtag.Album)
+	release.Artists = artists
+	release.Date = musicbrainz.AnyTime{Time: parseAnyTime(normtag.Get(first, normtag.Date))}
+	release.Barcode = normtag.Get(first, normtag.Barcode)
+	release.Disambiguation = normtag.Get(first, normtag.MusicBrainzAlbumComment)
+	if label, catNum := normtag.Get(first, normtag.Label), normtag.Get(first, normtag.CatalogueNum); label != "" || catNum != "" {
+		release.LabelInfo = []musicbrainz.LabelInfo{{Label: musicbrainz.Label{Name: label}, CatalogNumber: catNum}}
+	}
+
+	release.ReleaseGroup.ID = normtag.Get(first, normtag.MusicBrainzReleaseGroupID)
+	release.ReleaseGroup.Title = release.Title
+	release.ReleaseGroup.Artists = artists
+	release.ReleaseGroup.FirstReleaseDate = musicbrainz.AnyTime{Time: parseAnyTime(normtag.Get(first, normtag.OriginalDate))}
+	for _, t := range normtag.Values(first, normtag.ReleaseType) {
+		if pt, ok := primaryTypes[strings.ToLower(t)]; ok && release.ReleaseGroup.PrimaryType == "" {
+			release.ReleaseGroup.PrimaryType = pt
+			continue
+		}
+		if st, ok := secondaryTypes[strings.ToLower(t)]; ok {
+			release.ReleaseGroup.SecondaryTypes = append(release.ReleaseGroup.SecondaryTypes, st)
+		}
+	}
+
+	// group the files by disc, keeping them in the order they were read
+	mediaIndex := map[int]int{}
+	trackMedia := make([]int, 0, len(pathTags))
+	for _, pt := range pathTags {
+		pos := leadingInt(normtag.Get(pt.Tags, normtag.DiscNumber))
+		i, ok := mediaIndex[pos]
+		if !ok {
+			i = len(release.Media)
+			mediaIndex[pos] = i
+			release.Media = append(release.Media, musicbrainz.Media{
+				Position:   pos,
+				Title:      normtag.Get(pt.Tags, normtag.DiscSubtitle),
+				Format:     normtag.Get(pt.Tags, normtag.MediaFormat),
+				TrackCount: leadingInt(normtag.Get(pt.Tags, normtag.TrackTotal)),
+			})
+		}
+
+		number := normtag.Get(pt.Tags, normtag.TrackNumber)
+		title := normtag.Get(pt.Tags, normtag.Title)
+		trackArtists := creditsFromTags(pt.Tags, normtag.Artist, normtag.Artists, normtag.ArtistsCredit, normtag.MusicBrainzArtistID)
+
+		release.Media[i].Tracks = append(release.Media[i].Tracks, musicbrainz.Track{
+			ID:       normtag.Get(pt.Tags, normtag.MusicBrainzTrackID),
+			Number:   number,
+			Position: leadingInt(number),
+			Title:    title,
+			Artists:  trackArtists,
+			Length:   int(pt.Length.Milliseconds()),
+			Recording: musicbrainz.Recording{
+				ID:      normtag.Get(pt.Tags, normtag.MusicBrainzRecordingID),
+				Title:   title,
+				Artists: trackArtists,
+				Length:  int(pt.Length.Milliseconds()),
+			},
+		})
+		trackMedia = append(trackMedia, i)
+	}
+	for i := range release.Media {
+		release.Media[i].TrackCount = cmp.Or(release.Media[i].TrackCount, len(release.Media[i].Tracks))
+	}
+
+	tracks := make([]releaseTrack, 0, len(pathTags))
+	seen := make([]int, len(release.Media))
+	for _, i := range trackMedia {
+		media := release.Media[i]
+		tracks = append(tracks, releaseTrack{track: media.Tracks[seen[i]], media: media})
+		seen[i]++
+	}
+	return &release, tracks
+}
+
+// creditsFromTags reads artist credits back from the tags written for them. The join phrases are recovered by
+// finding each artist name in the joined string.
+func creditsFromTags(t map[string][]string, joinedKey, namesKey, creditNamesKey, idsKey string) []musicbrainz.ArtistCredit {
+	joined := normtag.Get(t, joinedKey)
+	names := normtag.Values(t, namesKey)
+	creditNames := normtag.Values(t, creditNamesKey)
+	ids := normtag.Values(t, idsKey)
+
+	if len(names) == 0 {
+		if joined == "" {
+			return nil
+		}
+		return []musicbrainz.ArtistCredit{{Name: joined, Artist: musicbrainz.Artist{Name: joined, ID: get(ids, 0)}}}
+	}
+
+	credits := make([]musicbrainz.ArtistCredit, 0, len(names))
+	var rest = joined
+	for i, name := range names {
+		credit := musicbrainz.ArtistCredit{
+			Name:   cmp.Or(get(creditNames, i), name),
+			Artist: musicbrainz.Artist{Name: name, ID: get(ids, i)},
+		}
+		if after, ok := strings.CutPrefix(rest, name); ok {
+			rest = after
+			if i+1 < len(names) {
+				if j := strings.Index(rest, names[i+1]); j >= 0 {
+					credit.JoinPhrase, rest = rest[:j], rest[j:]
+				}
+			} else {
+				credit.JoinPhrase, rest = rest, ""
+			}
+		}
+		credits = append(credits, credit)
+	}
+	if musicbrainz.ArtistsString(credits) != joined {
+		// the tags were changed by something else, so guess
+		for i := range credits[:len(credits)-1] {
+			credits[i].JoinPhrase = ", "
+		}
+		credits[len(credits)-1].JoinPhrase = ""
+	}
+	return credits
+}
+
+var primaryTypes = map[string]musicbrainz.ReleaseGroupPrimaryType{}
+var secondaryTypes = map[string]musicbrainz.ReleaseGroupSecondaryType{}
+
+func init() {
+	for _, t := range []musicbrainz.ReleaseGroupPrimaryType{musicbrainz.Album, musicbrainz.Single, musicbrainz.EP, musicbrainz.Broadcast, musicbrainz.Other} {
+		primaryTypes[strings.ToLower(string(t))] = t
+	}
+	for _, t := range []musicbrainz.ReleaseGroupSecondaryType{
+		musicbrainz.AudioDrama, musicbrainz.Audiobook, musicbrainz.Compilation, musicbrainz.Demo, musicbrainz.DJMix, musicbrainz.FieldRecording,
+		musicbrainz.Interview, musicbrainz.Live, musicbrainz.MixtapeStreet, musicbrainz.Remix, musicbrainz.Soundtrack, musicbrainz.Spokenword,
+	} {
+		secondaryTypes[strings.ToLower(string(t))] = t
+	}
+}
+
+// leadingInt parses the number at the start of a string like "3", "3/10", or "03", or returns 0.
+func leadingInt(s string) int {
+	s = strings.TrimSpace(s)
+	end := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) })
+	if end >= 0 {
+		s = s[:end]
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func get[T any](elms []T, i int) T {
+	var zero T
+	if i < len(elms) {
+		return elms[i]
+	}
+	return zero
+}
@@ -0,0 +1,70 @@
+package wrtag
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/wrtag/musicbrainz"
+)
+
+func TestReleaseFromTags(t *testing.T) {
+	t.Parallel()
+
+	credit := func(name, join, id string) musicbrainz.ArtistCredit {
+		return musicbrainz.ArtistCredit{Name: name, JoinPhrase: join, Artist: musicbrainz.Artist{ID: id, Name: name}}
+	}
+
+	var release musicbrainz.Release
+	release.ID = "release-id"
+	release.Title = "Sleep"
+	release.Artists = []musicbrainz.ArtistCredit{credit("Max Richter", " & ", "a1"), credit("Grace Davidson", "", "a2")}
+	release.ReleaseGroup.ID = "group-id"
+	release.ReleaseGroup.PrimaryType = musicbrainz.Album
+	release.ReleaseGroup.SecondaryTypes = []musicbrainz.ReleaseGroupSecondaryType{musicbrainz.Live}
+	release.Media = []musicbrainz.Media{
+		{Position: 1, TrackCount: 2, Format: "CD", Tracks: []musicbrainz.Track{
+			{ID: "t1", Position: 1, Title: "Dream 0"},
+			{ID: "t2", Position: 2, Title: "Path 1"},
+		}},
+		{Position: 2, TrackCount: 1, Format: "CD", Title: "Bonus", Tracks: []musicbrainz.Track{
+			{ID: "t3", Position: 1, Title: "Dream 1", Artists: []musicbrainz.ArtistCredit{credit("Max Richter", "", "a1")}},
+		}},
+	}
+
+	var pathTags []PathTags
+	for _, rt := range releaseTracks(release.Media) {
+		tags := map[string][]string{}
+		WriteRelease(tags, &release, musicbrainz.LabelInfo{}, nil, &rt.media, &rt.track)
+		pathTags = append(pathTags, PathTags{Path: rt.track.ID + ".flac", Tags: tags})
+	}
+
+	got, tracks := releaseFromTags(pathTags)
+	require.Len(t, tracks, 3)
+
+	assert.Equal(t, release.ID, got.ID)
+	assert.Equal(t, release.Title, got.Title)
+	assert.Equal(t, "Max Richter & Grace Davidson", musicbrainz.ArtistsString(got.Artists))
+	assert.Equal(t, []string{"a1", "a2"}, []string{got.Artists[0].Artist.ID, got.Artists[1].Artist.ID})
+	assert.Equal(t, musicbrainz.Album, got.ReleaseGroup.PrimaryType)
+	assert.Equal(t, []musicbrainz.ReleaseGroupSecondaryType{musicbrainz.Live}, got.ReleaseGroup.SecondaryTypes)
+
+	require.Len(t, got.Media, 2)
+	assert.Equal(t, 2, got.Media[1].Position)
+	assert.Equal(t, "Bonus", got.Media[1].Title)
+	assert.Equal(t, "Dream 1", tracks[2].track.Title)
+	assert.Equal(t, 1, tracks[2].track.Position)
+	assert.Equal(t, 2, tracks[2].media.Position)
+	assert.Equal(t, "Max Richter", musicbrainz.ArtistsString(tracks[2].track.Artists))
+}
+
+func TestLeadingInt(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, 3, leadingInt("3"))
+	assert.Equal(t, 3, leadingInt("03"))
+	assert.Equal(t, 3, leadingInt("3/10"))
+	assert.Equal(t, 0, leadingInt("A1"))
+	assert.Equal(t, 0, leadingInt(""))
+}
@@ -0,0 +1,312 @@
+package wrtag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.senan.xyz/wrtag/destfs"
+	"go.senan.xyz/wrtag/fileutil"
+	"go.senan.xyz/wrtag/musicbrainz"
+	"go.senan.xyz/wrtag/tags"
+	"go.senan.xyz/wrtag/tags/normtag"
+)
+
+var (
+	ErrNotTrack       = errors.New("not a readable track")
+	ErrSinglesIndexed = errors.New("singles can't be added to the library index")
+)
+
+// SingleResult contains the results of a MusicBrainz recording lookup and potential import operation, for
+// a track that isn't part of a release.
+type SingleResult struct {
+	Recording *musicbrainz.Recording
+	Query     musicbrainz.RecordingQuery
+	Score     float64
+	DestPath  string
+	Diff      []Diff
+
+	// Reason is why the recording was or wasn't imported.
+	Reason ImportReason
+}
+
+// ProcessSingle processes a single music file by looking up its recording on MusicBrainz and either
+// moving, copying, or reflinking it to a new location under the singles path format with recording tags.
+// It's for loose tracks that don't belong to any release, so nothing else in the source or destination
+// directory is touched.
+//
+// The track is staged and journalled like a release. It can't be added to the library index, since its
+// directory isn't a release, so ErrSinglesIndexed is returned if the index is enabled.
+//
+// The path must be an absolute path.
+// The cond parameter determines the conditions under which the import will proceed.
+// The useMBID parameter can be used to force a specific MusicBrainz recording ID.
+func ProcessSingle(
+	ctx context.Context, cfg *Config,
+	op FileSystemOperation, path string, cond ImportCondition, useMBID string,
+) (*SingleResult, error) {
+	if cfg.SinglesPathFormat.Root() == "" {
+		return nil, errors.New("no singles path format provided")
+	}
+	if err := checkDestFS(cfg, op); err != nil {
+		return nil, err
+	}
+	if cfg.Index.Enabled() {
+		return nil, ErrSinglesIndexed
+	}
+
+	if !filepath.IsAbs(path) {
+		panic("path not abs") // this is a programmer error for now
+	}
+
+	if !tags.CanRead(path) {
+		return nil, ErrNotTrack
+	}
+	pt, err := readPathTags(path)
+	if err != nil {
+		return nil, fmt.Errorf("read track: %w", err)
+	}
+
+	var mbid = normtag.Get(pt.Tags, normtag.MusicBrainzRecordingID)
+	if useMBID != "" {
+		mbid = useMBID
+	}
+
+	title, artist := singleTitleArtist(pt)
+
+	query := musicbrainz.RecordingQuery{
+		MBRecordingID: mbid,
+		MBArtistID:    normtag.Get(pt.Tags, normtag.MusicBrainzArtistID),
+		Recording:     title,
+		Artist:        artist,
+		ISRC:          normtag.Get(pt.Tags, normtag.ISRC),
+	}
+
+	recordingIDs, err := searchRecordings(ctx, cfg, query, pt)
+	if err != nil {
+		return nil, fmt.Errorf("search musicbrainz: %w", err)
+	}
+
+	var recording *musicbrainz.Recording
+	var score float64
+	var diff []Diff
+	var getErr error
+	for _, id := range recordingIDs {
+		rec, err := cfg.MusicBrainzClient.GetRecording(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			getErr = fmt.Errorf("get recording by mbid %s: %w", id, err)
+			slog.WarnContext(ctx, "skipping candidate", "id", id, "err", err)
+			continue
+		}
+		recScore, recDiff := DiffRecording(cfg.DiffWeights, cfg.LengthTolerance, rec, pt)
+		if recording == nil || recScore > score {
+			recording, score, diff = rec, recScore, recDiff
+		}
+	}
+	if recording == nil && getErr != nil {
+		return nil, getErr
+	}
+
+	res := &SingleResult{
+		Recording: recording,
+		Query:     query,
+		Score:     score,
+		Diff:      diff,
+	}
+
+	res.Reason, err = decideImport(cfg.ImportRules, cfg.minScore(), cond, ruleMatch{
+		score: score,
+		diff:  diff,
+		mbid:  mbid != "",
+	})
+	if err != nil {
+		return res, err
+	}
+
+	destPath, err := cfg.SinglesPathFormat.Execute(*recording, strings.ToLower(filepath.Ext(path)))
+	if err != nil {
+		return nil, fmt.Errorf("create path: %w", err)
+	}
+	if destfs.IsLocal(cfg.DestFS) {
+		if dir, err := filepath.EvalSymlinks(filepath.Dir(destPath)); err == nil {
+			destPath = filepath.Join(dir, filepath.Base(destPath))
+		}
+	}
+	destPath = fileutil.TrimLength(destPath, 255)
+
+	srcDir, destDir := filepath.Dir(path), filepath.Dir(destPath)
+
+	unlock := lockPaths(
+		srcDir,
+		destDir,
+	)
+	defer unlock()
+
+	// put together in a stage and journalled like a release, so that it's never left half imported, or uploaded
+	// before it's ready, and it can be undone
+	var st *stage
+	if op.CanModifyDest() {
+		st, err = newStage(cfg, cfg.SinglesPathFormat.Root(), op, srcDir, destDir, []string{destPath})
+		if err != nil {
+			return nil, fmt.Errorf("stage: %w", err)
+		}
+		st.manifest.Single = true // written along with the file when it's placed
+		defer func() {
+			if err := st.close(ctx); err != nil {
+				slog.ErrorContext(ctx, "close stage", "err", err)
+			}
+		}()
+	}
+
+	dc := NewDirContext().on(cfg.destFS())
+	if op.CanModifyDest() {
+		dc.journal, dc.entry = cfg.Journal, cfg.Journal.begin(op, srcDir, destDir, cfg.SinglesPathFormat.Root())
+	}
+	if dc.entry != nil {
+		defer func() {
+			if !st.committed() {
+				return
+			}
+			if err := cfg.Journal.append(dc.entry); err != nil {
+				slog.ErrorContext(ctx, "write journal entry", "err", err)
+			}
+		}()
+	}
+
+	stagedPath, err := st.place(dc, path, destPath, pt.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("place path %q: %w", filepath.Base(path), err)
+	}
+	if err := op.ProcessPath(ctx, st.dirContext(dc), path, stagedPath, cfg.FileMode); err != nil {
+		return nil, fmt.Errorf("process path %q: %w", filepath.Base(path), err)
+	}
+	dc.record(path, destPath, pt.Tags)
+
+	var destTags = map[string][]string{}
+	WriteRecording(destTags, recording, musicbrainz.AnyRecordingGenres(recording))
+	ApplyTagConfig(destTags, pt.Tags, cfg.TagConfig)
+
+	if lvl, slog := slog.LevelDebug, slog.Default(); slog.Enabled(ctx, lvl) {
+		logTagChanges(ctx, path, lvl, pt.Tags, destTags)
+	}
+
+	if op.CanModifyDest() {
+		if !tags.Equal(pt.Tags, destTags) || len(cfg.Addons) > 0 {
+			if err := breakLink(ctx, stagedPath, cfg.FileMode); err != nil {
+				return nil, fmt.Errorf("break link: %w", err)
+			}
+		}
+		if !tags.Equal(pt.Tags, destTags) {
+			if err := tags.WriteTags(stagedPath, destTags, tags.Clear); err != nil {
+				return nil, fmt.Errorf("write tag file: %w", err)
+			}
+		}
+		for _, addon := range cfg.Addons {
+			if err := addon.ProcessRelease(ctx, "", []string{stagedPath}); err != nil {
+				return nil, fmt.Errorf("process addon: %w", err)
+			}
+		}
+		if err := st.commit(ctx, dc); err != nil {
+			return nil, fmt.Errorf("commit: %w", err)
+		}
+	}
+
+	res.DestPath = destPath
+	return res, nil
+}
+
+// searchRecordings finds the IDs of recordings that might be the local file. If the query has an MBID, only
+// that recording is considered. If it has nothing useful to search with, the recordings that the file's
+// fingerprint identifies are used instead.
+func searchRecordings(ctx context.Context, cfg *Config, query musicbrainz.RecordingQuery, pt PathTags) ([]string, error) {
+	if query.MBRecordingID != "" {
+		return []string{query.MBRecordingID}, nil
+	}
+
+	numCandidates := max(cfg.NumCandidates, 1)
+
+	if cfg.AcoustIDClient.APIKey != "" && normtag.Get(pt.Tags, normtag.Title) == "" {
+		ids, err := identifyPaths(ctx, &cfg.AcoustIDClient, []PathTags{pt})
+		if err != nil {
+			return nil, fmt.Errorf("identify: %w", err)
+		}
+		var recordingIDs []string
+		for _, r := range ids[0].results {
+			for _, rec := range r.Recordings {
+				if !slices.Contains(recordingIDs, rec.ID) {
+					recordingIDs = append(recordingIDs, rec.ID)
+				}
+			}
+		}
+		if len(recordingIDs) > 0 {
+			return recordingIDs[:min(len(recordingIDs), numCandidates)], nil
+		}
+	}
+
+	results, err := cfg.MusicBrainzClient.SearchRecordings(ctx, query, numCandidates)
+	if err != nil {
+		return nil, err
+	}
+	return mapFunc(results, func(_ int, r musicbrainz.RecordingSearchResult) string { return r.ID }), nil
+}
+
+// DiffRecording compares a local file's tags and length with a MusicBrainz recording, like DiffRelease does
+// for a whole release.
+func DiffRecording(weights DiffWeights, lengthTolerance time.Duration, recording *musicbrainz.Recording, file PathTags) (float64, []Diff) {
+	weight := func(field string) float64 {
+		if w, ok := weights[field]; ok {
+			return w
+		}
+		return 1
+	}
+
+	var score float64
+	s := scorer{score: &score}
+
+	localTitle, localArtist := singleTitleArtist(file)
+
+	title := s.diff(weight("title"), "title", localTitle, recording.Title)
+	s.diffLength(weight("track length"), lengthTolerance, &title, file.Length, time.Duration(recording.Length)*time.Millisecond)
+	artist := s.diff(weight("artist"), "artist", localArtist, musicbrainz.ArtistsString(recording.Artists))
+
+	diffs := []Diff{title, artist}
+	s.penalize(diffs)
+
+	return score, diffs
+}
+
+// singleTitleArtist gets the title and artist of a loose track from its tags. Loose downloads are often
+// untagged but named like "Artist - Title.mp3", so the file name is used for anything missing.
+func singleTitleArtist(pt PathTags) (title, artist string) {
+	title = normtag.Get(pt.Tags, normtag.Title)
+	artist = normtag.Get(pt.Tags, normtag.Artist)
+	if title != "" {
+		return title, artist
+	}
+
+	name := strings.TrimSuffix(filepath.Base(pt.Path), filepath.Ext(pt.Path))
+	if a, t, ok := strings.Cut(name, " - "); ok && artist == "" {
+		return strings.TrimSpace(t), strings.TrimSpace(a)
+	}
+	return name, artist
+}
+
+func readPathTags(path string) (PathTags, error) {
+	t, err := tags.ReadTags(path)
+	if err != nil {
+		return PathTags{}, fmt.Errorf("read tags: %w", err)
+	}
+	props, err := tags.ReadProperties(path)
+	if err != nil {
+		return PathTags{}, fmt.Errorf("read track properties: %w", err)
+	}
+	return PathTags{Path: path, Tags: t, Length: props.Length}, nil
+}
@@ -0,0 +1,415 @@
+package wrtag
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.senan.xyz/wrtag/destfs"
+	"go.senan.xyz/wrtag/fileutil"
+	"go.senan.xyz/wrtag/tags"
+)
+
+// StagingDirName is the directory in the library root with a manifest for each import in progress.
+const StagingDirName = ".wrtag-staging"
+
+// stageDirPrefix is the prefix of the temporary sibling of a destination directory that an import is put
+// together in.
+const stageDirPrefix = ".wrtag-stage-"
+
+// IsStagingPath returns whether path is, or is in, a directory used for staging imports. They should be
+// skipped when walking the library.
+func IsStagingPath(path string) bool {
+	for elem := range strings.SplitSeq(filepath.ToSlash(path), "/") {
+		if elem == StagingDirName || strings.HasPrefix(elem, stageDirPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// stage is an import that's being put together in a temporary sibling of its destination. Files are moved or
+// copied into the stage, tagged, and given to addons there. Only then are they committed, by renaming them into place.
+// The manifest is written before each file is staged, so if the import is interrupted, RecoverStaged can
+// either put the files back where they came from, or finish the commit.
+//
+// The stage is always on the local filesystem. For a remote destination, it's in the staging dir from the
+// config, and files are uploaded to the destination when they're committed.
+//
+// A nil *stage is valid, and places files directly at their destination.
+type stage struct {
+	fs           destfs.FS
+	manifestPath string
+	lockFile     *os.File
+	manifest     stageManifest
+}
+
+type stageManifest struct {
+	ID        string      `json:"id"`
+	Operation string      `json:"operation"`
+	SourceDir string      `json:"source_dir"`
+	Base      string      `json:"base"`
+	Dir       string      `json:"dir"`
+	Committed bool        `json:"committed"`
+	Files     []stageFile `json:"files"`
+
+	// Single is set for a single, which leaves the rest of its source dir alone, so it isn't cleaned up after a
+	// move.
+	Single bool `json:"single,omitempty"`
+}
+
+// stageFile is a file in the stage. Tracks have the tags they had before the import, so that they can be
+// written again when a move is rolled back. Files with no source, like downloaded covers, are only deleted.
+type stageFile struct {
+	Source string              `json:"source,omitempty"`
+	Staged string              `json:"staged"`
+	Dest   string              `json:"dest"`
+	Tags   map[string][]string `json:"tags,omitempty"`
+}
+
+// newStage starts staging an import of srcDir into destDir, under the library root. The stage mirrors the common
+// parent directory of destDir and destPaths, so that it can be renamed into place in one go if that doesn't exist
+// yet. Its manifest is kept in the staging dir, where RecoverStaged can find it.
+func newStage(cfg *Config, root string, op FileSystemOperation, srcDir, destDir string, destPaths []string) (*stage, error) {
+	base := destDir
+	for _, p := range destPaths {
+		for !fileutil.HasPrefix(p, base) && filepath.Dir(base) != base {
+			base = filepath.Dir(base)
+		}
+	}
+
+	fsys := cfg.destFS()
+	stagingDir := stagingDir(cfg, root)
+	if stagingDir == "" {
+		return nil, errors.New("no staging dir for imports to a remote library")
+	}
+
+	// a sibling is on the same filesystem, unless the base is the root itself. a remote import is put together
+	// in the staging dir
+	parent := filepath.Dir(base)
+	if fileutil.HasPrefix(root, base) {
+		parent = base
+	}
+	if !destfs.IsLocal(fsys) {
+		parent = stagingDir
+	}
+
+	id := newJournalID()
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("create staging dir: %w", err)
+	}
+
+	st := &stage{
+		fs:           fsys,
+		manifestPath: filepath.Join(stagingDir, id+".json"),
+		manifest: stageManifest{
+			ID:        id,
+			Operation: operationName(op),
+			SourceDir: srcDir,
+			Base:      base,
+			Dir:       filepath.Join(parent, stageDirPrefix+id),
+		},
+	}
+
+	f, err := os.OpenFile(lockPath(st.manifestPath), os.O_CREATE|os.O_RDWR, 0o644) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("create lock file: %w", err)
+	}
+	if ok, err := tryLockFile(f); err != nil || !ok {
+		f.Close()
+		return nil, errors.Join(errors.New("lock stage"), err)
+	}
+	st.lockFile = f
+
+	if err := st.writeManifest(); err != nil {
+		st.close(context.Background())
+		return nil, err
+	}
+	return st, nil
+}
+
+// place returns the path that src should be put at so that it ends up at dest. When staging, that's in the
+// stage, and the file is added to the manifest first. Otherwise it's dest itself, and any file that it would
+// replace is kept by the journal.
+func (st *stage) place(dc DirContext, src, dest string, t map[string][]string) (string, error) {
+	if st == nil {
+		if err := dc.replace(src, dest); err != nil {
+			return "", err
+		}
+		return dest, nil
+	}
+
+	rel, err := filepath.Rel(st.manifest.Base, dest)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%q is outside of %q", dest, st.manifest.Base)
+	}
+	staged := filepath.Join(st.manifest.Dir, rel)
+
+	st.manifest.Files = append(st.manifest.Files, stageFile{Source: src, Staged: staged, Dest: dest, Tags: t})
+	if err := st.writeManifest(); err != nil {
+		return "", err
+	}
+	return staged, nil
+}
+
+// dirContext returns the DirContext to put files at the paths from place with. The stage is always on the
+// local filesystem, so it's dc on that when staging, and dc itself otherwise.
+func (st *stage) dirContext(dc DirContext) DirContext {
+	if st == nil {
+		return dc
+	}
+	return dc.on(destfs.Local{})
+}
+
+// path returns where the file for dest is while it's staged.
+func (st *stage) path(dest string) string {
+	if st == nil {
+		return dest
+	}
+	for _, f := range st.manifest.Files {
+		if f.Dest == dest {
+			return f.Staged
+		}
+	}
+	return dest
+}
+
+// commit moves the staged files into place. If the base directory doesn't exist yet on the local filesystem,
+// the whole stage is renamed to it at once, otherwise each file is renamed or uploaded into place.
+func (st *stage) commit(ctx context.Context, dc DirContext) error {
+	if st == nil {
+		return nil
+	}
+
+	st.manifest.Committed = true
+	if err := st.writeManifest(); err != nil {
+		return err
+	}
+
+	for _, f := range st.manifest.Files {
+		dc.knownDestPaths[f.Dest] = struct{}{}
+	}
+
+	if _, err := os.Stat(st.manifest.Base); errors.Is(err, os.ErrNotExist) && destfs.IsLocal(st.fs) {
+		if err := os.MkdirAll(filepath.Dir(st.manifest.Base), os.ModePerm); err != nil {
+			return fmt.Errorf("create base parent: %w", err)
+		}
+		if err := os.Rename(st.manifest.Dir, st.manifest.Base); err == nil {
+			slog.DebugContext(ctx, "committed staged dir", "dir", st.manifest.Base)
+			return nil
+		}
+		// probably a different filesystem, so fall back to moving each file
+	}
+
+	for _, f := range st.manifest.Files {
+		if err := dc.replace(f.Source, f.Dest); err != nil {
+			return fmt.Errorf("replace %q: %w", f.Dest, err)
+		}
+	}
+	if err := st.manifest.moveIntoPlace(st.fs); err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "committed staged files", "dir", st.manifest.Base, "files", len(st.manifest.Files))
+	return nil
+}
+
+// committed returns whether the files were put in place, rather than left to be rolled back.
+func (st *stage) committed() bool {
+	return st == nil || st.manifest.Committed
+}
+
+// close rolls back the import if it wasn't committed, or finishes the commit if it failed part way, then
+// removes the stage. If that fails too, the stage is left for RecoverStaged.
+func (st *stage) close(ctx context.Context) error {
+	if st == nil {
+		return nil
+	}
+	defer st.lockFile.Close()
+
+	if st.manifest.Committed {
+		if err := st.manifest.moveIntoPlace(st.fs); err != nil {
+			return fmt.Errorf("finish commit, leaving stage %q: %w", st.manifest.Dir, err)
+		}
+	} else {
+		if err := st.manifest.rollback(ctx); err != nil {
+			return fmt.Errorf("roll back, leaving stage %q: %w", st.manifest.Dir, err)
+		}
+	}
+
+	if err := os.RemoveAll(st.manifest.Dir); err != nil {
+		return fmt.Errorf("remove stage: %w", err)
+	}
+	if err := os.Remove(st.manifestPath); err != nil {
+		return fmt.Errorf("remove manifest: %w", err)
+	}
+	_ = os.Remove(lockPath(st.manifestPath))
+	_ = os.Remove(filepath.Dir(st.manifestPath)) // only if empty
+	return nil
+}
+
+func (st *stage) writeManifest() error {
+	data, err := json.Marshal(st.manifest)
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	tmp := st.manifestPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil { //nolint:gosec
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, st.manifestPath); err != nil {
+		return fmt.Errorf("rename manifest: %w", err)
+	}
+	return nil
+}
+
+// moveIntoPlace moves each staged file that's still in the stage to its destination in fsys.
+func (m *stageManifest) moveIntoPlace(fsys destfs.FS) error {
+	for _, f := range m.Files {
+		if _, err := os.Stat(f.Staged); errors.Is(err, os.ErrNotExist) {
+			continue // already in place
+		}
+		if err := fsys.MkdirAll(filepath.Dir(f.Dest)); err != nil {
+			return fmt.Errorf("create dest dir: %w", err)
+		}
+		if err := destfs.Move(fsys, f.Staged, f.Dest); err != nil {
+			return fmt.Errorf("move %q into place: %w", f.Dest, err)
+		}
+	}
+	return nil
+}
+
+// rollback puts moved files back where they came from, with their original tags. Copied files are left in
+// the stage to be removed with it.
+func (m *stageManifest) rollback(ctx context.Context) error {
+	if m.Operation != "move" {
+		return nil
+	}
+	for _, f := range m.Files {
+		if f.Source == "" {
+			continue
+		}
+		if _, err := os.Stat(f.Staged); errors.Is(err, os.ErrNotExist) {
+			continue // never staged, or already put back
+		}
+		if err := os.MkdirAll(filepath.Dir(f.Source), os.ModePerm); err != nil {
+			return fmt.Errorf("create source dir: %w", err)
+		}
+		if err := moveFile(f.Staged, f.Source); err != nil {
+			return fmt.Errorf("move %q back: %w", f.Source, err)
+		}
+		if f.Tags != nil {
+			if err := tags.WriteTags(f.Source, f.Tags, tags.Clear); err != nil {
+				return fmt.Errorf("write original tags: %w", err)
+			}
+		}
+	}
+	slog.InfoContext(ctx, "rolled back staged import", "source", m.SourceDir)
+	return nil
+}
+
+// RecoverStaged finds imports into the library and the singles root that were interrupted, for example by the
+// process being killed. Imports that were still being staged are rolled back, so that the source directory is
+// as it was. Imports that were being committed are finished. Imports that another process is still working on
+// are left alone.
+func RecoverStaged(ctx context.Context, cfg *Config) error {
+	var errs []error
+	var seen []string
+	for _, root := range []string{cfg.PathFormat.Root(), cfg.SinglesPathFormat.Root()} {
+		stagingDir := stagingDir(cfg, root)
+		if root == "" || stagingDir == "" || slices.Contains(seen, stagingDir) {
+			continue
+		}
+		seen = append(seen, stagingDir)
+
+		manifestPaths, err := fileutil.GlobDir(stagingDir, "*.json")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("glob manifests: %w", err))
+			continue
+		}
+		for _, p := range manifestPaths {
+			if err := recoverStage(ctx, cfg.destFS(), root, p); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(p), err))
+			}
+		}
+		_ = os.Remove(stagingDir) // only if empty
+	}
+	return errors.Join(errs...)
+}
+
+func recoverStage(ctx context.Context, fsys destfs.FS, root, manifestPath string) error {
+	lf, err := os.OpenFile(lockPath(manifestPath), os.O_CREATE|os.O_RDWR, 0o644) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("open lock file: %w", err)
+	}
+	defer lf.Close()
+
+	if ok, err := tryLockFile(lf); err != nil {
+		return fmt.Errorf("lock stage: %w", err)
+	} else if !ok {
+		return nil // still in progress
+	}
+
+	data, err := os.ReadFile(manifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // finished while we were waiting
+	}
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	var m stageManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("decode manifest: %w", err)
+	}
+	if !strings.HasPrefix(filepath.Base(m.Dir), stageDirPrefix) {
+		return fmt.Errorf("invalid stage dir %q", m.Dir)
+	}
+
+	if m.Committed {
+		if err := m.moveIntoPlace(fsys); err != nil {
+			return err
+		}
+		if m.Operation == "move" && m.SourceDir != m.Base && !m.Single {
+			if err := (Move{}).PostSource(ctx, NewDirContext(), root, m.SourceDir); err != nil {
+				return fmt.Errorf("clean source: %w", err)
+			}
+		}
+		slog.InfoContext(ctx, "finished staged import", "source", m.SourceDir, "dest", m.Base)
+	} else if err := m.rollback(ctx); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(m.Dir); err != nil {
+		return fmt.Errorf("remove stage: %w", err)
+	}
+	if err := os.Remove(manifestPath); err != nil {
+		return err
+	}
+	return os.Remove(lockPath(manifestPath))
+}
+
+// stagingDir is the local directory with the manifests of imports in progress under root. It's in root, unless
+// the library is remote.
+func stagingDir(cfg *Config, root string) string {
+	if !destfs.IsLocal(cfg.DestFS) {
+		return cfg.StagingDir
+	}
+	if root != "" {
+		return filepath.Join(root, StagingDirName)
+	}
+	return ""
+}
+
+// lockPath is the path of the file that's locked while a stage is in use. It's separate from the manifest,
+// since that's replaced each time it's written.
+func lockPath(manifestPath string) string {
+	return strings.TrimSuffix(manifestPath, ".json") + ".lock"
+}
+
+// overridden in _unix.go to lock with flock.
+var tryLockFile = func(*os.File) (bool, error) { return true, nil }
@@ -0,0 +1,19 @@
+//go:build unix
+
+package wrtag
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func init() {
+	tryLockFile = func(f *os.File) (bool, error) {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) //nolint:gosec
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
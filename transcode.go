@@ -0,0 +1,171 @@
+package wrtag
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.senan.xyz/wrtag/tags"
+)
+
+var ErrNoFFmpeg = errors.New("ffmpeg not found in PATH")
+
+const FFmpegCommand = "ffmpeg"
+
+// TranscodeFormat is a lossy format that Transcode can encode to.
+type TranscodeFormat struct {
+	Name           string
+	Ext            string
+	Codec          string
+	DefaultBitrate string
+}
+
+// TranscodeFormats are the formats that Transcode can encode to.
+var TranscodeFormats = []TranscodeFormat{
+	{Name: "opus", Ext: ".opus", Codec: "libopus", DefaultBitrate: "128k"},
+	{Name: "mp3", Ext: ".mp3", Codec: "libmp3lame", DefaultBitrate: "256k"},
+}
+
+// Transcode encodes audio files to a lossy format with ffmpeg, and writes the tags that the source had to the new
+// file. Anything else, like a cover or log, is copied. Like Copy, the source is left alone.
+type Transcode struct {
+	dryRun  bool
+	format  TranscodeFormat
+	bitrate string
+}
+
+// NewTranscode returns a Transcode to the named format in TranscodeFormats. An empty bitrate uses the format's
+// default.
+func NewTranscode(dryRun bool, format string, bitrate string) (Transcode, error) {
+	i := slices.IndexFunc(TranscodeFormats, func(f TranscodeFormat) bool { return f.Name == format })
+	if i < 0 {
+		return Transcode{}, fmt.Errorf("unknown transcode format %q", format)
+	}
+	f := TranscodeFormats[i]
+	return Transcode{dryRun: dryRun, format: f, bitrate: cmp.Or(bitrate, f.DefaultBitrate)}, nil
+}
+
+// Format returns the format that audio files are encoded to.
+func (t Transcode) Format() TranscodeFormat {
+	return t.format
+}
+
+func (t Transcode) CanModifyDest() bool {
+	return !t.dryRun
+}
+
+func (t Transcode) ProcessPath(ctx context.Context, dc DirContext, src, dest string, mode os.FileMode) error {
+	dc.knownDestPaths[dest] = struct{}{}
+
+	if filepath.Clean(src) == filepath.Clean(dest) {
+		return ErrSelfCopy
+	}
+
+	if !tags.CanRead(src) {
+		if t.dryRun {
+			slog.InfoContext(ctx, "copy", "from", src, "to", dest)
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+			return fmt.Errorf("create dest path: %w", err)
+		}
+		if err := copyFile(src, dest); err != nil {
+			return err
+		}
+		if err := os.Chmod(dest, mode); err != nil {
+			return fmt.Errorf("chmod dest: %w", err)
+		}
+		return nil
+	}
+
+	if t.dryRun {
+		slog.InfoContext(ctx, "transcode", "from", src, "to", dest, "format", t.format.Name, "bitrate", t.bitrate)
+		return nil
+	}
+
+	srcTags, err := tags.ReadTags(src)
+	if err != nil {
+		return fmt.Errorf("read source tags: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return fmt.Errorf("create dest path: %w", err)
+	}
+
+	// encode next to the dest, so that a half written file is never in place
+	tmp := filepath.Join(filepath.Dir(dest), ".wrtag-transcode-tmp-"+strconv.Itoa(os.Getpid())+"-"+filepath.Base(dest))
+	defer os.Remove(tmp) //nolint:errcheck
+
+	if err := ffmpeg(ctx, "-i", src, "-map", "0:a", "-map_metadata", "-1", "-c:a", t.format.Codec, "-b:a", t.bitrate, "-f", t.format.Name, tmp); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if err := tags.WriteTags(tmp, srcTags, tags.Clear); err != nil {
+		return fmt.Errorf("write tags: %w", err)
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return fmt.Errorf("chmod dest: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("rename into place: %w", err)
+	}
+
+	slog.DebugContext(ctx, "transcoded path", "from", src, "to", dest)
+	return nil
+}
+
+func (Transcode) PostSource(ctx context.Context, dc DirContext, limit string, src string) error {
+	return nil
+}
+
+// scaleCover writes src to dest scaled down to fit in maxSize by maxSize pixels, or as it is if it's smaller.
+func scaleCover(ctx context.Context, src, dest string, maxSize int, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return fmt.Errorf("create dest path: %w", err)
+	}
+
+	tmp := filepath.Join(filepath.Dir(dest), ".wrtag-transcode-tmp-"+strconv.Itoa(os.Getpid())+"-"+filepath.Base(dest))
+	defer os.Remove(tmp) //nolint:errcheck
+
+	scale := fmt.Sprintf("scale=w='min(%d,iw)':h='min(%d,ih)':force_original_aspect_ratio=decrease", maxSize, maxSize)
+	if err := ffmpeg(ctx, "-i", src, "-vf", scale, "-frames:v", "1", "-update", "1", tmp); err != nil {
+		return fmt.Errorf("scale: %w", err)
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return fmt.Errorf("chmod dest: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("rename into place: %w", err)
+	}
+	return nil
+}
+
+func ffmpeg(ctx context.Context, args ...string) error {
+	if _, err := exec.LookPath(FFmpegCommand); err != nil {
+		return fmt.Errorf("%w: %w", ErrNoFFmpeg, err)
+	}
+
+	args = append([]string{"-nostdin", "-hide_banner", "-loglevel", "error", "-y"}, args...)
+	cmd := exec.CommandContext(ctx, FFmpegCommand, args...) //nolint:gosec // args are only args and paths
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	slog.DebugContext(ctx, "starting subprocess", "command", cmd.Args)
+
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("run cmd: %w: stderr: %q", err, strings.TrimSpace(stderr.String()))
+		}
+		return fmt.Errorf("run cmd: %w", err)
+	}
+	return nil
+}
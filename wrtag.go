@@ -7,11 +7,13 @@ package wrtag
 import (
 	"cmp"
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
 	"path"
@@ -28,9 +30,15 @@ import (
 	"github.com/argusdusty/treelock"
 	dmp "github.com/sergi/go-diff/diffmatchpatch"
 	"go.senan.xyz/natcmp"
+	"go.senan.xyz/wrtag/acoustid"
 	"go.senan.xyz/wrtag/addon"
+	"go.senan.xyz/wrtag/assign"
 	"go.senan.xyz/wrtag/coverparse"
+	"go.senan.xyz/wrtag/destfs"
+	"go.senan.xyz/wrtag/discid"
+	"go.senan.xyz/wrtag/discogs"
 	"go.senan.xyz/wrtag/fileutil"
+	"go.senan.xyz/wrtag/library"
 	"go.senan.xyz/wrtag/musicbrainz"
 	"go.senan.xyz/wrtag/originfile"
 	"go.senan.xyz/wrtag/pathformat"
@@ -47,11 +55,12 @@ var (
 )
 
 func IsNonFatalError(err error) bool {
-	return errors.Is(err, ErrScoreTooLow) || errors.Is(err, ErrTrackCountMismatch)
+	return errors.Is(err, ErrScoreTooLow) || errors.Is(err, ErrNeedsConfirmation) || errors.Is(err, ErrRejected) ||
+		errors.Is(err, ErrTrackCountMismatch) || errors.Is(err, ErrDuplicate) || errors.Is(err, ErrKeptExisting)
 }
 
-// The minimum score required for a MusicBrainz match to be considered valid.
-const minScore = 95
+// DefaultMinScore is the default score a match needs to be imported without any rules or confirmation.
+const DefaultMinScore = 95
 
 const numTrackGenres = 6
 
@@ -60,14 +69,78 @@ const (
 	thresholdSizeTrim  uint64 = 3000 * 1e6 // 3000 MB
 )
 
+// DefaultNumCandidates is the default number of search results to diff when matching a directory or track.
+const DefaultNumCandidates = 3
+
 // SearchResult contains the results of a MusicBrainz lookup and potential import operation.
 type SearchResult struct {
 	Release    *musicbrainz.Release
+	Provider   string // the name of the provider the release is from
+	URL        string // the provider's page for the release
 	Query      musicbrainz.ReleaseQuery
 	Score      float64
 	DestDir    string
 	Diff       []Diff
 	OriginFile *originfile.OriginFile
+
+	// Candidates contains every release that was considered, best match first. The first
+	// candidate is the same as Release.
+	Candidates []Candidate
+
+	// Reason is why the release was or wasn't imported.
+	Reason ImportReason
+
+	// MissingTracks and ExtraFiles are set when a track count mismatch was resolved. They are the
+	// release tracks with no local file, and the local files with no release track.
+	MissingTracks []musicbrainz.Track
+	ExtraFiles    []string
+
+	// Files are the local files that were matched to release tracks, with where they were put.
+	Files []MatchedFile
+
+	// Duplicate is set when the release was already in the library, with what was done about it.
+	Duplicate *Duplicate
+
+	// Plan is what the import does. It's nil if there's nothing to do, because the release is being kept as it
+	// is as a duplicate, or is unchanged.
+	Plan *ImportPlan
+
+	// Drift is set for dry runs, with what the import would have changed.
+	Drift *Drift
+
+	// JournalID is the ID of the journal entry that the import was recorded in, which Journal.UndoID can undo.
+	JournalID string
+
+	// ReleaseHash identifies the release data that was written. Unchanged is set if nothing was written, because
+	// the release was already in place with the same hash and Config.SkipUnchanged is set.
+	ReleaseHash string
+	Unchanged   bool
+}
+
+// MatchedFile is a local file and the release track it was matched to.
+type MatchedFile struct {
+	Path       string
+	DestPath   string
+	DiscNumber int
+	Track      musicbrainz.Track
+}
+
+// Candidate is a release that was diffed against the local files while searching for a match.
+type Candidate struct {
+	Release     *musicbrainz.Release
+	Provider    string // the name of the provider the release is from
+	ReleaseID   string // the provider's ID for the release
+	URL         string // the provider's page for the release
+	SearchScore int    // provider search score (0-100), or 0 if the release was looked up directly or isn't scored
+	Score       float64
+	Diff        []Diff
+
+	// Mapping is the index of the local file assigned to each release track, if it's different from sort order.
+	Mapping []int
+
+	// DiscIDMatch is set when the release has a disc with exactly the disc ID calculated from a rip log or
+	// cue sheet. Like a tagged MBID, it's strong enough evidence to import with HighScoreOrMBID.
+	DiscIDMatch bool
 }
 
 // ImportCondition defines the conditions under which a release will be imported.
@@ -79,17 +152,104 @@ const (
 	Always
 )
 
+// ImportReason explains why a match was or wasn't imported.
+type ImportReason string
+
+const (
+	ReasonScoreTooLow ImportReason = "score too low"
+	ReasonHighScore   ImportReason = "high score"
+	ReasonMBID        ImportReason = "mbid"
+	ReasonDiscID      ImportReason = "disc id"
+	ReasonConfirmed   ImportReason = "confirmed"
+)
+
 // Config contains configuration options for processing music directories.
 type Config struct {
 	MusicBrainzClient     musicbrainz.MBClient
 	CoverArtArchiveClient musicbrainz.CAAClient
+	DiscogsClient         discogs.Client
 	PathFormat            pathformat.Format
+	SinglesPathFormat     pathformat.SinglesFormat
 	DiffWeights           DiffWeights
+	LengthTolerance       time.Duration
 	TagConfig             TagConfig
 	KeepFiles             map[string]struct{}
 	Addons                []addon.Addon
 	UpgradeCover          bool
 	FileMode              os.FileMode
+
+	// ImportRules decide whether a match is imported, needs confirmation, or is rejected, before falling back
+	// to the score threshold.
+	ImportRules ImportRules
+	// MinScore is the score threshold that a match needs to be imported when no rule decides. Defaults to
+	// DefaultMinScore.
+	MinScore float64
+
+	// ReleasePreferences choose between releases in the same release group that match equally well, and can
+	// exclude some releases from being chosen at all.
+	ReleasePreferences ReleasePreferences
+
+	// Providers are the names of the providers to search for releases, in order of fallback. Defaults to
+	// DefaultProvider.
+	Providers []string
+
+	// NumCandidates is the number of search results to diff against, taking the best. It applies to every
+	// provider, and to recording searches for singles. Values below 1 are treated as 1.
+	NumCandidates int
+
+	// ResolveTrackCount matches what files it can to release tracks by title when the local and release track
+	// counts differ, instead of failing with ErrTrackCountMismatch. Unmatched files are moved to ExtrasDir.
+	ResolveTrackCount bool
+	// ExtrasDir is the subdirectory of the release that unmatched files are moved to.
+	ExtrasDir string
+
+	// AcoustIDClient is used to identify files by fingerprint when their tags don't give us anything
+	// to search with. It's disabled if it has no APIKey.
+	AcoustIDClient acoustid.Client
+	// AcoustIDWriteTags fingerprints every file, and writes the fingerprint and AcoustID to the new tags.
+	AcoustIDWriteTags bool
+
+	// Journal records what each import changes, so that it can be undone.
+	Journal *Journal
+
+	// Index is kept up to date with the releases that are imported, if it's enabled.
+	Index *library.Index
+
+	// DuplicatePolicy decides what to do when the release is already in the library. Defaults to
+	// DuplicateReplaceBetter.
+	DuplicatePolicy DuplicatePolicy
+
+	// SkipUnchanged leaves a release that's already in place alone if its hash is the same as when it was last
+	// synced, as recorded in the Index. Tags aren't written and addons aren't run.
+	SkipUnchanged bool
+
+	// DestFS is the filesystem that releases are imported to. Defaults to the local filesystem. Imports to a
+	// remote one are staged in StagingDir, and uploaded when they're committed.
+	DestFS destfs.FS
+	// StagingDir is a local directory to stage imports to a remote DestFS in. Imports to the local filesystem
+	// are staged next to their destination instead.
+	StagingDir string
+
+	// MirrorPathFormat is where Mirror writes transcoded copies of releases in the library, with the extension
+	// of the transcode format.
+	MirrorPathFormat pathformat.Format
+	// MirrorCoverSize is the largest width and height of covers in the mirror. Larger covers are scaled down,
+	// and zero copies them as they are.
+	MirrorCoverSize int
+}
+
+func (cfg *Config) minScore() float64 {
+	if cfg.MinScore == 0 {
+		return DefaultMinScore
+	}
+	return cfg.MinScore
+}
+
+func (cfg *Config) destFS() destfs.FS {
+	if cfg.DestFS == nil {
+		return destfs.Local{}
+	}
+	return cfg.DestFS
 }
 
 // ProcessDir processes a music directory by looking up metadata on MusicBrainz and
@@ -99,13 +259,43 @@ type Config struct {
 // The srcDir must be an absolute path.
 // The cond parameter determines the conditions under which the import will proceed.
 // The useMBID parameter can be used to force a specific MusicBrainz release ID.
+//
+// It's the same as Plan followed by Apply, without checking the source dir in between.
 func ProcessDir(
 	ctx context.Context, cfg *Config,
 	op FileSystemOperation, srcDir string, cond ImportCondition, useMBID string,
+) (*SearchResult, error) {
+	res, err := Plan(ctx, cfg, op, srcDir, cond, useMBID)
+	if err != nil {
+		return res, err
+	}
+	if res.Plan == nil {
+		return res, nil
+	}
+
+	drift, journalID, err := apply(ctx, cfg, op, res.Plan)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Drift = drift
+	res.JournalID = journalID
+	res.DestDir = res.Plan.DestDir
+	return res, nil
+}
+
+// Plan matches a music directory like ProcessDir, and works out everything the import would do without
+// changing anything. If the release should be imported, the returned SearchResult has a Plan for Apply.
+func Plan(
+	ctx context.Context, cfg *Config,
+	op FileSystemOperation, srcDir string, cond ImportCondition, useMBID string,
 ) (*SearchResult, error) {
 	if cfg.PathFormat.Root() == "" {
 		return nil, errors.New("no path format provided")
 	}
+	if err := checkDestFS(cfg, op); err != nil {
+		return nil, err
+	}
 
 	if !filepath.IsAbs(srcDir) {
 		panic("src dir not abs") // this is a programmer error for now
@@ -156,38 +346,113 @@ func ProcessDir(
 		}
 	}
 
-	release, err := cfg.MusicBrainzClient.SearchRelease(ctx, query)
+	// find a CD table of contents from a rip log or cue sheet, for an exact lookup by disc id
+	var toc *discid.TOC
+	if mbid == "" {
+		toc, err = discid.Find(srcDir, func(path string) (time.Duration, error) {
+			props, err := tags.ReadProperties(path)
+			return props.Length, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("find disc toc: %w", err)
+		}
+	}
+
+	// fingerprint the files if we have nothing else to search with, or if we want to write the acoustid tags anyway
+	var ids []identification
+	if cfg.AcoustIDClient.APIKey != "" && (cfg.AcoustIDWriteTags || !hasSearchTerms(query)) {
+		ids, err = identifyPaths(ctx, &cfg.AcoustIDClient, pathTags)
+		if err != nil {
+			return nil, fmt.Errorf("identify by fingerprint: %w", err)
+		}
+	}
+
+	candidates, err := searchCandidates(ctx, cfg, query, useMBID, pathTags, toc, ids)
 	if err != nil {
-		return nil, fmt.Errorf("search musicbrainz: %w", err)
+		return nil, fmt.Errorf("search: %w", err)
 	}
 
+	best := candidates[0]
+	release, score, diff := best.Release, best.Score, best.Diff
 	releaseTracks := releaseTracks(release.Media)
 
-	var score float64
-	var diff []Diff
-	{
-		tagsOnly := mapFunc(pathTags, func(_ int, pt PathTags) map[string][]string { return pt.Tags })
-		tracksOnly := mapFunc(releaseTracks, func(_ int, tm releaseTrack) musicbrainz.Track { return tm.track })
+	if best.Mapping != nil {
+		orig, origIDs := pathTags, ids
+		pathTags, ids = nil, nil
+		for _, fi := range best.Mapping {
+			pathTags = append(pathTags, orig[fi])
+			if fi < len(origIDs) {
+				ids = append(ids, origIDs[fi])
+			}
+		}
+	}
 
-		score, diff = DiffRelease(cfg.DiffWeights, release, tracksOnly, tagsOnly)
+	res := &SearchResult{
+		Release:    release,
+		Provider:   best.Provider,
+		URL:        best.URL,
+		Query:      query,
+		Score:      score,
+		Diff:       diff,
+		OriginFile: originFile,
+		Candidates: candidates,
 	}
 
+	var extraFiles []PathTags
 	if len(pathTags) != len(releaseTracks) {
-		return &SearchResult{release, query, 0, "", diff, originFile}, fmt.Errorf("%w: %d remote / %d local", ErrTrackCountMismatch, len(releaseTracks), len(pathTags))
-	}
+		var matches []trackMatch
+		if cfg.ResolveTrackCount {
+			matches = matchTracksByTitle(pathTags, releaseTracks)
+		}
+		if len(matches) == 0 {
+			res.Score = 0
+			return res, fmt.Errorf("%w: %d remote / %d local", ErrTrackCountMismatch, len(releaseTracks), len(pathTags))
+		}
+
+		// only tag what we could match, and keep the rest as extras
+		matchedFiles := map[int]struct{}{}
+		matchedTracks := map[int]struct{}{}
+		var newPathTags []PathTags
+		var newReleaseTracks []releaseTrack
+		var newIDs []identification
+		for _, m := range matches {
+			matchedFiles[m.file] = struct{}{}
+			matchedTracks[m.track] = struct{}{}
+			newPathTags = append(newPathTags, pathTags[m.file])
+			newReleaseTracks = append(newReleaseTracks, releaseTracks[m.track])
+			if m.file < len(ids) {
+				newIDs = append(newIDs, ids[m.file])
+			}
+		}
+		for i, pt := range pathTags {
+			if _, ok := matchedFiles[i]; !ok {
+				extraFiles = append(extraFiles, pt)
+				res.ExtraFiles = append(res.ExtraFiles, pt.Path)
+			}
+		}
+		for i, rt := range releaseTracks {
+			if _, ok := matchedTracks[i]; !ok {
+				res.MissingTracks = append(res.MissingTracks, rt.track)
+			}
+		}
+		pathTags, releaseTracks, ids = newPathTags, newReleaseTracks, newIDs
+
+		tracksOnly := mapFunc(releaseTracks, func(_ int, tm releaseTrack) musicbrainz.Track { return tm.track })
+		score, diff = DiffRelease(cfg.DiffWeights, cfg.LengthTolerance, release, tracksOnly, pathTags)
+		res.Score, res.Diff = score, diff
 
-	var shouldImport bool
-	switch cond {
-	case HighScoreOrMBID:
-		shouldImport = score >= minScore || mbid != ""
-	case HighScore:
-		shouldImport = score >= minScore
-	case Always:
-		shouldImport = true
+		slog.InfoContext(ctx, "resolved track count mismatch", "matched", len(matches), "missing", len(res.MissingTracks), "extra", len(res.ExtraFiles))
 	}
 
-	if !shouldImport {
-		return &SearchResult{release, query, score, "", diff, originFile}, ErrScoreTooLow
+	res.Reason, err = decideImport(cfg.ImportRules, cfg.minScore(), cond, ruleMatch{
+		score:       score,
+		diff:        res.Diff,
+		compilation: musicbrainz.IsCompilation(release.ReleaseGroup),
+		mbid:        mbid != "",
+		discID:      best.DiscIDMatch,
+	})
+	if err != nil {
+		return res, err
 	}
 
 	destDir, err := DestDir(&cfg.PathFormat, release)
@@ -196,8 +461,10 @@ func ProcessDir(
 	}
 
 	origDestDir := destDir
-	if dir, err := filepath.EvalSymlinks(destDir); err == nil {
-		destDir = dir
+	if destfs.IsLocal(cfg.DestFS) {
+		if dir, err := filepath.EvalSymlinks(destDir); err == nil {
+			destDir = dir
+		}
 	}
 
 	labelInfo := musicbrainz.AnyLabelInfo(release)
@@ -218,88 +485,763 @@ func ProcessDir(
 		destPaths = append(destPaths, destPath)
 	}
 
-	var coverTmp string
+	// the same release might already be in the library, maybe in a different quality
+	if srcDir != destDir {
+		dup, err := findDuplicate(cfg.destFS(), destDir, release.ID, pathTags)
+		if err != nil {
+			return nil, fmt.Errorf("find duplicate: %w", err)
+		}
+		if dup != nil {
+			dup.Decision = decideDuplicate(cfg.DuplicatePolicy, cond, dup)
+			res.Duplicate = dup
+
+			slog.InfoContext(ctx, "release already in library", "dir", dup.Dir, "existing", dup.Existing, "new", dup.New, "decision", dup.Decision)
+
+			switch dup.Decision {
+			case DecisionKeptExisting:
+				res.DestDir = destDir
+				return res, ErrKeptExisting
+			case DecisionNeedsInput:
+				return res, ErrDuplicate
+			case DecisionKeptBoth:
+				bothDir := keepBothDir(cfg.destFS(), destDir, srcDir)
+				for i, p := range destPaths {
+					destPaths[i] = filepath.Join(bothDir, strings.TrimPrefix(p, destDir))
+				}
+				destDir = bothDir
+			}
+		}
+	}
+
+	for i, pt := range pathTags {
+		rt := releaseTracks[i]
+		res.Files = append(res.Files, MatchedFile{Path: pt.Path, DestPath: destPaths[i], DiscNumber: rt.media.Position, Track: rt.track})
+	}
+
+	res.ReleaseHash = releaseHash(release, cfg.TagConfig)
+	if cfg.SkipUnchanged && op.CanModifyDest() && srcDir == destDir {
+		state, err := cfg.Index.SyncState(ctx, srcDir)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("get sync state: %w", err)
+		}
+		if err == nil && state.Failures == 0 && state.ReleaseHash == res.ReleaseHash {
+			slog.DebugContext(ctx, "release unchanged since last sync", "dir", srcDir)
+			res.DestDir, res.Unchanged = destDir, true
+			return res, nil
+		}
+	}
+
+	plan := &ImportPlan{
+		Version:   planVersion,
+		Operation: operationName(op),
+		SourceDir: srcDir,
+		DestDir:   destDir,
+		ReleaseID: best.ReleaseID,
+		Provider:  best.Provider,
+		URL:       best.URL,
+		Score:     res.Score,
+		Reason:    res.Reason,
+
+		sourceTags: map[string]map[string][]string{},
+	}
+
+	for i, pt := range pathTags {
+		rt := releaseTracks[i]
+
+		sourceTags := pt.Tags
+		if cfg.AcoustIDWriteTags && i < len(ids) {
+			// write as if they were existing tags, so they're kept or dropped by the tag config like any other
+			sourceTags = maps.Clone(pt.Tags)
+			normtag.Set(sourceTags, normtag.AcoustIDFingerprint, ids[i].fingerprint.Fingerprint)
+			normtag.Set(sourceTags, normtag.AcoustIDID, trimZero(ids[i].id())...)
+		}
+
+		var destTags = map[string][]string{}
+		WriteRelease(destTags, release, labelInfo, genres, &rt.media, &rt.track)
+		ApplyTagConfig(destTags, sourceTags, cfg.TagConfig)
+		maps.DeleteFunc(destTags, func(_ string, vs []string) bool { return len(vs) == 0 }) // easier to read and edit
+
+		plan.Files = append(plan.Files, PlanFile{
+			Source:     pt.Path,
+			Dest:       destPaths[i],
+			DiscNumber: rt.media.Position,
+			Position:   rt.track.Position,
+			TrackID:    rt.track.ID,
+			Title:      rt.track.Title,
+			Tags:       destTags,
+		})
+		plan.sourceTags[pt.Path] = pt.Tags
+	}
+
 	if op.CanModifyDest() && (cover == "" || cfg.UpgradeCover) {
+		provider, err := cfg.Provider(best.Provider)
+		if err != nil {
+			return nil, err
+		}
+		coverURL, err := provider.GetCoverURL(ctx, best.ReleaseID, release)
+		if err != nil {
+			return nil, fmt.Errorf("get cover url: %w", err)
+		}
+		if coverURL != "" && cfg.CoverArtArchiveClient.Cache != nil && cfg.CoverArtArchiveClient.Cache.Offline {
+			// cover images aren't cached
+			slog.DebugContext(ctx, "skipping downloading cover while offline", "url", coverURL)
+			coverURL = ""
+		}
+		if coverURL != "" {
+			plan.Cover = &PlanCover{Action: CoverDownloaded, Source: cover, URL: coverURL}
+		}
+	}
+	if plan.Cover == nil && cover != "" {
+		plan.Cover = &PlanCover{Action: CoverKept, Source: cover}
+	}
+
+	for _, pt := range extraFiles {
+		rel, err := filepath.Rel(srcDir, pt.Path)
+		if err != nil {
+			return nil, fmt.Errorf("make extra file path relative: %w", err)
+		}
+		plan.Extras = append(plan.Extras, PlanPath{Source: pt.Path, Dest: filepath.Join(destDir, cfg.ExtrasDir, rel)})
+	}
+
+	for _, kf := range slices.Sorted(maps.Keys(cfg.KeepFiles)) {
+		src := filepath.Join(srcDir, kf)
+		if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		plan.Keep = append(plan.Keep, PlanPath{Source: src, Dest: filepath.Join(destDir, kf)})
+	}
+
+	plan.Delete, err = leftoverPaths(cfg.destFS(), plan)
+	if err != nil {
+		return nil, fmt.Errorf("find leftovers: %w", err)
+	}
+
+	plan.Source, err = sourceFiles(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("read source files: %w", err)
+	}
+
+	res.Plan = plan
+	return res, nil
+}
+
+// apply carries out a plan. Tags that the source files had are taken from the plan if it has them, for
+// the journal and to skip writing tags that are already right. The returned journal ID is set if the import
+// was recorded in the journal.
+func apply(ctx context.Context, cfg *Config, op FileSystemOperation, plan *ImportPlan) (drift *Drift, journalID string, err error) {
+	if err := checkDestFS(cfg, op); err != nil {
+		return nil, "", err
+	}
+
+	srcDir, destDir := plan.SourceDir, plan.DestDir
+	destPaths := mapFunc(plan.Files, func(_ int, f PlanFile) string { return f.Dest })
+
+	var cover, coverTmp string
+	if plan.Cover != nil {
+		cover = plan.Cover.Source
+	}
+	if plan.Cover != nil && plan.Cover.Action == CoverDownloaded && op.CanModifyDest() {
 		var err error
-		coverTmp, err = maybeFetchUpgradedCover(ctx, &cfg.CoverArtArchiveClient, release, cover, maxCoverSizeBytes)
+		coverTmp, err = maybeFetchUpgradedCover(ctx, &cfg.CoverArtArchiveClient, plan.Cover.URL, cover, maxCoverSizeBytes)
 		if err != nil {
-			return nil, fmt.Errorf("fetch cover: %w", err)
+			return nil, "", fmt.Errorf("fetch cover: %w", err)
 		}
 		if coverTmp != "" {
 			defer os.Remove(coverTmp) //nolint:errcheck
 		}
 	}
 
+	if !op.CanModifyDest() {
+		drift = &Drift{}
+	}
+
 	// lock both source and destination directories
 	unlock := lockPaths(
 		srcDir,
 		destDir,
 	)
 
-	dc := NewDirContext()
+	// put the release together in a stage first if it's going to a new dir, so that it's never left half
+	// imported. re-tags in place are written directly, unless they have to be uploaded
+	var st *stage
+	if op.CanModifyDest() && (srcDir != destDir || !destfs.IsLocal(cfg.DestFS)) {
+		var err error
+		st, err = newStage(cfg, cfg.PathFormat.Root(), op, srcDir, destDir, destPaths)
+		if err != nil {
+			return nil, "", fmt.Errorf("stage: %w", err)
+		}
+		defer func() {
+			if err := st.close(ctx); err != nil {
+				slog.ErrorContext(ctx, "close stage", "err", err)
+			}
+		}()
+	}
+
+	dc := NewDirContext().on(cfg.destFS())
+	if op.CanModifyDest() {
+		dc.journal, dc.entry = cfg.Journal, cfg.Journal.begin(op, srcDir, destDir, cfg.PathFormat.Root())
+	}
+	sdc := st.dirContext(dc)
+	if dc.entry != nil {
+		defer func() {
+			if !st.committed() || len(dc.entry.Files) == 0 && len(dc.entry.Removed) == 0 {
+				return
+			}
+			if err := cfg.Journal.append(dc.entry); err != nil {
+				slog.ErrorContext(ctx, "write journal entry", "err", err)
+				return
+			}
+			journalID = dc.entry.ID
+		}()
+	}
 
 	// move/copy and tag
-	for i := range pathTags {
-		pt, rt, destPath := pathTags[i], releaseTracks[i], destPaths[i]
+	for _, f := range plan.Files {
+		sourceTags := plan.sourceTags[f.Source]
 
-		if err := op.ProcessPath(ctx, dc, pt.Path, destPath, cfg.FileMode); err != nil {
-			return nil, fmt.Errorf("process path %q: %w", filepath.Base(pt.Path), err)
+		path, err := st.place(dc, f.Source, f.Dest, sourceTags)
+		if err != nil {
+			return nil, "", fmt.Errorf("place path %q: %w", filepath.Base(f.Source), err)
 		}
-
-		var destTags = map[string][]string{}
-		WriteRelease(destTags, release, labelInfo, genres, &rt.media, &rt.track)
-		ApplyTagConfig(destTags, pt.Tags, cfg.TagConfig)
+		if err := op.ProcessPath(ctx, sdc, f.Source, path, cfg.FileMode); err != nil {
+			return nil, "", fmt.Errorf("process path %q: %w", filepath.Base(f.Source), err)
+		}
+		dc.record(f.Source, f.Dest, sourceTags)
+		drift.addMove(f.Source, f.Dest)
 
 		if lvl, slog := slog.LevelDebug, slog.Default(); slog.Enabled(ctx, lvl) {
-			logTagChanges(ctx, pt.Path, lvl, pt.Tags, destTags)
+			logTagChanges(ctx, f.Source, lvl, sourceTags, f.Tags)
 		}
+		drift.addRetags(f.Source, sourceTags, f.Tags)
 
 		if !op.CanModifyDest() {
 			continue
 		}
-		if tags.Equal(pt.Tags, destTags) {
+		if tags.Equal(sourceTags, f.Tags) {
 			// try to avoid more io if we can
 			continue
 		}
 
-		if err := tags.WriteTags(destPath, destTags, tags.Clear); err != nil {
-			return nil, fmt.Errorf("write tag file: %w", err)
+		if err := breakLink(ctx, path, cfg.FileMode); err != nil {
+			return nil, "", fmt.Errorf("break link: %w", err)
+		}
+		if err := tags.WriteTags(path, f.Tags, tags.Clear); err != nil {
+			return nil, "", fmt.Errorf("write tag file: %w", err)
 		}
 	}
 
-	destCover, err := processCover(ctx, op, dc, destDir, cover, coverTmp, cfg.FileMode)
+	destCover, err := processCover(ctx, op, dc, st, destDir, cover, coverTmp, cfg.FileMode)
 	if err != nil {
-		return nil, fmt.Errorf("place cover: %w", err)
+		return nil, "", fmt.Errorf("place cover: %w", err)
+	}
+	if coverTmp == "" && cover != "" {
+		drift.addMove(cover, destCover)
 	}
 
-	// process addons with new files
+	// process addons with new files, while they're still staged
 	if op.CanModifyDest() {
+		stagedPaths := make([]string, 0, len(destPaths))
+		for _, p := range destPaths {
+			stagedPaths = append(stagedPaths, st.path(p))
+		}
+		if len(cfg.Addons) > 0 {
+			// addons may write to any of them
+			for _, p := range stagedPaths {
+				if err := breakLink(ctx, p, cfg.FileMode); err != nil {
+					return nil, "", fmt.Errorf("break link: %w", err)
+				}
+			}
+		}
 		for _, addon := range cfg.Addons {
-			if err := addon.ProcessRelease(ctx, destCover, destPaths); err != nil {
-				return nil, fmt.Errorf("process addon: %w", err)
+			if err := addon.ProcessRelease(ctx, destCover, stagedPaths); err != nil {
+				return nil, "", fmt.Errorf("process addon: %w", err)
 			}
 		}
 	}
 
-	for kf := range cfg.KeepFiles {
-		if err := op.ProcessPath(ctx, dc, filepath.Join(srcDir, kf), filepath.Join(destDir, kf), cfg.FileMode); err != nil && !errors.Is(err, os.ErrNotExist) {
-			return nil, fmt.Errorf("process keep file %q: %w", kf, err)
+	for _, e := range plan.Extras {
+		path, err := st.place(dc, e.Source, e.Dest, nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("place extra file %q: %w", filepath.Base(e.Source), err)
+		}
+		if err := op.ProcessPath(ctx, sdc, e.Source, path, cfg.FileMode); err != nil {
+			return nil, "", fmt.Errorf("process extra file %q: %w", filepath.Base(e.Source), err)
+		}
+		dc.record(e.Source, e.Dest, nil)
+		drift.addMove(e.Source, e.Dest)
+	}
+
+	for _, k := range plan.Keep {
+		if _, err := os.Stat(k.Source); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		path, err := st.place(dc, k.Source, k.Dest, nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("place keep file %q: %w", filepath.Base(k.Source), err)
+		}
+		if err := op.ProcessPath(ctx, sdc, k.Source, path, cfg.FileMode); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, "", fmt.Errorf("process keep file %q: %w", filepath.Base(k.Source), err)
 		}
+		dc.record(k.Source, k.Dest, nil)
+		drift.addMove(k.Source, k.Dest)
+	}
+
+	if err := st.commit(ctx, dc); err != nil {
+		return nil, "", fmt.Errorf("commit: %w", err)
 	}
 
-	if err := trimDestDir(ctx, dc, destDir, op.CanModifyDest()); err != nil {
-		return nil, fmt.Errorf("trim: %w", err)
+	deleted, err := trimDestDir(ctx, dc, plan.Delete, op.CanModifyDest())
+	if err != nil {
+		return nil, "", fmt.Errorf("trim: %w", err)
 	}
+	drift.addDeletes(deleted)
 
 	unlock()
 
 	if srcDir != destDir {
-		if err := op.PostSource(ctx, dc, cfg.PathFormat.Root(), srcDir); err != nil {
-			return nil, fmt.Errorf("clean: %w", err)
+		// the source is always local
+		if err := op.PostSource(ctx, dc.on(destfs.Local{}), cfg.PathFormat.Root(), srcDir); err != nil {
+			return nil, "", fmt.Errorf("clean: %w", err)
+		}
+	}
+
+	if op.CanModifyDest() {
+		if err := updateIndex(ctx, cfg.Index, srcDir, destDir); err != nil {
+			slog.ErrorContext(ctx, "update index", "err", err)
+		}
+	}
+
+	return drift, "", nil // the journal ID is set as the entry is written, when returning
+}
+
+// checkDestFS returns an error if op, or anything else the config asks for, can't be done on the destination
+// filesystem. Only moves and copies can be made to a remote library, and they can't be journalled or indexed.
+func checkDestFS(cfg *Config, op FileSystemOperation) error {
+	if destfs.IsLocal(cfg.DestFS) {
+		return nil
+	}
+	switch op.(type) {
+	case Move, Copy:
+	default:
+		return fmt.Errorf("can't %s to a remote library", operationName(op))
+	}
+	if cfg.Journal.enabled() {
+		return errors.New("imports to a remote library can't be journalled")
+	}
+	if cfg.Index.Enabled() {
+		return errors.New("imports to a remote library can't be indexed")
+	}
+	return nil
+}
+
+// searchCandidates finds releases for the query and diffs each against the local files. The candidates
+// are ranked with releases that have the right number of tracks first, then by score. Providers are searched
+// in order, and the next is only searched if no candidate so far would be imported without confirmation.
+// A release ID to use is looked up with the provider if only one is searched, like when a candidate from it
+// was picked.
+func searchCandidates(ctx context.Context, cfg *Config, query musicbrainz.ReleaseQuery, useID string, pathTags []PathTags, toc *discid.TOC, ids []identification) ([]Candidate, error) {
+	providers, err := cfg.providers()
+	if err != nil {
+		return nil, err
+	}
+	if query.MBReleaseID != "" && (useID == "" || len(providers) != 1) {
+		// a tagged mbid is a choice the user already made, even if we would search elsewhere
+		providers = []Provider{&MusicBrainzProvider{MB: &cfg.MusicBrainzClient, CAA: &cfg.CoverArtArchiveClient}}
+	}
+
+	var candidates []Candidate
+	for _, p := range providers {
+		found, err := findReleases(ctx, cfg, p, query, pathTags, toc, ids)
+		if errors.Is(err, musicbrainz.ErrNoResults) {
+			slog.DebugContext(ctx, "no results from provider", "provider", p.Name())
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name(), err)
+		}
+		for _, f := range found {
+			candidates = append(candidates, diffCandidate(cfg, p, f, pathTags))
+		}
+		if slices.ContainsFunc(candidates, func(c Candidate) bool {
+			_, err := decideImport(cfg.ImportRules, cfg.minScore(), HighScoreOrMBID, ruleMatch{
+				score:       c.Score,
+				diff:        c.Diff,
+				compilation: musicbrainz.IsCompilation(c.Release.ReleaseGroup),
+				mbid:        query.MBReleaseID != "",
+				discID:      c.DiscIDMatch,
+			})
+			return err == nil
+		}) {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, musicbrainz.ErrNoResults
+	}
+
+	// a tagged mbid is a choice the user already made, so only filter what we searched for
+	if query.MBReleaseID == "" {
+		candidates = slices.DeleteFunc(candidates, func(c Candidate) bool {
+			return cfg.ReleasePreferences.Excludes(c.Release)
+		})
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("all releases excluded by preferences: %w", musicbrainz.ErrNoResults)
+		}
+	}
+
+	// keep releases from the same group together, so that preferences can order them
+	groupKey := func(c Candidate) string {
+		if c.Release.ReleaseGroup.ID == "" {
+			return c.Provider + "/" + c.ReleaseID // providers without groups
+		}
+		return c.Release.ReleaseGroup.ID
+	}
+	groupOrder := map[string]int{}
+	for i, c := range candidates {
+		if _, ok := groupOrder[groupKey(c)]; !ok {
+			groupOrder[groupKey(c)] = i
+		}
+	}
+
+	// stable so that equal candidates stay in search order
+	slices.SortStableFunc(candidates, func(a, b Candidate) int {
+		aCountOK := len(releaseTracks(a.Release.Media)) == len(pathTags)
+		bCountOK := len(releaseTracks(b.Release.Media)) == len(pathTags)
+		return cmp.Or(
+			-cmpBool(aCountOK, bCountOK),
+			cmp.Compare(b.Score, a.Score),
+			cmp.Compare(groupOrder[groupKey(a)], groupOrder[groupKey(b)]),
+			cfg.ReleasePreferences.Compare(a.Release, b.Release),
+		)
+	})
+
+	return candidates, nil
+}
+
+// foundRelease is a release found by a provider, before it's diffed.
+type foundRelease struct {
+	id          string
+	release     *musicbrainz.Release
+	searchScore int
+	discIDMatch bool
+}
+
+// findReleases finds the releases that a provider has for the query. If the query has a release ID, only that
+// release is found. Otherwise for MusicBrainz, releases with a disc matching the TOC are preferred. If the
+// query has nothing useful to search with, the releases that the fingerprint identifications point to are
+// used instead.
+func findReleases(ctx context.Context, cfg *Config, p Provider, query musicbrainz.ReleaseQuery, pathTags []PathTags, toc *discid.TOC, ids []identification) ([]foundRelease, error) {
+	mb, isMB := p.(*MusicBrainzProvider)
+
+	if isMB && query.MBReleaseID != "" {
+		release, err := mb.MB.SearchRelease(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return []foundRelease{{id: release.ID, release: release}}, nil
+	}
+	if query.MBReleaseID != "" {
+		release, err := p.GetRelease(ctx, query.MBReleaseID)
+		if err != nil {
+			return nil, err
+		}
+		return []foundRelease{{id: query.MBReleaseID, release: release}}, nil
+	}
+
+	var results []musicbrainz.ReleaseSearchResult
+	var discIDMatch bool
+	if isMB && toc != nil {
+		releaseIDs, exact, err := mb.MB.LookupDiscID(ctx, toc.DiscID(), toc.String())
+		if err != nil && !errors.Is(err, musicbrainz.ErrNoResults) {
+			return nil, fmt.Errorf("lookup disc id: %w", err)
+		}
+		slog.DebugContext(ctx, "looked up disc id", "disc_id", toc.DiscID(), "exact", exact, "releases", len(releaseIDs))
+		for _, id := range releaseIDs {
+			results = append(results, musicbrainz.ReleaseSearchResult{ID: id})
+		}
+		discIDMatch = exact
+	}
+	if len(results) > 0 {
+		results = results[:min(len(results), max(cfg.NumCandidates, 1))]
+	} else if fpResults := fingerprintReleases(ids, len(pathTags)); isMB && len(fpResults) > 0 && !hasSearchTerms(query) {
+		results = fpResults[:min(len(fpResults), max(cfg.NumCandidates, 1))]
+	} else {
+		var err error
+		results, err = p.SearchReleases(ctx, query, max(cfg.NumCandidates, 1))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// one release that can't be fetched shouldn't stop the others from being compared
+	var found []foundRelease
+	var getErr error
+	for _, r := range results {
+		release, err := p.GetRelease(ctx, r.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			getErr = fmt.Errorf("get release by id %s: %w", r.ID, err)
+			slog.WarnContext(ctx, "skipping candidate", "provider", p.Name(), "id", r.ID, "err", err)
+			continue
+		}
+		found = append(found, foundRelease{id: r.ID, release: release, searchScore: r.Score, discIDMatch: discIDMatch})
+	}
+	if len(found) == 0 && getErr != nil {
+		return nil, getErr
+	}
+	return found, nil
+}
+
+// diffCandidate diffs a found release against the local files, assigning files to tracks by content if the
+// track counts match.
+func diffCandidate(cfg *Config, p Provider, f foundRelease, pathTags []PathTags) Candidate {
+	tracksOnly := mapFunc(releaseTracks(f.release.Media), func(_ int, tm releaseTrack) musicbrainz.Track { return tm.track })
+
+	files := pathTags
+	var mapping []int
+	if len(tracksOnly) == len(pathTags) {
+		mapping = assignFiles(pathTags, tracksOnly, cfg.LengthTolerance)
+	}
+	if mapping != nil {
+		files = mapFunc(mapping, func(_ int, fi int) PathTags { return pathTags[fi] })
+	}
+
+	score, diff := DiffRelease(cfg.DiffWeights, cfg.LengthTolerance, f.release, tracksOnly, files)
+
+	// show where files were assigned out of sort order
+	trackDiffs := diff[len(diff)-len(tracksOnly):]
+	for ti, fi := range mapping {
+		if ti != fi {
+			trackDiffs[ti].File = filepath.Base(pathTags[fi].Path)
+			trackDiffs[ti].Equal = false
+		}
+	}
+
+	return Candidate{
+		Release:     f.release,
+		Provider:    p.Name(),
+		ReleaseID:   f.id,
+		URL:         p.ReleaseURL(f.id),
+		SearchScore: f.searchScore,
+		Score:       score,
+		Diff:        diff,
+		DiscIDMatch: f.discIDMatch,
+		Mapping:     mapping,
+	}
+}
+
+// trackMatch pairs a local file with a release track, by index.
+type trackMatch struct {
+	file, track int
+}
+
+// minTitleSimilarity is how similar a file's title must be to a track's to be matched with it when resolving track
+// count mismatches.
+const minTitleSimilarity = 0.6
+
+// matchTracksByTitle pairs up local files and release tracks which have similar titles, for when there are more or
+// fewer files than tracks. Pairs are picked greedily, most similar first, preferring pairs with close positions for
+// ties. Files without a title tag use their file name. The matches are returned in release track order.
+func matchTracksByTitle(pathTags []PathTags, tracks []releaseTrack) []trackMatch {
+	type pair struct {
+		trackMatch
+		similarity float64
+	}
+	var pairs []pair
+	for fi, pt := range pathTags {
+		for ti, rt := range tracks {
+			similarity, ok := titleSimilarity(localTitle(pt), rt.track.Title)
+			if !ok || similarity < minTitleSimilarity {
+				continue
+			}
+			pairs = append(pairs, pair{trackMatch{fi, ti}, similarity})
+		}
+	}
+
+	slices.SortStableFunc(pairs, func(a, b pair) int {
+		return cmp.Or(
+			cmp.Compare(b.similarity, a.similarity),
+			cmp.Compare(abs(a.file-a.track), abs(b.file-b.track)),
+		)
+	})
+
+	usedFiles := map[int]struct{}{}
+	usedTracks := map[int]struct{}{}
+	var matches []trackMatch
+	for _, p := range pairs {
+		if _, ok := usedFiles[p.file]; ok {
+			continue
+		}
+		if _, ok := usedTracks[p.track]; ok {
+			continue
+		}
+		usedFiles[p.file] = struct{}{}
+		usedTracks[p.track] = struct{}{}
+		matches = append(matches, p.trackMatch)
+	}
+
+	slices.SortFunc(matches, func(a, b trackMatch) int {
+		return cmp.Compare(a.track, b.track)
+	})
+	return matches
+}
+
+// assignFiles works out which local file belongs to each release track, by title similarity and duration. It
+// returns the index of the file for each track. Sort order is only overridden when it's clearly wrong, so that
+// files without useful titles keep their order.
+func assignFiles(pathTags []PathTags, tracks []musicbrainz.Track, lengthTolerance time.Duration) []int {
+	n := len(tracks)
+	cost := make([][]float64, n)
+	for ti, track := range tracks {
+		cost[ti] = make([]float64, len(pathTags))
+		for fi, pt := range pathTags {
+			cost[ti][fi] = assignCost(pt, track, lengthTolerance) + reorderCost*float64(abs(ti-fi))/float64(n)
+		}
+	}
+
+	mapping := assign.Min(cost)
+
+	var identityCost, mappingCost float64
+	for ti := range tracks {
+		identityCost += cost[ti][ti]
+		mappingCost += cost[ti][mapping[ti]]
+	}
+	if identityCost-mappingCost < minReorderGain {
+		return nil
+	}
+	return mapping
+}
+
+const (
+	// reorderCost is a small cost for assigning a file away from its sort position, to break ties
+	reorderCost = 0.01
+	// minReorderGain is how much better than sort order an assignment must be before it's used, about half a title
+	minReorderGain = 0.5
+)
+
+// assignCost is how unlikely it is that the local file is the release track, from 0 to 2.
+func assignCost(pt PathTags, track musicbrainz.Track, lengthTolerance time.Duration) float64 {
+	var cost float64
+
+	if similarity, ok := titleSimilarity(localTitle(pt), track.Title); ok {
+		cost += 1 - similarity
+	} else {
+		cost += 0.5
+	}
+
+	if a, b := pt.Length, trackLength(track); a > 0 && b > 0 {
+		if delta := max(a-b, b-a) - lengthTolerance; delta > 0 {
+			cost += min(1, float64(delta)/float64(max(a, b)))
+		}
+	}
+
+	return cost
+}
+
+// localTitle is the title of a local file, or its file name if it has none.
+func localTitle(pt PathTags) string {
+	if title := normtag.Get(pt.Tags, normtag.Title); title != "" {
+		return title
+	}
+	return strings.TrimSuffix(filepath.Base(pt.Path), filepath.Ext(pt.Path))
+}
+
+// titleSimilarity compares two titles ignoring case and punctuation, from 0 for completely different to 1 for
+// the same. It returns false if either title is empty.
+func titleSimilarity(a, b string) (float64, bool) {
+	a, b = diffNormText(a), diffNormText(b)
+	if a == "" || b == "" {
+		return 0, false
+	}
+	dist := dm.DiffLevenshtein(dm.DiffMain(a, b, false))
+	return 1 - float64(dist)/float64(max(len([]rune(a)), len([]rune(b)))), true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// hasSearchTerms reports whether the query has anything that identifies a release. The track count
+// alone isn't enough.
+func hasSearchTerms(q musicbrainz.ReleaseQuery) bool {
+	return q.MBReleaseID != "" || q.MBArtistID != "" || q.MBReleaseGroupID != "" ||
+		q.Release != "" || q.Artist != "" || q.Barcode != "" || q.CatalogueNum != ""
+}
+
+// identification is what the AcoustID service knows about a file from its fingerprint.
+type identification struct {
+	fingerprint acoustid.Fingerprint
+	results     []acoustid.Result
+}
+
+// id returns the best matching AcoustID for the file, if any.
+func (id identification) id() string {
+	if len(id.results) == 0 {
+		return ""
+	}
+	return id.results[0].ID
+}
+
+func identifyPaths(ctx context.Context, client *acoustid.Client, pathTags []PathTags) ([]identification, error) {
+	ids := make([]identification, 0, len(pathTags))
+	for _, pt := range pathTags {
+		fp, err := acoustid.Calculate(ctx, pt.Path)
+		if err != nil {
+			return nil, fmt.Errorf("calculate fingerprint for %q: %w", filepath.Base(pt.Path), err)
+		}
+		results, err := client.Lookup(ctx, fp)
+		if err != nil {
+			return nil, fmt.Errorf("lookup fingerprint for %q: %w", filepath.Base(pt.Path), err)
 		}
+		ids = append(ids, identification{fingerprint: fp, results: results})
 	}
+	return ids, nil
+}
 
-	return &SearchResult{release, query, score, destDir, diff, originFile}, nil
+// fingerprintReleases ranks the releases which the identified recordings appear on. Each file votes once for
+// every release it might be from, weighted by the AcoustID score. The returned score is the percentage of
+// numFiles that voted for the release.
+func fingerprintReleases(ids []identification, numFiles int) []musicbrainz.ReleaseSearchResult {
+	var order []string
+	votes := map[string]float64{}
+	for _, id := range ids {
+		// best score this file gives each release
+		fileVotes := map[string]float64{}
+		for _, r := range id.results {
+			for _, rec := range r.Recordings {
+				for _, rel := range rec.Releases {
+					if _, ok := votes[rel.ID]; !ok {
+						order = append(order, rel.ID)
+						votes[rel.ID] = 0
+					}
+					fileVotes[rel.ID] = max(fileVotes[rel.ID], r.Score)
+				}
+			}
+		}
+		for relID, score := range fileVotes {
+			votes[relID] += score
+		}
+	}
+
+	results := make([]musicbrainz.ReleaseSearchResult, 0, len(order))
+	for _, id := range order {
+		results = append(results, musicbrainz.ReleaseSearchResult{
+			ID:    id,
+			Score: int(100 * votes[id] / float64(max(numFiles, 1))),
+		})
+	}
+	slices.SortStableFunc(results, func(a, b musicbrainz.ReleaseSearchResult) int {
+		return cmp.Compare(votes[b.ID], votes[a.ID])
+	})
+	return results
 }
 
 type releaseTrack struct {
@@ -351,6 +1293,9 @@ type PathTags struct {
 
 	// Tags contains the audio file's metadata tags
 	Tags map[string][]string
+
+	// Length is the audio duration of the file, or 0 if it couldn't be determined
+	Length time.Duration
 }
 
 // ReadReleaseDir reads a directory containing music files and extracts tags from each file.
@@ -377,14 +1322,11 @@ func ReadReleaseDir(dirPath string) (string, []PathTags, error) {
 		}
 
 		if tags.CanRead(path) {
-			tags, err := tags.ReadTags(path)
+			pt, err := readPathTags(path)
 			if err != nil {
 				return "", nil, fmt.Errorf("read track: %w", err)
 			}
-			pathTags = append(pathTags, PathTags{
-				Path: path,
-				Tags: tags,
-			})
+			pathTags = append(pathTags, pt)
 			continue
 		}
 	}
@@ -455,12 +1397,6 @@ func WriteRelease(
 	release *musicbrainz.Release, labelInfo musicbrainz.LabelInfo, genres []musicbrainz.Genre,
 	media *musicbrainz.Media, trk *musicbrainz.Track,
 ) {
-	formatDate := func(d time.Time) string {
-		if d.IsZero() {
-			return ""
-		}
-		return d.Format(time.DateOnly)
-	}
 	formatBool := func(b bool) string {
 		if !b {
 			return ""
@@ -476,30 +1412,6 @@ func WriteRelease(
 	disambiguationParts := trimZero(release.ReleaseGroup.Disambiguation, release.Disambiguation)
 	disambiguation := strings.Join(disambiguationParts, ", ")
 
-	collectCredits := func(rels []musicbrainz.Relation, typ string) (names, credits, ids []string) {
-		for _, r := range rels {
-			if r.Artist.ID != "" && r.Type == typ {
-				names = append(names, r.Artist.Name)
-				credits = append(credits, cmp.Or(r.TargetCredit, r.Artist.Name))
-				ids = append(ids, r.Artist.ID)
-			}
-		}
-		return
-	}
-
-	remixers, remixersCredit, remixerIDs := collectCredits(trk.Recording.Relations, "remixer")
-	producers, producersCredit, producerIDs := collectCredits(trk.Recording.Relations, "producer")
-	conductors, conductorsCredit, conductorIDs := collectCredits(trk.Recording.Relations, "conductor")
-
-	var workRelations []musicbrainz.Relation
-	for _, r := range trk.Recording.Relations {
-		workRelations = append(workRelations, r.Work.Relations...)
-	}
-
-	composers, composersCredit, composerIDs := collectCredits(workRelations, "composer")
-	lyricists, lyricistsCredit, lyricistIDs := collectCredits(workRelations, "lyricist")
-	arrangers, arrangersCredit, arrangerIDs := collectCredits(workRelations, "arranger")
-
 	// normtag.Set(t, x, trimZero(y)...) so that we clear out tags with no value from the map
 
 	normtag.Set(t, normtag.Album, trimZero(release.Title)...)
@@ -521,20 +1433,74 @@ func WriteRelease(
 	normtag.Set(t, normtag.MusicBrainzAlbumArtistID, trimZero(mapFunc(release.Artists, func(_ int, v musicbrainz.ArtistCredit) string { return v.Artist.ID })...)...)
 	normtag.Set(t, normtag.MusicBrainzAlbumComment, trimZero(disambiguation)...)
 
-	normtag.Set(t, normtag.Title, trimZero(trk.Title)...)
-	normtag.Set(t, normtag.Artist, trimZero(musicbrainz.ArtistsString(trk.Artists))...)
-	normtag.Set(t, normtag.Artists, trimZero(musicbrainz.ArtistsNames(trk.Artists)...)...)
-	normtag.Set(t, normtag.ArtistCredit, trimZero(musicbrainz.ArtistsCreditString(trk.Artists))...)
-	normtag.Set(t, normtag.ArtistsCredit, trimZero(musicbrainz.ArtistsCreditNames(trk.Artists)...)...)
-	normtag.Set(t, normtag.Genre, trimZero(cmp.Or(genreNames...))...)
-	normtag.Set(t, normtag.Genres, trimZero(genreNames...)...)
-	normtag.Set(t, normtag.TrackNumber, trimZero(strconv.Itoa(trk.Position))...)
-	normtag.Set(t, normtag.TrackTotal, trimZero(strconv.Itoa(media.TrackCount))...)
-	normtag.Set(t, normtag.DiscNumber, trimZero(strconv.Itoa(media.Position))...)
-	normtag.Set(t, normtag.DiscTotal, trimZero(strconv.Itoa(len(release.Media)))...)
-	normtag.Set(t, normtag.DiscSubtitle, trimZero(media.Title)...)
+	normtag.Set(t, normtag.Title, trimZero(trk.Title)...)
+	normtag.Set(t, normtag.Artist, trimZero(musicbrainz.ArtistsString(trk.Artists))...)
+	normtag.Set(t, normtag.Artists, trimZero(musicbrainz.ArtistsNames(trk.Artists)...)...)
+	normtag.Set(t, normtag.ArtistCredit, trimZero(musicbrainz.ArtistsCreditString(trk.Artists))...)
+	normtag.Set(t, normtag.ArtistsCredit, trimZero(musicbrainz.ArtistsCreditNames(trk.Artists)...)...)
+	normtag.Set(t, normtag.Genre, trimZero(cmp.Or(genreNames...))...)
+	normtag.Set(t, normtag.Genres, trimZero(genreNames...)...)
+	normtag.Set(t, normtag.TrackNumber, trimZero(strconv.Itoa(trk.Position))...)
+	normtag.Set(t, normtag.TrackTotal, trimZero(strconv.Itoa(media.TrackCount))...)
+	normtag.Set(t, normtag.DiscNumber, trimZero(strconv.Itoa(media.Position))...)
+	normtag.Set(t, normtag.DiscTotal, trimZero(strconv.Itoa(len(release.Media)))...)
+	normtag.Set(t, normtag.DiscSubtitle, trimZero(media.Title)...)
+
+	writeRecordingCredits(t, &trk.Recording)
+
+	normtag.Set(t, normtag.MusicBrainzTrackID, trimZero(trk.ID)...)
+	normtag.Set(t, normtag.MusicBrainzArtistID, trimZero(mapFunc(trk.Artists, func(_ int, v musicbrainz.ArtistCredit) string { return v.Artist.ID })...)...)
+}
+
+// WriteRecording populates a Tags structure with metadata from a MusicBrainz recording, for a track
+// that isn't part of a release. Only track-level tags are written.
+func WriteRecording(t map[string][]string, recording *musicbrainz.Recording, genres []musicbrainz.Genre) {
+	genreNames := make([]string, 0, numTrackGenres)
+	for _, g := range genres[:min(numTrackGenres, len(genres))] {
+		genreNames = append(genreNames, g.Name)
+	}
+
+	normtag.Set(t, normtag.Title, trimZero(recording.Title)...)
+	normtag.Set(t, normtag.Artist, trimZero(musicbrainz.ArtistsString(recording.Artists))...)
+	normtag.Set(t, normtag.Artists, trimZero(musicbrainz.ArtistsNames(recording.Artists)...)...)
+	normtag.Set(t, normtag.ArtistCredit, trimZero(musicbrainz.ArtistsCreditString(recording.Artists))...)
+	normtag.Set(t, normtag.ArtistsCredit, trimZero(musicbrainz.ArtistsCreditNames(recording.Artists)...)...)
+	normtag.Set(t, normtag.Date, trimZero(formatDate(parseAnyTime(recording.FirstReleaseDate)))...)
+	normtag.Set(t, normtag.Genre, trimZero(cmp.Or(genreNames...))...)
+	normtag.Set(t, normtag.Genres, trimZero(genreNames...)...)
+
+	writeRecordingCredits(t, recording)
+
+	normtag.Set(t, normtag.MusicBrainzArtistID, trimZero(mapFunc(recording.Artists, func(_ int, v musicbrainz.ArtistCredit) string { return v.Artist.ID })...)...)
+}
+
+// writeRecordingCredits writes the tags that belong to the recording itself, the same on any release it appears on.
+func writeRecordingCredits(t map[string][]string, recording *musicbrainz.Recording) {
+	collectCredits := func(rels []musicbrainz.Relation, typ string) (names, credits, ids []string) {
+		for _, r := range rels {
+			if r.Artist.ID != "" && r.Type == typ {
+				names = append(names, r.Artist.Name)
+				credits = append(credits, cmp.Or(r.TargetCredit, r.Artist.Name))
+				ids = append(ids, r.Artist.ID)
+			}
+		}
+		return
+	}
+
+	remixers, remixersCredit, remixerIDs := collectCredits(recording.Relations, "remixer")
+	producers, producersCredit, producerIDs := collectCredits(recording.Relations, "producer")
+	conductors, conductorsCredit, conductorIDs := collectCredits(recording.Relations, "conductor")
+
+	var workRelations []musicbrainz.Relation
+	for _, r := range recording.Relations {
+		workRelations = append(workRelations, r.Work.Relations...)
+	}
+
+	composers, composersCredit, composerIDs := collectCredits(workRelations, "composer")
+	lyricists, lyricistsCredit, lyricistIDs := collectCredits(workRelations, "lyricist")
+	arrangers, arrangersCredit, arrangerIDs := collectCredits(workRelations, "arranger")
 
-	normtag.Set(t, normtag.ISRC, trimZero(trk.Recording.ISRCs...)...)
+	normtag.Set(t, normtag.ISRC, trimZero(recording.ISRCs...)...)
 
 	normtag.Set(t, normtag.Remixer, trimZero(strings.Join(remixers, ", "))...)
 	normtag.Set(t, normtag.Remixers, trimZero(remixers...)...)
@@ -572,9 +1538,7 @@ func WriteRelease(
 	normtag.Set(t, normtag.ArrangersCredit, trimZero(arrangersCredit...)...)
 	normtag.Set(t, normtag.MusicBrainzArrangerID, trimZero(arrangerIDs...)...)
 
-	normtag.Set(t, normtag.MusicBrainzRecordingID, trimZero(trk.Recording.ID)...)
-	normtag.Set(t, normtag.MusicBrainzTrackID, trimZero(trk.ID)...)
-	normtag.Set(t, normtag.MusicBrainzArtistID, trimZero(mapFunc(trk.Artists, func(_ int, v musicbrainz.ArtistCredit) string { return v.Artist.ID })...)...)
+	normtag.Set(t, normtag.MusicBrainzRecordingID, trimZero(recording.ID)...)
 }
 
 // Diff represents a comparison between two tag values, showing the differences
@@ -583,16 +1547,128 @@ type Diff struct {
 	Field         string
 	Before, After []dmp.Diff
 	Equal         bool
+
+	// Weight is what the field's text distance was multiplied by. Distance is the weighted edit distance
+	// between the local and remote values, including any track length difference, out of Size characters.
+	// Fields with a side missing aren't scored, and have no Size.
+	Weight, Distance, Size float64
+	// Penalty is how many percentage points this field took off the final score.
+	Penalty float64
+
+	// File is the name of the local file for a track diff, if it was assigned to the track out of sort order.
+	File string
+
+	// BeforeLength and AfterLength are the local and remote durations of a track, if this is a
+	// track diff. Zero means the length is unknown.
+	BeforeLength, AfterLength time.Duration
+}
+
+// LengthDelta returns how much longer the remote track is than the local file, or 0 if either length is unknown.
+func (d Diff) LengthDelta() time.Duration {
+	if d.BeforeLength == 0 || d.AfterLength == 0 {
+		return 0
+	}
+	return d.AfterLength - d.BeforeLength
 }
 
 // DiffWeights maps tag field names to their relative importance when calculating match scores.
 // Higher weights make differences in those fields have greater impact on the overall score.
 type DiffWeights map[string]float64
 
+// ReleasePreferences are rules for choosing between releases of the same release group, in order of priority.
+type ReleasePreferences []ReleasePreference
+
+// ReleasePreference prefers releases by one of their fields. For "country", "format" and "status", Values are
+// in order of preference, and releases matching none of them come last. For "date", the single value is
+// "earliest" or "latest". Releases with any of the Values for "exclude-status" are never chosen.
+type ReleasePreference struct {
+	Field  string
+	Values []string
+}
+
+// Compare orders a before b if the first preference that tells them apart prefers it.
+func (ps ReleasePreferences) Compare(a, b *musicbrainz.Release) int {
+	for _, p := range ps {
+		if c := p.compare(a, b); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Excludes reports whether release should never be chosen.
+func (ps ReleasePreferences) Excludes(release *musicbrainz.Release) bool {
+	for _, p := range ps {
+		if p.Field == "exclude-status" && p.rank(release.Status) < len(p.Values) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ReleasePreference) compare(a, b *musicbrainz.Release) int {
+	switch p.Field {
+	case "country":
+		return cmp.Compare(p.rankCountry(a), p.rankCountry(b))
+	case "format":
+		return cmp.Compare(p.rankFormat(a), p.rankFormat(b))
+	case "status":
+		return cmp.Compare(p.rank(a.Status), p.rank(b.Status))
+	case "date":
+		aDate, bDate := a.Date.Time, b.Date.Time
+		switch {
+		case aDate.IsZero() || bDate.IsZero():
+			// unknown dates last
+			return -cmpBool(!aDate.IsZero(), !bDate.IsZero())
+		case len(p.Values) > 0 && p.Values[0] == "latest":
+			return bDate.Compare(aDate)
+		default:
+			return aDate.Compare(bDate)
+		}
+	}
+	return 0
+}
+
+func (p ReleasePreference) rankCountry(release *musicbrainz.Release) int {
+	r := p.rank(release.Country)
+	for _, ev := range release.ReleaseEvents {
+		for _, code := range ev.Area.Iso31661Codes {
+			r = min(r, p.rank(code))
+		}
+	}
+	return r
+}
+
+func (p ReleasePreference) rankFormat(release *musicbrainz.Release) int {
+	r := len(p.Values)
+	for _, m := range release.Media {
+		r = min(r, p.rank(m.Format))
+	}
+	return r
+}
+
+// rank is the position of v in the preferred values, or after all of them if it's not there.
+func (p ReleasePreference) rank(v string) int {
+	if v == "" {
+		return len(p.Values)
+	}
+	for i, pv := range p.Values {
+		if strings.EqualFold(pv, v) {
+			return i
+		}
+	}
+	return len(p.Values)
+}
+
+// DefaultLengthTolerance is how far a local track's duration may drift from the MusicBrainz track
+// length before it counts against the score.
+const DefaultLengthTolerance = 3 * time.Second
+
 // DiffRelease compares local tag files against a MusicBrainz release and calculates a match score.
 // It returns a score (0-100) indicating match confidence and detailed diffs for each compared field.
 // The weights parameter allows customizing the importance of different tag fields in the score calculation.
-func DiffRelease(weights DiffWeights, release *musicbrainz.Release, tracks []musicbrainz.Track, tagFiles []map[string][]string) (float64, []Diff) {
+// Track durations are compared too when known, with differences up to lengthTolerance being ignored.
+func DiffRelease(weights DiffWeights, lengthTolerance time.Duration, release *musicbrainz.Release, tracks []musicbrainz.Track, files []PathTags) (float64, []Diff) {
 	if len(tracks) == 0 {
 		return 0, nil
 	}
@@ -600,7 +1676,7 @@ func DiffRelease(weights DiffWeights, release *musicbrainz.Release, tracks []mus
 	labelInfo := musicbrainz.AnyLabelInfo(release)
 
 	var score float64
-	diff := Differ(&score)
+	s := &scorer{score: &score}
 
 	weight := func(t string) float64 {
 		if w, ok := weights[t]; ok {
@@ -611,33 +1687,45 @@ func DiffRelease(weights DiffWeights, release *musicbrainz.Release, tracks []mus
 
 	var diffs []Diff
 	{
-		tf := tagFiles[0]
+		tf := files[0].Tags
 		diffs = append(diffs,
-			diff(weight("release"), "release", normtag.Get(tf, normtag.Album), release.Title),
-			diff(weight("artist"), "artist", normtag.Get(tf, normtag.AlbumArtist), musicbrainz.ArtistsString(release.Artists)),
-			diff(weight("label"), "label", normtag.Get(tf, normtag.Label), labelInfo.Label.Name),
-			diff(weight("catalogue num"), "catalogue num", normtag.Get(tf, normtag.CatalogueNum), labelInfo.CatalogNumber),
-			diff(weight("barcode"), "barcode", normtag.Get(tf, normtag.Barcode), release.Barcode),
-			diff(weight("media format"), "media format", normtag.Get(tf, normtag.MediaFormat), release.Media[0].Format),
+			s.diff(weight("release"), "release", normtag.Get(tf, normtag.Album), release.Title),
+			s.diff(weight("artist"), "artist", normtag.Get(tf, normtag.AlbumArtist), musicbrainz.ArtistsString(release.Artists)),
+			s.diff(weight("label"), "label", normtag.Get(tf, normtag.Label), labelInfo.Label.Name),
+			s.diff(weight("catalogue num"), "catalogue num", normtag.Get(tf, normtag.CatalogueNum), labelInfo.CatalogNumber),
+			s.diff(weight("barcode"), "barcode", normtag.Get(tf, normtag.Barcode), release.Barcode),
+			s.diff(weight("media format"), "media format", normtag.Get(tf, normtag.MediaFormat), release.Media[0].Format),
 		)
 	}
 
-	for i := range max(len(tagFiles), len(tracks)) {
+	for i := range max(len(files), len(tracks)) {
 		var a, b string
-		if i < len(tagFiles) {
-			tagFile := tagFiles[i]
+		var aLength, bLength time.Duration
+		if i < len(files) {
+			tagFile := files[i].Tags
 			a = strings.Join(trimZero(normtag.Get(tagFile, normtag.Artist), normtag.Get(tagFile, normtag.Title)), " – ")
+			aLength = files[i].Length
 		}
 		if i < len(tracks) {
 			track := tracks[i]
 			b = strings.Join(trimZero(musicbrainz.ArtistsString(track.Artists), track.Title), " – ")
+			bLength = trackLength(track)
 		}
-		diffs = append(diffs, diff(weight("track"), fmt.Sprintf("track %d", i+1), a, b))
+		d := s.diff(weight("track"), fmt.Sprintf("track %d", i+1), a, b)
+		s.diffLength(weight("track length"), lengthTolerance, &d, aLength, bLength)
+		diffs = append(diffs, d)
 	}
 
+	s.penalize(diffs)
+
 	return score, diffs
 }
 
+func trackLength(track musicbrainz.Track) time.Duration {
+	ms := cmp.Or(track.Length, track.Recording.Length)
+	return time.Duration(ms) * time.Millisecond
+}
+
 var (
 	dm = dmp.New()
 )
@@ -645,33 +1733,81 @@ var (
 // Differ creates a difference function that compares two strings and updates a running score.
 // The returned function calculates text differences and accumulates weighted distances for scoring.
 func Differ(score *float64) func(weight float64, field string, a, b string) Diff {
-	var total float64
-	var totalDist float64
+	s := &scorer{score: score}
+	return s.diff
+}
 
-	return func(w float64, field, a, b string) Diff {
-		diffs := dm.DiffMain(a, b, false)
+// scorer accumulates weighted distances from a series of diffs into a single 0-100 score.
+type scorer struct {
+	score            *float64
+	total, totalDist float64
+}
 
-		var d Diff
-		d.Field = field
-		d.Before = filterFunc(diffs, func(d dmp.Diff) bool { return d.Type <= dmp.DiffEqual })
-		d.After = filterFunc(diffs, func(d dmp.Diff) bool { return d.Type >= dmp.DiffEqual })
-		d.Equal = a == b
+func (s *scorer) add(dist, total float64) {
+	s.totalDist += dist
+	s.total += total
+	*s.score = 100 - (s.totalDist * 100 / s.total)
+}
 
-		if a == "" || b == "" {
-			return d
-		}
+func (s *scorer) diff(w float64, field, a, b string) Diff {
+	diffs := dm.DiffMain(a, b, false)
 
-		// separate, norm diff for score calculation. only if we have both fields
-		aNorm, bNorm := diffNormText(a), diffNormText(b)
+	var d Diff
+	d.Field = field
+	d.Before = filterFunc(diffs, func(d dmp.Diff) bool { return d.Type <= dmp.DiffEqual })
+	d.After = filterFunc(diffs, func(d dmp.Diff) bool { return d.Type >= dmp.DiffEqual })
+	d.Equal = a == b
 
-		diffs = dm.DiffMain(aNorm, bNorm, false)
-		totalDist += float64(dm.DiffLevenshtein(diffs)) * w
-		total += float64(max(len([]rune(aNorm)), len([]rune(bNorm))))
+	if a == "" || b == "" {
+		return d
+	}
 
-		*score = 100 - (totalDist * 100 / total)
+	// separate, norm diff for score calculation. only if we have both fields
+	aNorm, bNorm := diffNormText(a), diffNormText(b)
 
-		return d
+	diffs = dm.DiffMain(aNorm, bNorm, false)
+	d.Weight = w
+	d.Distance = float64(dm.DiffLevenshtein(diffs)) * w
+	d.Size = float64(max(len([]rune(aNorm)), len([]rune(bNorm))))
+	s.add(d.Distance, d.Size)
+
+	return d
+}
+
+// penalize sets how much each of the diffs took off the final score, once everything has been scored.
+func (s *scorer) penalize(diffs []Diff) {
+	if s.total == 0 {
+		return
+	}
+	for i := range diffs {
+		diffs[i].Penalty = diffs[i].Distance * 100 / s.total
+	}
+}
+
+// lengthDiffSize is how many characters of text a track length comparison is worth in the score.
+const lengthDiffSize = 10
+
+// diffLength records the local and remote lengths on d, and scores how far apart they are. Anything within
+// the tolerance is considered equal and isn't scored at all, so that releases with known lengths score the
+// same as they would without them. Past that, the distance grows with the difference relative to the track
+// length, so a truncated or missing rip counts heavily while a few seconds of extra silence barely does.
+func (s *scorer) diffLength(w float64, tolerance time.Duration, d *Diff, a, b time.Duration) {
+	d.BeforeLength, d.AfterLength = a, b
+
+	if a == 0 || b == 0 {
+		return
+	}
+
+	delta := max(a-b, b-a) - tolerance
+	if delta <= 0 {
+		return
 	}
+
+	d.Equal = false
+	frac := min(1, float64(delta)/float64(max(a, b)))
+	d.Size += lengthDiffSize
+	d.Distance += frac * lengthDiffSize * w
+	s.add(frac*lengthDiffSize*w, lengthDiffSize)
 }
 
 func diffNormText(input string) string {
@@ -732,7 +1868,7 @@ var defaultKeepConfig = []string{
 }
 
 // FileSystemOperation defines operations that can be performed on files during the import/tagging process.
-// Implementations handle different ways to transfer files (move, copy, reflink) while maintaining consistent behaviours.
+// Implementations handle different ways to transfer files (move, copy, reflink, link) while maintaining consistent behaviours.
 type FileSystemOperation interface {
 	// CanModifyDest returns whether this operation can modify existing destination files.
 	// Note: If down the line some sort of "in place" tagging operation is needed, then a `CanModifySource` may be appropriate too.
@@ -746,15 +1882,34 @@ type FileSystemOperation interface {
 }
 
 // DirContext tracks known files in the destination directory. After a release is put in place,
-// unknown files not in the DirContext will be deleted.
+// unknown files not in the DirContext will be deleted. If the import is being journalled, it also
+// records what was changed. Files are placed and removed in its filesystem, which is local by default.
 type DirContext struct {
 	knownDestPaths map[string]struct{}
+
+	fs      destfs.FS
+	journal *Journal
+	entry   *JournalEntry
 }
 
 func NewDirContext() DirContext {
 	return DirContext{knownDestPaths: map[string]struct{}{}}
 }
 
+// on returns a copy of dc that places and removes files in fsys. The copy shares its known paths and journal
+// entry with dc.
+func (dc DirContext) on(fsys destfs.FS) DirContext {
+	dc.fs = fsys
+	return dc
+}
+
+func (dc DirContext) destFS() destfs.FS {
+	if dc.fs == nil {
+		return destfs.Local{}
+	}
+	return dc.fs
+}
+
 type Move struct {
 	dryRun bool
 }
@@ -777,31 +1932,16 @@ func (m Move) ProcessPath(ctx context.Context, dc DirContext, src, dest string,
 		return nil
 	}
 
-	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+	fsys := dc.destFS()
+	if err := fsys.MkdirAll(filepath.Dir(dest)); err != nil {
 		return fmt.Errorf("create dest path: %w", err)
 	}
 
-	if err := os.Rename(src, dest); err != nil {
-		if errNo := syscall.Errno(0); errors.As(err, &errNo) && errNo == 18 /*  invalid cross-device link */ {
-			// we tried to rename across filesystems. copy and delete instead
-			if err := copyFile(src, dest); err != nil {
-				return fmt.Errorf("copy from move: %w", err)
-			}
-			if err := os.Remove(src); err != nil {
-				return fmt.Errorf("remove from move: %w", err)
-			}
-			if err := os.Chmod(dest, mode); err != nil {
-				return fmt.Errorf("chmod dest: %w", err)
-			}
-
-			slog.DebugContext(ctx, "moved path", "from", src, "to", dest)
-			return nil
-		}
-
-		return fmt.Errorf("rename: %w", err)
+	if err := destfs.Move(fsys, src, dest); err != nil {
+		return err
 	}
 
-	if err := os.Chmod(dest, mode); err != nil {
+	if err := fsys.Chmod(dest, mode); err != nil {
 		return fmt.Errorf("chmod dest: %w", err)
 	}
 
@@ -828,7 +1968,7 @@ func (m Move) PostSource(ctx context.Context, dc DirContext, limit string, src s
 	defer unlock()
 
 	for _, p := range toRemove {
-		if err := safeRemoveAll(ctx, p, m.dryRun); err != nil {
+		if err := safeRemoveAll(ctx, dc, p, m.dryRun); err != nil {
 			return fmt.Errorf("safe remove all: %w", err)
 		}
 	}
@@ -858,18 +1998,11 @@ func (c Copy) ProcessPath(ctx context.Context, dc DirContext, src, dest string,
 		return nil
 	}
 
-	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
-		return fmt.Errorf("create dest path: %w", err)
-	}
-
-	if err := copyFile(src, dest); err != nil {
+	// parents are created, and the mode set, as it's uploaded
+	if err := destfs.Upload(dc.destFS(), src, dest, mode); err != nil {
 		return err
 	}
 
-	if err := os.Chmod(dest, mode); err != nil {
-		return fmt.Errorf("chmod dest: %w", err)
-	}
-
 	slog.DebugContext(ctx, "copied path", "from", src, "to", dest)
 	return nil
 }
@@ -902,7 +2035,11 @@ func (c Reflink) ProcessPath(ctx context.Context, dc DirContext, src, dest strin
 		return nil
 	}
 
-	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+	fsys := dc.destFS()
+	if !destfs.IsLocal(fsys) {
+		return errRemoteLink
+	}
+	if err := fsys.MkdirAll(filepath.Dir(dest)); err != nil {
 		return fmt.Errorf("create dest path: %w", err)
 	}
 
@@ -910,7 +2047,7 @@ func (c Reflink) ProcessPath(ctx context.Context, dc DirContext, src, dest strin
 		return fmt.Errorf("reflink file: %w", err)
 	}
 
-	if err := os.Chmod(dest, mode); err != nil {
+	if err := fsys.Chmod(dest, mode); err != nil {
 		return fmt.Errorf("chmod dest: %w", err)
 	}
 
@@ -922,34 +2059,206 @@ func (Reflink) PostSource(ctx context.Context, dc DirContext, limit string, src
 	return nil
 }
 
-// trimDestDir deletes all items in a destination dir that don't look like they should be there.
-func trimDestDir(ctx context.Context, dc DirContext, dest string, canModifyDest bool) error {
-	entries, err := os.ReadDir(dest)
-	if !canModifyDest && errors.Is(err, os.ErrNotExist) {
-		// this is fine if we're only doing a dry run
-	} else if err != nil {
-		return fmt.Errorf("read dir: %w", err)
+// ReflinkOrCopy reflinks files like Reflink where the filesystem supports it, and copies them otherwise.
+type ReflinkOrCopy struct {
+	dryRun bool
+}
+
+func NewReflinkOrCopy(dryRun bool) ReflinkOrCopy {
+	return ReflinkOrCopy{dryRun: dryRun}
+}
+
+func (c ReflinkOrCopy) CanModifyDest() bool {
+	return !c.dryRun
+}
+
+func (c ReflinkOrCopy) ProcessPath(ctx context.Context, dc DirContext, src, dest string, mode os.FileMode) error {
+	dc.knownDestPaths[dest] = struct{}{}
+
+	if filepath.Clean(src) == filepath.Clean(dest) {
+		return ErrSelfCopy
+	}
+
+	if c.dryRun {
+		slog.InfoContext(ctx, "reflink or copy", "from", src, "to", dest)
+		return nil
+	}
+
+	fsys := dc.destFS()
+	if !destfs.IsLocal(fsys) {
+		return errRemoteLink
+	}
+	if err := fsys.MkdirAll(filepath.Dir(dest)); err != nil {
+		return fmt.Errorf("create dest path: %w", err)
+	}
+
+	if err := reflink.Auto(src, dest); err != nil {
+		return fmt.Errorf("reflink or copy file: %w", err)
+	}
+
+	if err := fsys.Chmod(dest, mode); err != nil {
+		return fmt.Errorf("chmod dest: %w", err)
+	}
+
+	slog.DebugContext(ctx, "reflinked or copied path", "from", src, "to", dest)
+	return nil
+}
+
+func (ReflinkOrCopy) PostSource(ctx context.Context, dc DirContext, limit string, src string) error {
+	return nil
+}
+
+// Hardlink links files from the source to the destination, so they take no extra space, as long as both
+// are on the same filesystem. Files that are tagged, or processed by addons, have their link replaced with a
+// copy first, so the source is never changed. That keeps it usable for seeding.
+type Hardlink struct {
+	dryRun bool
+}
+
+func NewHardlink(dryRun bool) Hardlink {
+	return Hardlink{dryRun: dryRun}
+}
+
+func (h Hardlink) CanModifyDest() bool {
+	return !h.dryRun
+}
+
+func (h Hardlink) ProcessPath(ctx context.Context, dc DirContext, src, dest string, mode os.FileMode) error {
+	dc.knownDestPaths[dest] = struct{}{}
+
+	if filepath.Clean(src) == filepath.Clean(dest) {
+		return ErrSelfCopy
+	}
+
+	if h.dryRun {
+		slog.InfoContext(ctx, "hardlink", "from", src, "to", dest)
+		return nil
+	}
+
+	fsys := dc.destFS()
+	if !destfs.IsLocal(fsys) {
+		return errRemoteLink
+	}
+	if err := fsys.MkdirAll(filepath.Dir(dest)); err != nil {
+		return fmt.Errorf("create dest path: %w", err)
+	}
+
+	// the mode is left alone, since it's shared with the source
+	if err := os.Link(src, dest); err != nil {
+		return fmt.Errorf("hardlink file: %w", err)
+	}
+
+	slog.DebugContext(ctx, "hardlinked path", "from", src, "to", dest)
+	return nil
+}
+
+func (Hardlink) PostSource(ctx context.Context, dc DirContext, limit string, src string) error {
+	return nil
+}
+
+// Symlink links files from the destination to the source, which can be on any filesystem. Like Hardlink,
+// files that are tagged or processed by addons are replaced with a copy first.
+type Symlink struct {
+	dryRun bool
+}
+
+func NewSymlink(dryRun bool) Symlink {
+	return Symlink{dryRun: dryRun}
+}
+
+func (s Symlink) CanModifyDest() bool {
+	return !s.dryRun
+}
+
+func (s Symlink) ProcessPath(ctx context.Context, dc DirContext, src, dest string, mode os.FileMode) error {
+	dc.knownDestPaths[dest] = struct{}{}
+
+	if filepath.Clean(src) == filepath.Clean(dest) {
+		return ErrSelfCopy
+	}
+
+	if s.dryRun {
+		slog.InfoContext(ctx, "symlink", "from", src, "to", dest)
+		return nil
+	}
+
+	fsys := dc.destFS()
+	if !destfs.IsLocal(fsys) {
+		return errRemoteLink
+	}
+	if err := fsys.MkdirAll(filepath.Dir(dest)); err != nil {
+		return fmt.Errorf("create dest path: %w", err)
+	}
+
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return fmt.Errorf("make source abs: %w", err)
+	}
+	if err := os.Symlink(src, dest); err != nil {
+		return fmt.Errorf("symlink file: %w", err)
 	}
 
+	slog.DebugContext(ctx, "symlinked path", "from", src, "to", dest)
+	return nil
+}
+
+func (Symlink) PostSource(ctx context.Context, dc DirContext, limit string, src string) error {
+	return nil
+}
+
+// errRemoteLink is returned by operations that link or reflink files, which can only be done on the local
+// filesystem.
+var errRemoteLink = errors.New("files can only be linked on the local filesystem")
+
+// breakLink replaces path with a copy of itself if it's a symlink, or a hardlink that shares its data with
+// another path, so that writing to it doesn't change the file it's linked to.
+func breakLink(ctx context.Context, path string, mode os.FileMode) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 && !isHardlinked(info) {
+		return nil
+	}
+
+	if err := copyFile(path, path); err != nil {
+		return fmt.Errorf("copy linked file: %w", err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("chmod copy: %w", err)
+	}
+
+	slog.DebugContext(ctx, "replaced link with copy", "path", path)
+	return nil
+}
+
+// overridden in link_unix.go, where the number of links is known.
+var isHardlinked = func(os.FileInfo) bool { return false }
+
+// trimDestDir deletes the leftovers in a destination dir that were planned to be deleted, unless the import put
+// something there. It returns what was deleted, or what would have been for a dry run.
+func trimDestDir(ctx context.Context, dc DirContext, leftovers []string, canModifyDest bool) ([]string, error) {
 	var toDelete []string
 	var size uint64
-	for _, entry := range entries {
-		path := filepath.Join(dest, entry.Name())
+	for _, path := range leftovers {
 		if _, ok := dc.knownDestPaths[path]; ok {
 			continue
 		}
-		if entry.IsDir() {
-			continue
+		info, err := dc.destFS().Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // probably moved in place
 		}
-		info, err := entry.Info()
 		if err != nil {
-			return fmt.Errorf("get info: %w", err)
+			return nil, fmt.Errorf("get info: %w", err)
+		}
+		if info.IsDir() {
+			continue
 		}
 		size += uint64(info.Size()) //nolint:gosec
 		toDelete = append(toDelete, path)
 	}
 	if size > thresholdSizeTrim {
-		return fmt.Errorf("extra files were too big to remove: %d/%d", size, thresholdSizeTrim)
+		return nil, fmt.Errorf("extra files were too big to remove: %d/%d", size, thresholdSizeTrim)
 	}
 
 	var deleteErrs []error
@@ -958,15 +2267,34 @@ func trimDestDir(ctx context.Context, dc DirContext, dest string, canModifyDest
 			slog.InfoContext(ctx, "delete extra file", "path", p)
 			continue
 		}
-		if err := os.Remove(p); err != nil {
+		if err := dc.remove(p); err != nil {
 			deleteErrs = append(deleteErrs, err)
 		}
 		slog.InfoContext(ctx, "deleted extra file", "path", p)
 	}
 	if err := errors.Join(deleteErrs...); err != nil {
-		return fmt.Errorf("delete extra files: %w", err)
+		return nil, fmt.Errorf("delete extra files: %w", err)
 	}
 
+	return toDelete, nil
+}
+
+// moveFile renames src to dest, or copies and deletes it if they're on different filesystems.
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err != nil {
+		if errNo := syscall.Errno(0); errors.As(err, &errNo) && errNo == 18 /*  invalid cross-device link */ {
+			// we tried to rename across filesystems. copy and delete instead
+			if err := copyFile(src, dest); err != nil {
+				return fmt.Errorf("copy from move: %w", err)
+			}
+			if err := os.Remove(src); err != nil {
+				return fmt.Errorf("remove from move: %w", err)
+			}
+			return nil
+		}
+
+		return fmt.Errorf("rename: %w", err)
+	}
 	return nil
 }
 
@@ -1015,7 +2343,7 @@ func copyFile(src, dest string) (err error) {
 
 const maxCoverSizeBytes = 8 * 1024 * 1024 // 8 MiB
 
-func maybeFetchUpgradedCover(ctx context.Context, caa *musicbrainz.CAAClient, release *musicbrainz.Release, cover string, maxSize int64) (string, error) {
+func maybeFetchUpgradedCover(ctx context.Context, caa *musicbrainz.CAAClient, coverURL string, cover string, maxSize int64) (string, error) {
 	skipFunc := func(resp *http.Response) bool {
 		if resp.ContentLength > maxSize {
 			slog.WarnContext(ctx, "skipping downloading cover which is larger than max size", "size_bytes", resp.ContentLength, "max_size_bytes", maxCoverSizeBytes)
@@ -1031,7 +2359,7 @@ func maybeFetchUpgradedCover(ctx context.Context, caa *musicbrainz.CAAClient, re
 		return resp.ContentLength == info.Size()
 	}
 
-	coverTmp, err := downloadMusicBrainzCover(ctx, caa, release, skipFunc)
+	coverTmp, err := downloadCover(ctx, caa, coverURL, skipFunc)
 	if err != nil {
 		return "", fmt.Errorf("maybe fetch better cover: %w", err)
 	}
@@ -1040,41 +2368,40 @@ func maybeFetchUpgradedCover(ctx context.Context, caa *musicbrainz.CAAClient, re
 }
 
 func processCover(
-	ctx context.Context, op FileSystemOperation, dc DirContext,
+	ctx context.Context, op FileSystemOperation, dc DirContext, st *stage,
 	destDir, cover, coverNew string, mode os.FileMode,
 ) (string, error) {
-	coverPath := func(p string) string {
-		ext := strings.ToLower(filepath.Ext(p))
-		return filepath.Join(destDir, "cover"+ext)
-	}
-
 	if coverNew != "" {
-		destCover := coverPath(coverNew)
-		if err := (Move{}).ProcessPath(ctx, dc, coverNew, destCover, mode); err != nil {
+		destCover := coverDest(destDir, coverNew)
+		path, err := st.place(dc, "", destCover, nil)
+		if err != nil {
+			return "", fmt.Errorf("place new cover: %w", err)
+		}
+		if err := (Move{}).ProcessPath(ctx, st.dirContext(dc), coverNew, path, mode); err != nil {
 			return "", fmt.Errorf("move new cover to dest: %w", err)
 		}
-		return destCover, nil
+		dc.recordCover(CoverDownloaded, "", destCover)
+		return path, nil
 	}
 
 	if cover != "" {
-		destCover := coverPath(cover)
-		if err := op.ProcessPath(ctx, dc, cover, destCover, mode); err != nil {
+		destCover := coverDest(destDir, cover)
+		path, err := st.place(dc, cover, destCover, nil)
+		if err != nil {
+			return "", fmt.Errorf("place cover: %w", err)
+		}
+		if err := op.ProcessPath(ctx, st.dirContext(dc), cover, path, mode); err != nil {
 			return "", fmt.Errorf("move file to dest: %w", err)
 		}
-		return destCover, nil
+		dc.recordCover(CoverKept, cover, destCover)
+		return path, nil
 	}
 	return "", nil
 }
 
-func downloadMusicBrainzCover(ctx context.Context, caa *musicbrainz.CAAClient, release *musicbrainz.Release, skipFunc func(*http.Response) bool) (string, error) {
-	coverURL, err := caa.GetCoverURL(ctx, release)
-	if err != nil {
-		return "", err
-	}
-	if coverURL == "" {
-		return "", nil
-	}
-
+// downloadCover downloads a provider's cover to a temporary file, using the CoverArtArchive client to make
+// the request.
+func downloadCover(ctx context.Context, caa *musicbrainz.CAAClient, coverURL string, skipFunc func(*http.Response) bool) (string, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, coverURL, nil)
 	if err != nil {
 		return "", err
@@ -1126,7 +2453,7 @@ func dirSize(path string) (uint64, error) {
 	return size, err
 }
 
-func safeRemoveAll(ctx context.Context, src string, dryRun bool) error {
+func safeRemoveAll(ctx context.Context, dc DirContext, src string, dryRun bool) error {
 	entries, err := os.ReadDir(src)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -1154,7 +2481,12 @@ func safeRemoveAll(ctx context.Context, src string, dryRun bool) error {
 		return fmt.Errorf("folder was too big for clean up: %d/%d", size, thresholdSizeClean)
 	}
 
-	if err := os.RemoveAll(src); err != nil {
+	for _, entry := range entries {
+		if err := dc.remove(filepath.Join(src, entry.Name())); err != nil {
+			return fmt.Errorf("error cleaning up folder: %w", err)
+		}
+	}
+	if err := dc.removeDir(src); err != nil {
 		return fmt.Errorf("error cleaning up folder: %w", err)
 	}
 
@@ -1185,6 +2517,17 @@ func trimZero[T comparable](elms ...T) []T {
 	return slices.DeleteFunc(elms, func(t T) bool { return t == zero })
 }
 
+func cmpBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
 func releaseTypes(rg musicbrainz.ReleaseGroup) []string {
 	var types []string
 	if rg.PrimaryType != "" {
@@ -1196,6 +2539,13 @@ func releaseTypes(rg musicbrainz.ReleaseGroup) []string {
 	return types
 }
 
+func formatDate(d time.Time) string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format(time.DateOnly)
+}
+
 func parseAnyTime(str string) time.Time {
 	t, _ := dateparse.ParseAny(str)
 	return t
@@ -2,9 +2,13 @@ package wrtag
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/wrtag/musicbrainz"
+	"go.senan.xyz/wrtag/tags/normtag"
 )
 
 // ⚠️ Note, core wrtag functionality is tested from ./cmd/wrtag/
@@ -114,6 +118,121 @@ func TestNegativeScore(t *testing.T) {
 	assert.InEpsilon(t, 37, score, 1)
 }
 
+func TestDiffReleaseLength(t *testing.T) {
+	t.Parallel()
+
+	release := &musicbrainz.Release{Title: "Kat Moda"}
+	release.Media = []musicbrainz.Media{{}}
+
+	tracks := []musicbrainz.Track{
+		{Title: "Alarms", Length: 242_000},
+		{Title: "The Bells", Length: 352_000},
+	}
+	files := func(a, b time.Duration) []PathTags {
+		return []PathTags{
+			{Tags: map[string][]string{normtag.Album: {"Kat Moda"}, normtag.Title: {"Alarms"}}, Length: a},
+			{Tags: map[string][]string{normtag.Album: {"Kat Moda"}, normtag.Title: {"The Bells"}}, Length: b},
+		}
+	}
+
+	// within tolerance
+	score, diff := DiffRelease(nil, 3*time.Second, release, tracks, files(244*time.Second, 350*time.Second))
+	assert.InEpsilon(t, 100.0, score, 0)
+	assert.True(t, diff[len(diff)-1].Equal)
+	assert.Equal(t, 2*time.Second, diff[len(diff)-1].LengthDelta())
+
+	// truncated rip of the second track
+	score, diff = DiffRelease(nil, 3*time.Second, release, tracks, files(242*time.Second, 60*time.Second))
+	assert.Less(t, score, 80.0)
+	assert.False(t, diff[len(diff)-1].Equal)
+
+	// unknown lengths are ignored
+	score, diff = DiffRelease(nil, 3*time.Second, release, tracks, files(0, 0))
+	assert.InEpsilon(t, 100.0, score, 0)
+	assert.Zero(t, diff[len(diff)-1].LengthDelta())
+
+	// and so are lengths with no weight
+	score, _ = DiffRelease(DiffWeights{"track length": 0}, 3*time.Second, release, tracks, files(242*time.Second, 60*time.Second))
+	assert.InEpsilon(t, 100.0, score, 0)
+
+	// lengths within tolerance don't change the score of a release that doesn't match exactly
+	misspelt := files(244*time.Second, 350*time.Second)
+	misspelt[1].Tags[normtag.Title] = []string{"The Bell"}
+	score, diff = DiffRelease(nil, 3*time.Second, release, tracks, misspelt)
+	assert.InDelta(t, 100-100.0/21, score, 0.001) // 1 of "katmoda", "alarms", and "thebells"
+	assert.InDelta(t, 8.0, diff[len(diff)-1].Size, 0)
+	misspelt[0].Length, misspelt[1].Length = 0, 0
+	unknownScore, _ := DiffRelease(nil, 3*time.Second, release, tracks, misspelt)
+	assert.InDelta(t, unknownScore, score, 0)
+}
+
+func TestDiffReleasePenalties(t *testing.T) {
+	t.Parallel()
+
+	release := &musicbrainz.Release{Title: "Kat Moda"}
+	release.Media = []musicbrainz.Media{{}}
+
+	tracks := []musicbrainz.Track{
+		{Title: "Alarms", Length: 242_000},
+		{Title: "The Bells", Length: 352_000},
+	}
+	files := []PathTags{
+		{Tags: map[string][]string{normtag.Album: {"Kat Mode"}, normtag.Title: {"Alarms"}}, Length: 242 * time.Second},
+		{Tags: map[string][]string{normtag.Album: {"Kat Mode"}, normtag.Title: {"The Bell"}}, Length: 60 * time.Second},
+	}
+
+	score, diff := DiffRelease(DiffWeights{"release": 2}, 3*time.Second, release, tracks, files)
+
+	var total float64
+	for _, d := range diff {
+		total += d.Penalty
+	}
+	assert.InDelta(t, 100-score, total, 0.001)
+
+	assert.Equal(t, "release", diff[0].Field)
+	assert.InDelta(t, 2.0, diff[0].Weight, 0)
+	assert.InDelta(t, 2.0, diff[0].Distance, 0)
+	assert.Positive(t, diff[0].Penalty)
+
+	assert.Zero(t, diff[len(diff)-2].Penalty)
+	assert.Greater(t, diff[len(diff)-1].Penalty, diff[0].Penalty)
+}
+
+func TestReleasePreferences(t *testing.T) {
+	t.Parallel()
+
+	release := func(country, format, status string, year int) *musicbrainz.Release {
+		var r musicbrainz.Release
+		r.Country = country
+		r.Status = status
+		r.Media = []musicbrainz.Media{{Format: format}}
+		if year > 0 {
+			r.Date.Time = time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		}
+		return &r
+	}
+
+	digital := release("XW", "Digital Media", "Official", 2001)
+	vinyl := release("GB", "12\" Vinyl", "Official", 1997)
+	bootleg := release("", "CD", "Bootleg", 0)
+
+	prefs := ReleasePreferences{{Field: "format", Values: []string{"cd", "12\" vinyl"}}}
+	assert.Equal(t, -1, prefs.Compare(vinyl, digital))
+	assert.Equal(t, -1, prefs.Compare(bootleg, vinyl))
+
+	prefs = ReleasePreferences{{Field: "country", Values: []string{"US"}}, {Field: "date", Values: []string{"earliest"}}}
+	assert.Equal(t, 1, prefs.Compare(digital, vinyl))
+	assert.Equal(t, -1, prefs.Compare(digital, bootleg)) // unknown dates last
+
+	prefs = ReleasePreferences{{Field: "date", Values: []string{"latest"}}}
+	assert.Equal(t, -1, prefs.Compare(digital, vinyl))
+
+	prefs = ReleasePreferences{{Field: "exclude-status", Values: []string{"Bootleg", "Pseudo-Release"}}}
+	assert.True(t, prefs.Excludes(bootleg))
+	assert.False(t, prefs.Excludes(digital))
+	assert.Equal(t, 0, prefs.Compare(digital, vinyl))
+}
+
 func TestDiffNormText(t *testing.T) {
 	t.Parallel()
 
@@ -129,6 +248,7 @@ func TestIsNonFatalError(t *testing.T) {
 
 	assert.True(t, IsNonFatalError(ErrScoreTooLow))
 	assert.True(t, IsNonFatalError(ErrTrackCountMismatch))
+	assert.True(t, IsNonFatalError(ErrKeptExisting))
 	assert.False(t, IsNonFatalError(ErrNoTracks))
 	assert.False(t, IsNonFatalError(ErrNotSortable))
 	assert.False(t, IsNonFatalError(ErrSelfCopy))